@@ -0,0 +1,440 @@
+// Package agent is the TMGC service agent: it discovers the dependencies of a managed service, starts and
+// supervises the managed process, registers it with the service registry, applies the unavailability impacts of
+// its dependencies and serves the management API. The tmgcagent binary is a thin wrapper around it, and it can be
+// embedded in other binaries and driven directly by tests. Binaries embedding it must call sandbox.Init first
+// thing in main: the agent starts sandboxed managed processes, and those with rlimits, through their own binary.
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/consul"
+	"github.com/aambhaik/tmgcagent/discovery"
+	"github.com/aambhaik/tmgcagent/dns"
+	"github.com/aambhaik/tmgcagent/lifecycle"
+	"github.com/aambhaik/tmgcagent/static"
+	"github.com/robfig/cron"
+)
+
+var (
+	validServiceTypes = []string{"Watch", "Timer", "Weather"}
+
+	consulDiscovery     = "consul"
+	staticDiscovery     = "static"
+	fileDiscovery       = "file"
+	validDiscoveryTypes = []string{consulDiscovery, staticDiscovery, fileDiscovery}
+
+	runBinary      = "binary"
+	runScript      = "script"
+	validExecTypes = []string{runBinary, runScript}
+
+	shutdownManagedServiceImpact  = "shutdown-managed-service"
+	suspendManagedServiceImpact   = "suspend-managed-service"
+	reviveDependencyServiceImpact = "revive-dependency-service"
+	validImpactTypes              = []string{shutdownManagedServiceImpact, suspendManagedServiceImpact, reviveDependencyServiceImpact}
+
+	//registrations made by the agent carry this meta, so that stale ones left by earlier runs can be recognized
+	agentMetaKey   = "managed-by"
+	agentMetaValue = "tmgcagent"
+	//and the index of the replica they register
+	replicaMetaKey = "replica"
+)
+
+// DefaultStateDir is where the agent persists its state unless WithStateDir says otherwise
+const DefaultStateDir = "/var/lib/tmgc"
+
+// Logger is the logging interface of the agent. *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Clock tells the agent the time
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Option configures an Agent
+type Option func(*Agent)
+
+// WithConfig sets the agent configuration. it is required
+func WithConfig(config *conf.TMGCAgentConfig) Option {
+	return func(a *Agent) { a.config = config }
+}
+
+// WithRegistry sets the service registry. by default the registry is created from the service-discovery section
+// of the configuration
+func WithRegistry(registry discovery.Registry) Option {
+	return func(a *Agent) { a.registry = registry }
+}
+
+// WithLogger sets the logger, the standard logger by default
+func WithLogger(logger Logger) Option {
+	return func(a *Agent) { a.logger = logger }
+}
+
+// WithClock sets the clock, the system clock by default
+func WithClock(clock Clock) Option {
+	return func(a *Agent) { a.clock = clock }
+}
+
+// WithStateDir sets the directory where the agent persists its state across restarts, DefaultStateDir by default
+func WithStateDir(dir string) Option {
+	return func(a *Agent) { a.stateDir = dir }
+}
+
+// WithListener makes the management API serve on listener instead of listening on the configured management port
+func WithListener(listener net.Listener) Option {
+	return func(a *Agent) { a.listener = listener }
+}
+
+// Agent supervises one managed service
+type Agent struct {
+	config   *conf.TMGCAgentConfig
+	registry discovery.Registry
+	resolver *dns.Resolver
+	logger   Logger
+	clock    Clock
+	stateDir string
+
+	//guards the replicas, the job runs and the fields set by Run
+	mu sync.Mutex
+	//replicas of the managed service, by index
+	replicas []*replica
+	//runs of a job, the oldest first
+	jobRuns   []*jobRun
+	nextRunId int
+	//audit trail of the scalings, the oldest first, and when the replicas were last scaled
+	scalingDecisions []scalingDecision
+	lastScaled       time.Time
+	//local proxies to the dependencies
+	proxies []*dependencyProxy
+	//probed endpoints of the dependencies, by dependency key
+	endpointHealth map[string][]*endpointHealth
+	//node and datacenter of the local agent of the registry, once known
+	locality *discovery.Locality
+	//active tiers of the dependencies with fallbacks, by dependency key
+	activeTiers map[string]*dependencyTier
+	//datacenters the dependencies with datacenters are looked up in, by dependency key
+	activeDatacenters map[string]*activeDatacenter
+	//states of the dependency groups as of the last evaluation, by name
+	groupStates map[string]*groupState
+	//availability of the members of the dependency groups as of the last evaluation, by dependency key
+	memberAvailability map[string]bool
+
+	cron       *cron.Cron
+	listener   net.Listener
+	server     *http.Server
+	handedOver bool
+	//closed when the agent resumes after a failed handoff, nil unless it is handing the managed service over
+	resumed chan struct{}
+	//the listener the management server accepts from, and the connections it accepted and has not read from yet
+	accepting *handoffListener
+	unread    map[net.Conn]bool
+
+	//only one upgrade, and one scaling, may be in flight
+	upgradeLock sync.Mutex
+	scaleLock   sync.Mutex
+	//serializes the updates of the state files
+	stateLock sync.Mutex
+
+	//done is closed by Shutdown, finished when Run has returned
+	shutdownOnce sync.Once
+	done         chan struct{}
+	finished     chan struct{}
+	//the probes of the dependency endpoints, which restart replicas, waited for by Run
+	probing sync.WaitGroup
+}
+
+// New validates the configuration and creates an agent. nothing is started until Run
+func New(opts ...Option) (*Agent, error) {
+	a := &Agent{
+		logger:   log.New(os.Stderr, "", log.LstdFlags),
+		clock:    systemClock{},
+		stateDir: DefaultStateDir,
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.config == nil {
+		return nil, errors.New("the agent requires a configuration")
+	}
+
+	//check managed service type.
+	managedServiceConf := a.config.ServiceAgent.ManagedService
+	if !validateValue(managedServiceConf.Type, validServiceTypes) {
+		return nil, fmt.Errorf("invalid type found in the service configuration: %v, valid types are: %v", managedServiceConf.Type, validServiceTypes)
+	}
+	if !validateValue(managedServiceConf.Process.Type, validExecTypes) {
+		return nil, fmt.Errorf("invalid type found in the service configuration: %v, valid types are: %v", managedServiceConf.Process.Type, validExecTypes)
+	}
+	if err := validateLimits(managedServiceConf.Process.Limits); err != nil {
+		return nil, fmt.Errorf("invalid limits configuration: %v", err)
+	}
+	if err := validateSandbox(managedServiceConf.Process.Sandbox); err != nil {
+		return nil, fmt.Errorf("invalid sandbox configuration: %v", err)
+	}
+	if err := validateReadiness(managedServiceConf.Readiness); err != nil {
+		return nil, fmt.Errorf("invalid readiness configuration: %v", err)
+	}
+	if err := validateLiveness(managedServiceConf.Liveness); err != nil {
+		return nil, fmt.Errorf("invalid liveness configuration: %v", err)
+	}
+	if err := validateRestartPolicy(managedServiceConf.Restart); err != nil {
+		return nil, fmt.Errorf("invalid restart configuration: %v", err)
+	}
+	if err := validateHooks(managedServiceConf.Hooks); err != nil {
+		return nil, fmt.Errorf("invalid hooks configuration: %v", err)
+	}
+	if err := validateJob(managedServiceConf.Job); err != nil {
+		return nil, fmt.Errorf("invalid job configuration: %v", err)
+	}
+	if err := validateReplicas(managedServiceConf.Replicas, managedServiceConf.Ports); err != nil {
+		return nil, fmt.Errorf("invalid replicas configuration: %v", err)
+	}
+	if managedServiceConf.Job != nil && (managedServiceConf.Readiness != nil || managedServiceConf.Liveness != nil || managedServiceConf.Restart != nil || managedServiceConf.Hooks != nil) {
+		return nil, fmt.Errorf("readiness, liveness, restart and hooks do not apply to jobs")
+	}
+	if err := validateAutoscale(managedServiceConf.Autoscale); err != nil {
+		return nil, fmt.Errorf("invalid autoscale configuration: %v", err)
+	}
+	if managedServiceConf.Job != nil && (managedServiceConf.Replicas > 1 || managedServiceConf.Ports != nil || managedServiceConf.Autoscale != nil) {
+		return nil, fmt.Errorf("replicas, ports and autoscaling do not apply to jobs")
+	}
+	if err := validateProxies(managedServiceConf.ServiceDependency); err != nil {
+		return nil, fmt.Errorf("invalid proxy configuration: %v", err)
+	}
+	if err := validateEndpointProbes(managedServiceConf.ServiceDependency); err != nil {
+		return nil, fmt.Errorf("invalid dependency probe configuration: %v", err)
+	}
+	if err := validateSelectors(managedServiceConf.ServiceDependency); err != nil {
+		return nil, fmt.Errorf("invalid dependency selector configuration: %v", err)
+	}
+	if err := validateFallbacks(managedServiceConf.ServiceDependency); err != nil {
+		return nil, fmt.Errorf("invalid dependency fallback configuration: %v", err)
+	}
+	if err := validateFailover(managedServiceConf.ServiceDependency); err != nil {
+		return nil, fmt.Errorf("invalid dependency failover configuration: %v", err)
+	}
+	if err := validateDependencyGroups(managedServiceConf.DependencyGroups, managedServiceConf.ServiceDependency); err != nil {
+		return nil, fmt.Errorf("invalid dependency group configuration: %v", err)
+	}
+	if err := validateUsage(managedServiceConf.Usage); err != nil {
+		return nil, fmt.Errorf("invalid usage configuration: %v", err)
+	}
+
+	if a.registry == nil {
+		registry, err := newServiceRegistry(a.config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to %v server running on : %v, %v", a.config.ServiceAgent.ServiceDiscovery.Type, a.config.ServiceAgent.ServiceDiscovery.URL, err)
+		}
+		a.registry = registry
+	}
+
+	//dependencies with a srv-name are resolved through DNS instead of the registry
+	a.resolver = dns.NewResolver(a.config.ServiceAgent.ServiceDiscovery.DNSServer)
+
+	replicas := 1
+	if !a.isJob() {
+		replicas = a.replicaCount()
+	}
+	for index := 0; index < replicas; index++ {
+		a.replicas = append(a.replicas, a.newReplica(index))
+	}
+	return a, nil
+}
+
+// Run starts the dependency proxies, starts (or adopts) the managed service, registers it, starts the dependency
+// checks (or schedules the runs of a job) and serves the management API until ctx is done or Shutdown is called.
+// the managed process is left running when Run returns, so that a restarted agent can adopt it; use Stop to stop it.
+func (a *Agent) Run(ctx context.Context) error {
+	finished := make(chan struct{})
+	a.mu.Lock()
+	a.finished = finished
+	a.mu.Unlock()
+	defer close(finished)
+	defer a.stopServing()
+	defer a.probing.Wait()
+	//stops the liveness probes and pending restarts
+	defer a.shutdownOnce.Do(func() { close(a.done) })
+
+	//the proxies listen before the managed process is given their endpoints
+	if err := a.startProxies(); err != nil {
+		return err
+	}
+	a.probeDependenciesJob()
+	if a.isJob() {
+		if err := a.scheduleJob(); err != nil {
+			return err
+		}
+	} else if err := a.startService(); err != nil {
+		return err
+	}
+	a.reportUsageJob()
+
+	//start the service agent's own http routes to enable life-cycle management of the managed service.
+	if err := a.listen(); err != nil {
+		return err
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- a.server.Serve(a.accepting) }()
+	a.signalUpgradeReady()
+	a.logger.Printf("Agent for service %v started successfully", a.config.ServiceAgent.ManagedService.Process.Exec)
+
+	select {
+	case <-ctx.Done():
+	case <-a.done:
+	case err := <-serveErr:
+		if err != http.ErrServerClosed {
+			return err
+		}
+	}
+	return nil
+}
+
+// start (or adopt) the replicas of the managed service, register them and start the dependency checks
+func (a *Agent) startService() error {
+	//remove the registrations that earlier runs left behind, except those the replicas are registered under again
+	a.cleanupStaleRegistrations()
+	for _, r := range a.replicaList() {
+		if err := r.start("agent started"); err != nil {
+			return err
+		}
+	}
+
+	//start a cron job that checks with consul if all the dependency services on which the managed service depends are healthy. the job, at present, also takes remediation action
+	//on the managed service if the dependency services go bad. the remediation actions can be policy driven instead of arbitrary.
+	a.checkDependencyHealthJob()
+	a.checkLivenessJob()
+	a.autoscaleJob()
+	return nil
+}
+
+// stop the dependency checks, the proxies and the management API, finishing in-flight requests
+func (a *Agent) stopServing() {
+	a.mu.Lock()
+	c, server := a.cron, a.server
+	a.mu.Unlock()
+	if c != nil {
+		c.Stop()
+	}
+	a.stopProxies()
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}
+}
+
+// Shutdown makes Run stop the dependency checks and the management API, and waits for it to return until ctx is
+// done. the managed process keeps running
+func (a *Agent) Shutdown(ctx context.Context) error {
+	a.shutdownOnce.Do(func() { close(a.done) })
+	a.mu.Lock()
+	finished := a.finished
+	a.mu.Unlock()
+	if finished == nil {
+		return nil
+	}
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop stops all replicas of the managed service, or the active runs of a job
+func (a *Agent) Stop(reason string) error {
+	if a.isJob() {
+		return a.stopJobRuns(reason)
+	}
+	return a.eachReplica(func(r *replica) error { return r.stopManagedService(reason) })
+}
+
+// start all replicas of the managed service again, or start a run of a job
+func (a *Agent) start(reason string) error {
+	if a.isJob() {
+		return a.triggerJob(reason)
+	}
+	return a.eachReplica(func(r *replica) error { return r.startManagedService(reason) })
+}
+
+// State returns the lifecycle state of the (first replica of the) managed service
+func (a *Agent) State() lifecycle.State {
+	return a.first().managedService.Lifecycle.State()
+}
+
+// History returns the recent lifecycle transitions of the (first replica of the) managed service
+func (a *Agent) History() []lifecycle.Event {
+	return a.first().managedService.Lifecycle.History()
+}
+
+// Replicas returns the number of replicas of the managed service
+func (a *Agent) Replicas() int {
+	return len(a.replicaList())
+}
+
+// HandedOver reports whether the agent exited because it handed the managed service over to an upgraded agent
+func (a *Agent) HandedOver() bool {
+	a.upgradeLock.Lock()
+	defer a.upgradeLock.Unlock()
+	return a.handedOver
+}
+
+// LoadConfig reads the agent configuration (format as per the TMGCAgentConfig definition)
+func LoadConfig(path string) (*conf.TMGCAgentConfig, error) {
+	var sc *conf.TMGCAgentConfig
+
+	jsonFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(jsonFile, &sc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the configuration %v: %v", path, err)
+	}
+
+	return sc, nil
+}
+
+// create the service registry backend selected by the service-discovery type
+func newServiceRegistry(config *conf.TMGCAgentConfig) (discovery.Registry, error) {
+	serviceDiscovery := config.ServiceAgent.ServiceDiscovery
+	if !validateValue(serviceDiscovery.Type, validDiscoveryTypes) {
+		return nil, fmt.Errorf("invalid service discovery type found in the service configuration: %v, valid types are: %v", serviceDiscovery.Type, validDiscoveryTypes)
+	}
+
+	switch serviceDiscovery.Type {
+	case consulDiscovery:
+		return consul.NewConsulClient(serviceDiscovery.URL)
+	case staticDiscovery, fileDiscovery:
+		//for the file based backends the url is the path of the discovery file
+		return static.NewStaticRegistry(serviceDiscovery.URL)
+	}
+	return nil, fmt.Errorf("unsupported service discovery type: %v", serviceDiscovery.Type)
+}
+
+func validateValue(value string, list []string) bool {
+	for _, a := range list {
+		if a == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,2002 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/cgroup"
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/consul/consultest"
+	"github.com/aambhaik/tmgcagent/discovery"
+	"github.com/aambhaik/tmgcagent/lifecycle"
+	"github.com/aambhaik/tmgcagent/proc"
+	"github.com/aambhaik/tmgcagent/sandbox"
+	"github.com/aambhaik/tmgcagent/state"
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	// when set, the test binary acts as the dummy managed service instead of running the tests
+	managedServiceEnv = "TMGC_TEST_MANAGED_SERVICE"
+	// file the dummy managed service creates once it is ready
+	readyFileEnv = "TMGC_TEST_READY_FILE"
+	// when set, the dummy managed service is a job that sleeps for TMGC_TEST_JOB_SLEEP and exits with this status
+	jobExitEnv  = "TMGC_TEST_JOB_EXIT"
+	jobSleepEnv = "TMGC_TEST_JOB_SLEEP"
+	// port the dummy managed service listens on, if set
+	listenPortEnv = "TMGC_TEST_PORT"
+	// when set, the test binary acts as the agent started by an upgrade, with this state dir, instead of running
+	// the tests. it takes over with the configuration file TMGC_TEST_UPGRADED_CONFIG, or never does without one
+	upgradedStateEnv  = "TMGC_TEST_UPGRADED_STATE"
+	upgradedConfigEnv = "TMGC_TEST_UPGRADED_CONFIG"
+	// file of the state dir the upgraded agent writes its pid to
+	upgradedPidFile = "upgraded-agent.pid"
+)
+
+func TestMain(m *testing.M) {
+	//the test binary is also the shim of the sandboxed managed service
+	sandbox.Init()
+	if stateDir := os.Getenv(upgradedStateEnv); stateDir != "" {
+		os.Exit(runUpgradedAgent(stateDir))
+	}
+	if status := os.Getenv(jobExitEnv); status != "" && os.Getenv(managedServiceEnv) == "1" {
+		sleep, _ := time.ParseDuration(os.Getenv(jobSleepEnv))
+		time.Sleep(sleep)
+		code, _ := strconv.Atoi(status)
+		os.Exit(code)
+	}
+	if os.Getenv(managedServiceEnv) == "1" {
+		//dummy managed service: become ready after a while, then stay up until the agent kills the process group
+		if port := os.Getenv(listenPortEnv); port != "" {
+			if _, err := net.Listen("tcp", "127.0.0.1:"+port); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		if readyFile := os.Getenv(readyFileEnv); readyFile != "" {
+			time.Sleep(300 * time.Millisecond)
+			ioutil.WriteFile(readyFile, nil, 0644)
+		}
+		fmt.Println("managed service ready")
+		for {
+			time.Sleep(time.Hour)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+// run the agent an upgrade started until it is terminated
+func runUpgradedAgent(stateDir string) int {
+	//the managed processes it starts are not agents
+	os.Unsetenv(upgradedStateEnv)
+	ioutil.WriteFile(filepath.Join(stateDir, upgradedPidFile), []byte(strconv.Itoa(os.Getpid())), 0644)
+	ctx, cancel := context.WithCancel(context.Background())
+	terminated := make(chan os.Signal, 1)
+	signal.Notify(terminated, syscall.SIGTERM)
+	go func() {
+		<-terminated
+		cancel()
+	}()
+
+	configFile := os.Getenv(upgradedConfigEnv)
+	if configFile == "" {
+		<-ctx.Done()
+		return 0
+	}
+	config, err := LoadConfig(configFile)
+	if err == nil {
+		var a *Agent
+		if a, err = New(WithConfig(config), WithStateDir(stateDir)); err == nil {
+			err = a.Run(ctx)
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+const testConfig = `{
+  "service-agent": {
+    "management-port": 9989,
+    "service-discovery": {
+      "type": "consul",
+      "url": "%ADDR%"
+    },
+    "managed-service": {
+      "description": "Rolex watch service",
+      "name": "Rolex",
+      "process": {
+        "args": ["timerurl"],
+        "exec": "%EXEC%",
+        "type": "binary"
+      },
+      "service-dependency": [{
+        "endpoint-mapping": "weatherurl",
+        "service-name": "WeatherService",
+        "service-type": "Weather",
+        "skip": true,
+        "unavailablity-impact": "shutdown-managed-service"
+      }, {
+        "endpoint-mapping": "timerurl",
+        "min-instances": 1,
+        "service-name": "TimerService",
+        "service-type": "Timer",
+        "unavailablity-impact": "shutdown-managed-service"
+      }],
+      "type": "Watch"
+    },
+    "dependency-check-interval": "1h"
+  }
+}`
+
+// harness runs the agent against a fake consul with the test binary as the managed service
+type harness struct {
+	t          *testing.T
+	consul     *consultest.Server
+	configFile string
+	config     *conf.TMGCAgentConfig
+	stateDir   string
+	agent      *Agent
+	stop       func()
+}
+
+func newHarness(t *testing.T) *harness {
+	fake := consultest.NewServer()
+	t.Cleanup(fake.Close)
+	fake.AddService(&consul.AgentServiceRegistration{
+		ID:      "TimerService-Timer-1",
+		Name:    "TimerService",
+		Address: "timer.local",
+		Port:    9980,
+		Tags:    []string{"Timer", "proto:http", "route:/time"},
+	})
+
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	config := strings.NewReplacer("%ADDR%", fake.Addr(), "%EXEC%", os.Args[0]).Replace(testConfig)
+	if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(managedServiceEnv, "1")
+
+	tmgcServiceConfig, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("unable to read the test configuration: %v", err)
+	}
+
+	h := &harness{t: t, consul: fake, configFile: configFile, config: tmgcServiceConfig, stateDir: t.TempDir()}
+	h.agent = h.newAgent()
+	t.Cleanup(h.shutdown)
+	return h
+}
+
+func (h *harness) newAgent() *Agent {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	a, err := New(WithConfig(h.config), WithStateDir(h.stateDir), WithListener(listener))
+	if err != nil {
+		h.t.Fatalf("unable to create the agent: %v", err)
+	}
+	return a
+}
+
+// start runs the agent until it has started the managed process and registered it. starting again simulates
+// an agent restart: the running agent is shut down and a new one takes over
+func (h *harness) start() {
+	if h.stop != nil {
+		h.stop()
+		h.agent = h.newAgent()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- h.agent.Run(ctx) }()
+	h.stop = func() {
+		cancel()
+		if err := <-done; err != nil {
+			h.t.Errorf("agent failed: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.agent.first().managedServiceId() == "" {
+		select {
+		case err := <-done:
+			h.stop = nil
+			h.t.Fatalf("agent failed: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatal("the managed service was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// shutdown stops the agent and the managed process
+func (h *harness) shutdown() {
+	if h.stop != nil {
+		h.stop()
+		h.stop = nil
+	}
+	for _, r := range h.agent.replicaList() {
+		signalProcessGroup(r.managedCommand(), syscall.SIGKILL)
+	}
+}
+
+func (h *harness) running() bool {
+	return h.agent.first().managedCommand().Process.Signal(syscall.Signal(0)) == nil
+}
+
+// waitState waits for the managed service to reach one of the lifecycle states
+func (h *harness) waitState(states ...lifecycle.State) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !h.agent.first().managedService.Lifecycle.Is(states...) {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("managed service is %v, expected one of %v", h.agent.State(), states)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitStopped waits for the managed process to be killed and its exit observed
+func (h *harness) waitStopped() {
+	h.waitState(lifecycle.Stopped)
+	if h.running() {
+		h.t.Fatal("managed service is still running")
+	}
+}
+
+// call sends a request to the management API of the agent
+func (h *harness) call(method, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	h.agent.Handler().ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	return recorder
+}
+
+func TestDiscoverDependencies(t *testing.T) {
+	h := newHarness(t)
+
+	urls, err := h.agent.discoverManagedServiceDependencies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := urls["timerurl"]; len(got) != 1 || got[0].URL != "http://timer.local:9980/time" {
+		t.Errorf("unexpected timer urls: %v", got)
+	}
+	if _, ok := urls["weatherurl"]; ok {
+		t.Errorf("skipped dependency should not be resolved: %v", urls)
+	}
+
+	h.consul.RemoveService("TimerService-Timer-1")
+	if _, err := h.agent.discoverManagedServiceDependencies(); err == nil {
+		t.Error("expected an error when the dependency is not registered")
+	}
+}
+
+func TestStartAndRegister(t *testing.T) {
+	h := newHarness(t)
+	h.start()
+
+	if !h.running() {
+		t.Fatal("managed service is not running")
+	}
+	args := h.agent.first().managedCommand().Args[1:]
+	if strings.Join(args, " ") != "-timerurl http://timer.local:9980/time" {
+		t.Errorf("unexpected managed process arguments: %v", args)
+	}
+
+	reg, ok := h.consul.Service(h.agent.first().managedServiceId())
+	if !ok {
+		t.Fatalf("managed service %v is not registered", h.agent.first().managedServiceId())
+	}
+	if reg.Name != "Rolex" || reg.Port != 9985 || reg.Tags[0] != "Watch" {
+		t.Errorf("unexpected registration: %+v", reg)
+	}
+	if _, ok := h.consul.KV(h.agent.first().managedServiceId()); !ok {
+		t.Error("managed service metadata was not stored")
+	}
+
+	recorder := h.call("GET", "/service/health")
+	if recorder.Code != 200 {
+		t.Errorf("expected a healthy managed service, got %v: %v", recorder.Code, recorder.Body)
+	}
+}
+
+func TestShutdownImpact(t *testing.T) {
+	h := newHarness(t)
+	h.start()
+
+	//healthy dependency: nothing happens
+	h.agent.checkDependencyHealth()
+	if !h.running() {
+		t.Fatal("managed service was stopped while its dependency is healthy")
+	}
+
+	h.consul.SetStatus("TimerService-Timer-1", consul.HealthCritical)
+	h.agent.checkDependencyHealth()
+	h.waitStopped()
+
+	recorder := h.call("GET", "/service/health")
+	if recorder.Code != 503 {
+		t.Errorf("expected the managed service to be reported down, got %v", recorder.Code)
+	}
+}
+
+func TestStopAndStart(t *testing.T) {
+	h := newHarness(t)
+	h.start()
+
+	recorder := h.call("PUT", "/service/stop")
+	if recorder.Code != 200 {
+		t.Fatalf("stop failed with %v: %v", recorder.Code, recorder.Body)
+	}
+	h.waitStopped()
+
+	recorder = h.call("PUT", "/service/start")
+	if recorder.Code != 200 {
+		t.Fatalf("start failed with %v: %v", recorder.Code, recorder.Body)
+	}
+	if !h.running() {
+		t.Error("managed service is not running after start")
+	}
+	if _, ok := h.consul.Service(h.agent.first().managedServiceId()); !ok {
+		t.Error("managed service was not re-registered")
+	}
+
+	recorder = h.call("PUT", "/service/start")
+	if recorder.Code != 500 {
+		t.Errorf("starting a running service should fail, got %v", recorder.Code)
+	}
+}
+
+func TestStableServiceId(t *testing.T) {
+	h := newHarness(t)
+
+	//a registration and metadata left behind by an earlier run of the agent on this node
+	h.consul.AddService(&consul.AgentServiceRegistration{ID: "Rolex-Watch-stale", Name: "Rolex", Port: 9985, Tags: []string{"Watch"}})
+	h.agent.registry.PutKV("Rolex-Watch-stale", []byte("{}"))
+
+	h.start()
+	first := h.agent.first().managedServiceId()
+	pid := h.agent.first().managedCommand().Process.Pid
+	if _, ok := h.consul.Service("Rolex-Watch-stale"); ok {
+		t.Error("stale registration was not deregistered")
+	}
+	if _, ok := h.consul.KV("Rolex-Watch-stale"); ok {
+		t.Error("stale metadata was not deleted")
+	}
+
+	//an agent restart reuses the persisted id
+	h.start()
+	if h.agent.first().managedServiceId() != first {
+		t.Errorf("expected service id %v to be reused, got %v", first, h.agent.first().managedServiceId())
+	}
+	if adopted := h.agent.first().managedCommand().Process.Pid; adopted != pid {
+		t.Errorf("expected the restarted agent to adopt process %v, got %v", pid, adopted)
+	}
+	if regs := h.consul.Services("Rolex"); len(regs) != 1 {
+		t.Errorf("expected a single registration, got %v", regs)
+	}
+}
+
+func TestAdoptRunningProcess(t *testing.T) {
+	h := newHarness(t)
+	h.start()
+	pid := h.agent.first().managedCommand().Process.Pid
+
+	//an agent restart finds the managed process still running and adopts it
+	command, adopted := h.agent.first().adoptManagedProcess()
+	if !adopted {
+		t.Fatal("running managed process was not adopted")
+	}
+	if command.Process.Pid != pid {
+		t.Errorf("adopted pid %v, expected %v", command.Process.Pid, pid)
+	}
+
+	//a recorded process whose start time doesn't match is a different process that reused the pid
+	agentState, _ := state.Load(h.agent.first().stateFile())
+	agentState.Process.StartTime++
+	state.Save(h.agent.first().stateFile(), agentState)
+	if _, adopted := h.agent.first().adoptManagedProcess(); adopted {
+		t.Error("process with a different start time was adopted")
+	}
+	agentState.Process.StartTime--
+
+	//so is a process with another command line
+	cmdline := agentState.Process.Cmdline
+	agentState.Process.Cmdline = append([]string{}, cmdline[0], "-other")
+	state.Save(h.agent.first().stateFile(), agentState)
+	if _, adopted := h.agent.first().adoptManagedProcess(); adopted {
+		t.Error("process with a different command line was adopted")
+	}
+	agentState.Process.Cmdline = cmdline
+	state.Save(h.agent.first().stateFile(), agentState)
+
+	recorder := h.call("PUT", "/service/stop")
+	if recorder.Code != 200 {
+		t.Fatalf("stop failed with %v: %v", recorder.Code, recorder.Body)
+	}
+	h.waitStopped()
+	if _, adopted := h.agent.first().adoptManagedProcess(); adopted {
+		t.Error("stopped managed process was adopted")
+	}
+}
+
+// the pid of the agent started by an upgrade of the harness agent, 0 until it has written it
+func (h *harness) upgradedAgent() int {
+	data, _ := ioutil.ReadFile(filepath.Join(h.stateDir, upgradedPidFile))
+	pid, _ := strconv.Atoi(string(data))
+	return pid
+}
+
+func TestUpgrade(t *testing.T) {
+	h := newHarness(t)
+	h.start()
+	pid := h.agent.first().managedCommand().Process.Pid
+	url := "http://" + h.agent.listener.Addr().String()
+
+	//the test binary takes over with the same configuration and state
+	t.Setenv(upgradedStateEnv, h.stateDir)
+	t.Setenv(upgradedConfigEnv, h.configFile)
+	t.Cleanup(func() {
+		if upgraded := h.upgradedAgent(); upgraded != 0 {
+			syscall.Kill(upgraded, syscall.SIGTERM)
+			h.waitFor("the upgraded agent to exit", func() bool { return syscall.Kill(upgraded, 0) != nil })
+		}
+	})
+
+	//every connection to the management port is answered, by one agent or the other
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	var answered, failed int32
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if response, err := client.Get(url + "/agent/health"); err != nil || response.StatusCode != 200 {
+				atomic.AddInt32(&failed, 1)
+			} else {
+				response.Body.Close()
+				atomic.AddInt32(&answered, 1)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	if err := h.agent.Upgrade(""); err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+	//the old agent returns once it has handed over
+	h.waitFor("the old agent to return", func() bool {
+		h.agent.mu.Lock()
+		defer h.agent.mu.Unlock()
+		select {
+		case <-h.agent.finished:
+			return true
+		default:
+			return false
+		}
+	})
+	h.stop()
+	h.stop = nil
+	close(stop)
+	<-stopped
+	if !h.agent.HandedOver() {
+		t.Error("expected the old agent to have handed over")
+	}
+	if answered == 0 || failed != 0 {
+		t.Errorf("expected the management port to keep answering, %v requests failed and %v were answered", failed, answered)
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		t.Fatalf("the managed process %v did not survive the upgrade: %v", pid, err)
+	}
+
+	//the new agent serves the port and has adopted the managed process
+	response, err := client.Get(url + "/service/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	events, _ := ioutil.ReadAll(response.Body)
+	if !strings.Contains(string(events), fmt.Sprintf("adopted process %v", pid)) {
+		t.Errorf("expected the upgraded agent to adopt process %v, its events are %s", pid, events)
+	}
+}
+
+func TestUpgradeNotReady(t *testing.T) {
+	h := newHarness(t)
+	h.start()
+	pid := h.agent.first().managedCommand().Process.Pid
+	timeout := upgradeTimeout
+	upgradeTimeout = time.Second
+	t.Cleanup(func() { upgradeTimeout = timeout })
+
+	//an upgraded agent that exits before taking over
+	if err := h.agent.Upgrade("/bin/false"); err == nil {
+		t.Error("expected the upgrade to an agent that exits to fail")
+	}
+
+	//and one that never takes over is killed
+	t.Setenv(upgradedStateEnv, h.stateDir)
+	if err := h.agent.Upgrade(""); err == nil || !strings.Contains(err.Error(), "timed out after 1s") {
+		t.Errorf("expected the upgrade to time out, got %v", err)
+	}
+	if upgraded := h.upgradedAgent(); upgraded == 0 || syscall.Kill(upgraded, 0) == nil {
+		t.Errorf("expected the upgraded agent %v to be killed", upgraded)
+	}
+
+	//the current agent stays in charge
+	if h.agent.HandedOver() || h.agent.State() != lifecycle.Running || syscall.Kill(pid, 0) != nil {
+		t.Errorf("expected the agent to keep running the managed process %v, it is %v", pid, h.agent.State())
+	}
+	if recorder := h.call("GET", "/service/health"); recorder.Code != 200 {
+		t.Errorf("expected the agent to keep serving, got %v: %v", recorder.Code, recorder.Body)
+	}
+	if h.agent.quiesced() {
+		t.Error("expected the agent to supervise the managed service again after the failed upgrades")
+	}
+}
+
+func TestUpgradeQuiesce(t *testing.T) {
+	h := newHarness(t)
+	h.config.ServiceAgent.ManagedService.Restart = &conf.RestartPolicy{Policy: "on-failure", Backoff: "50ms"}
+	h.start()
+	pid := h.agent.first().managedCommand().Process.Pid
+
+	//while a new agent takes over, the crashed managed process is left to it
+	h.agent.quiesce()
+	signalProcessGroup(h.agent.first().managedCommand(), syscall.SIGKILL)
+	h.waitState(lifecycle.Backoff)
+	time.Sleep(200 * time.Millisecond)
+	if state := h.agent.State(); state != lifecycle.Backoff {
+		t.Errorf("expected the managed service not to be restarted during the handoff, it is %v", state)
+	}
+
+	//unless the handoff fails. the restart is over once the service is registered again
+	h.agent.first().setManagedServiceId("")
+	h.agent.resume()
+	h.waitFor("the restart after the failed handoff", func() bool {
+		return h.agent.first().managedServiceId() != "" && h.agent.first().managedCommand().Process.Pid != pid
+	})
+}
+
+func TestSuspendImpact(t *testing.T) {
+	h := newHarness(t)
+	h.config.ServiceAgent.ManagedService.ServiceDependency[1].UnavailablityImpact = suspendManagedServiceImpact
+	h.start()
+
+	h.consul.SetStatus("TimerService-Timer-1", consul.HealthCritical)
+	h.agent.checkDependencyHealth()
+	if state := h.agent.first().managedService.Lifecycle.State(); state != lifecycle.Suspended {
+		t.Fatalf("expected the managed service to be suspended, it is %v", state)
+	}
+	//SIGSTOP is delivered asynchronously
+	var stat *proc.Stat
+	for i := 0; i < 100; i++ {
+		if stat, _ = proc.ReadStat(h.agent.first().managedCommand().Process.Pid); stat != nil && stat.State == "T" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stat == nil || stat.State != "T" {
+		t.Errorf("expected the managed process to be stopped, got %+v", stat)
+	}
+
+	h.consul.SetStatus("TimerService-Timer-1", consul.HealthPassing)
+	h.agent.checkDependencyHealth()
+	if state := h.agent.first().managedService.Lifecycle.State(); state != lifecycle.Running {
+		t.Fatalf("expected the managed service to be resumed, it is %v", state)
+	}
+}
+
+func TestConcurrentLifecycleRequests(t *testing.T) {
+	h := newHarness(t)
+	h.start()
+
+	h.call("PUT", "/service/stop")
+	h.waitStopped()
+
+	//of several concurrent start requests exactly one starts the service
+	codes := make(chan int, 5)
+	for i := 0; i < cap(codes); i++ {
+		go func() {
+			codes <- h.call("PUT", "/service/start").Code
+		}()
+	}
+	started := 0
+	for i := 0; i < cap(codes); i++ {
+		if <-codes == 200 {
+			started++
+		}
+	}
+	if started != 1 {
+		t.Errorf("expected exactly one start to succeed, %v did", started)
+	}
+
+	//the crash of the running process is noticed
+	signalProcessGroup(h.agent.first().managedCommand(), syscall.SIGKILL)
+	h.waitState(lifecycle.Crashed)
+
+	history := h.agent.first().managedService.Lifecycle.History()
+	if last := history[len(history)-1]; last.To != lifecycle.Crashed || last.Reason != "killed by signal killed" {
+		t.Errorf("unexpected last lifecycle event: %+v", last)
+	}
+}
+
+func TestRunAndShutdown(t *testing.T) {
+	h := newHarness(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.agent, err = New(WithConfig(h.config), WithStateDir(h.stateDir), WithListener(listener))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- h.agent.Run(context.Background()) }()
+	h.waitState(lifecycle.Running)
+
+	//the management API is served on the given listener
+	var response *http.Response
+	for i := 0; i < 100; i++ {
+		if response, err = http.Get("http://" + listener.Addr().String() + "/agent/health"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 {
+		t.Errorf("unexpected agent health status %v", response.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.agent.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+	//the managed process outlives the agent, so that the next agent can adopt it
+	if !h.running() {
+		t.Error("managed service was stopped by the agent shutdown")
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/agent/health"); err == nil {
+		t.Error("management API is still served after the shutdown")
+	}
+}
+
+func TestReadinessGatesRegistration(t *testing.T) {
+	h := newHarness(t)
+	readyFile := filepath.Join(t.TempDir(), "ready")
+	t.Setenv(readyFileEnv, readyFile)
+	h.config.ServiceAgent.ManagedService.Readiness = &conf.Readiness{
+		Probes: []conf.Probe{
+			{Type: "file", Path: readyFile},
+			{Type: "log", Pattern: "^managed service ready$"},
+		},
+		Interval: "50ms",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- h.agent.Run(ctx) }()
+	h.stop = func() {
+		cancel()
+		<-done
+	}
+	for h.agent.first().managedCommand() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//started but not ready: not registered yet
+	if state := h.agent.State(); state != lifecycle.Starting {
+		t.Errorf("expected the managed service to be starting, it is %v", state)
+	}
+	if regs := h.consul.Services("Rolex"); len(regs) != 0 {
+		t.Errorf("managed service registered before it was ready: %v", regs)
+	}
+
+	h.waitState(lifecycle.Running)
+	if _, err := os.Stat(readyFile); err != nil {
+		t.Errorf("managed service became running before its readiness file existed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.consul.Services("Rolex")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if regs := h.consul.Services("Rolex"); len(regs) != 1 {
+		t.Errorf("expected the ready managed service to be registered, got %v", regs)
+	}
+}
+
+func TestReadinessTimeout(t *testing.T) {
+	h := newHarness(t)
+	h.config.ServiceAgent.ManagedService.Readiness = &conf.Readiness{
+		Probes:         []conf.Probe{{Type: "tcp", Address: "127.0.0.1:1"}},
+		Interval:       "50ms",
+		StartupTimeout: "200ms",
+	}
+
+	err := h.agent.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "startup failed") {
+		t.Fatalf("expected the start to fail, got %v", err)
+	}
+	history := h.agent.History()
+	if last := history[len(history)-1]; last.To != lifecycle.Crashed || !strings.HasPrefix(last.Reason, "startup failed: not ready after 200ms") {
+		t.Errorf("unexpected last lifecycle event: %+v", last)
+	}
+	for i := 0; i < 100 && h.running(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h.running() {
+		t.Error("the managed process that never became ready is still running")
+	}
+	if regs := h.consul.Services("Rolex"); len(regs) != 0 {
+		t.Errorf("managed service registered although it never became ready: %v", regs)
+	}
+}
+
+func TestInvalidReadiness(t *testing.T) {
+	h := newHarness(t)
+	h.config.ServiceAgent.ManagedService.Readiness = &conf.Readiness{Probes: []conf.Probe{{Type: "grpc"}}}
+	if _, err := New(WithConfig(h.config), WithStateDir(h.stateDir)); err == nil {
+		t.Error("expected an unknown probe type to be refused")
+	}
+}
+
+// livenessFile configures an exec liveness probe that passes while the returned file exists
+func (h *harness) livenessFile() string {
+	aliveFile := filepath.Join(h.t.TempDir(), "alive")
+	ioutil.WriteFile(aliveFile, nil, 0644)
+	h.config.ServiceAgent.ManagedService.Liveness = &conf.Liveness{
+		Probes:           []conf.Probe{{Type: "exec", Command: []string{"test", "-e", aliveFile}}},
+		Interval:         "50ms",
+		FailureThreshold: 2,
+	}
+	return aliveFile
+}
+
+// waitFor polls until condition holds
+func (h *harness) waitFor(what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLivenessFailure(t *testing.T) {
+	h := newHarness(t)
+	aliveFile := h.livenessFile()
+	h.start()
+
+	serviceId := h.agent.first().managedServiceId()
+	if reg, _ := h.consul.Service(serviceId); reg.Check == nil || reg.Check.TTL != "150ms" {
+		t.Errorf("expected the managed service to be registered with a TTL check: %+v", reg.Check)
+	}
+
+	//without a restart policy a hung service keeps running but is reported unhealthy
+	os.Remove(aliveFile)
+	h.waitFor("the critical check", func() bool { return h.consul.Status(serviceId) == consul.HealthCritical })
+	recorder := h.call("GET", "/service/health")
+	if recorder.Code != 503 || !strings.Contains(recorder.Body.String(), "failing its liveness probes") {
+		t.Errorf("expected the managed service to be reported unhealthy, got %v: %v", recorder.Code, recorder.Body)
+	}
+	if !h.running() || h.agent.State() != lifecycle.Running {
+		t.Errorf("managed service is %v, expected it to keep running", h.agent.State())
+	}
+
+	ioutil.WriteFile(aliveFile, nil, 0644)
+	h.waitFor("the passing check", func() bool { return h.consul.Status(serviceId) == consul.HealthPassing })
+	if recorder := h.call("GET", "/service/health"); recorder.Code != 200 {
+		t.Errorf("expected the recovered managed service to be healthy, got %v: %v", recorder.Code, recorder.Body)
+	}
+}
+
+func TestLivenessRestart(t *testing.T) {
+	h := newHarness(t)
+	aliveFile := h.livenessFile()
+	h.config.ServiceAgent.ManagedService.Restart = &conf.RestartPolicy{Policy: "on-failure", Backoff: "50ms"}
+	h.start()
+	pid := h.agent.first().managedCommand().Process.Pid
+
+	os.Remove(aliveFile)
+	h.waitFor("the liveness crash", func() bool {
+		for _, event := range h.agent.History() {
+			if event.To == lifecycle.Crashed && strings.HasPrefix(event.Reason, "liveness probe failed") {
+				return true
+			}
+		}
+		return false
+	})
+	ioutil.WriteFile(aliveFile, nil, 0644)
+
+	h.waitFor("the restart", func() bool {
+		return h.agent.State() == lifecycle.Running && h.agent.first().managedCommand().Process.Pid != pid
+	})
+	h.waitFor("the passing check", func() bool { return h.consul.Status(h.agent.first().managedServiceId()) == consul.HealthPassing })
+	if regs := h.consul.Services("Rolex"); len(regs) != 1 {
+		t.Errorf("expected the restarted service to keep its single registration, got %v", regs)
+	}
+}
+
+func TestCrashRestart(t *testing.T) {
+	h := newHarness(t)
+	h.config.ServiceAgent.ManagedService.Restart = &conf.RestartPolicy{Policy: "on-failure", Backoff: "50ms"}
+	h.start()
+	pid := h.agent.first().managedCommand().Process.Pid
+
+	//the restarted process gets the instances of its dependencies at the time of the restart
+	h.consul.RemoveService("TimerService-Timer-1")
+	h.consul.AddService(&consul.AgentServiceRegistration{ID: "TimerService-Timer-2", Name: "TimerService", Address: "timer-2.local", Port: 9980, Tags: []string{"Timer"}})
+	signalProcessGroup(h.agent.first().managedCommand(), syscall.SIGKILL)
+	h.waitFor("the restart", func() bool {
+		return h.agent.State() == lifecycle.Running && h.agent.first().managedCommand().Process.Pid != pid
+	})
+	if args := h.agent.first().managedCommand().Args[1:]; strings.Join(args, " ") != "-timerurl http://timer-2.local:9980" {
+		t.Errorf("expected the restarted process to get the current dependency, got %v", args)
+	}
+
+	var states []lifecycle.State
+	for _, event := range h.agent.History() {
+		states = append(states, event.To)
+	}
+	if got := fmt.Sprint(states[len(states)-4:]); got != "[crashed backoff starting running]" {
+		t.Errorf("unexpected lifecycle transitions: %v", got)
+	}
+
+	//a stop is not a crash
+	h.call("PUT", "/service/stop")
+	h.waitStopped()
+	time.Sleep(150 * time.Millisecond)
+	if state := h.agent.State(); state != lifecycle.Stopped {
+		t.Errorf("stopped managed service was restarted, it is %v", state)
+	}
+}
+
+func TestResourceLimits(t *testing.T) {
+	h := newHarness(t)
+	//plain files standing in for the cgroup filesystem
+	previousRoot := cgroup.Root
+	cgroup.Root = t.TempDir()
+	t.Cleanup(func() { cgroup.Root = previousRoot })
+	ioutil.WriteFile(filepath.Join(cgroup.Root, "cgroup.controllers"), []byte("cpu memory pids"), 0644)
+
+	noCore := uint64(0)
+	h.config.ServiceAgent.ManagedService.Process.Limits = &conf.Limits{OpenFiles: 123, CoreSize: &noCore, MemoryMax: "64M"}
+	h.start()
+	pid := h.agent.first().managedCommand().Process.Pid
+
+	//the shim sets the rlimits before it execs the managed binary
+	h.waitFor("the managed binary to run", func() bool {
+		environ, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/environ", pid))
+		return err == nil && !strings.Contains(string(environ), "TMGC_SANDBOX=")
+	})
+	limits, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/limits", pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`Max open files\s+123\s+123\s`, `Max core file size\s+0\s+0\s`} {
+		if !regexp.MustCompile(expected).Match(limits) {
+			t.Errorf("expected the limits of the managed process to match %v:\n%s", expected, limits)
+		}
+	}
+
+	group := filepath.Join(cgroup.Root, "tmgc", "Rolex")
+	if memoryMax, _ := ioutil.ReadFile(filepath.Join(group, "memory.max")); string(memoryMax) != "67108864" {
+		t.Errorf("unexpected memory.max %q", memoryMax)
+	}
+	if procs, _ := ioutil.ReadFile(filepath.Join(group, "cgroup.procs")); string(procs) != fmt.Sprint(pid) {
+		t.Errorf("expected the managed process %v in the cgroup, got %q", pid, procs)
+	}
+
+	//a SIGKILL with the OOM kill count of the cgroup going up is an OOM kill
+	ioutil.WriteFile(filepath.Join(group, "memory.events"), []byte("oom 1\noom_kill 1\n"), 0644)
+	signalProcessGroup(h.agent.first().managedCommand(), syscall.SIGKILL)
+	h.waitState(lifecycle.Crashed)
+	history := h.agent.History()
+	if last := history[len(history)-1]; last.Reason != "killed by the OOM killer" {
+		t.Errorf("unexpected last lifecycle event: %+v", last)
+	}
+}
+
+func TestResourceUsage(t *testing.T) {
+	h := newHarness(t)
+	h.config.ServiceAgent.ManagedService.Usage = &conf.UsageReporting{Registry: true, Interval: "50ms"}
+	h.start()
+
+	recorder := h.call("GET", "/service/health?format=json")
+	var health struct {
+		State   lifecycle.State `json:"state"`
+		Healthy bool            `json:"healthy"`
+		Usage   *proc.Usage     `json:"usage"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &health); err != nil {
+		t.Fatalf("unable to read the health of the managed service %q: %v", recorder.Body, err)
+	}
+	if recorder.Code != 200 || !health.Healthy || health.State != lifecycle.Running {
+		t.Errorf("expected the managed service to be healthy, got %v: %s", recorder.Code, recorder.Body)
+	}
+	if usage := health.Usage; usage == nil || usage.Processes < 1 || usage.Threads < 1 || usage.RSSBytes <= 0 || usage.OpenFDs <= 0 {
+		t.Errorf("unexpected usage of the managed service: %+v", usage)
+	}
+
+	metrics := h.call("GET", "/metrics").Body.String()
+	for _, expected := range []string{`tmgc_managed_service_up{service="Rolex",replica="0"} 1`, `tmgc_managed_service_memory_rss_bytes{service="Rolex",replica="0"} `, `tmgc_managed_service_processes{service="Rolex",replica="0"} `} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("expected the metrics to contain %v:\n%v", expected, metrics)
+		}
+	}
+
+	serviceId := h.agent.first().managedServiceId()
+	h.waitFor("the usage in the registry", func() bool {
+		data, _ := h.consul.KV(serviceId + "/usage")
+		var usage proc.Usage
+		return json.Unmarshal(data, &usage) == nil && usage.RSSBytes > 0
+	})
+	//the usage is reported without registering the service again
+	if reg, _ := h.consul.Service(serviceId); len(reg.Meta) != 2 || reg.Meta[agentMetaKey] != agentMetaValue {
+		t.Errorf("unexpected meta of the registration: %v", reg.Meta)
+	}
+
+	//the text health stays the default
+	if body := h.call("GET", "/service/health").Body.String(); !strings.Contains(body, "running successfully") {
+		t.Errorf("unexpected health of the managed service: %v", body)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("sandboxes need root")
+	}
+	h := newHarness(t)
+	h.config.ServiceAgent.ManagedService.Process.Sandbox = &conf.Sandbox{
+		//no private /tmp, the test binary lives there
+		Namespaces:      []string{"mount", "pid", "ipc"},
+		ReadOnlyPaths:   []string{"/"},
+		NoNewPrivileges: true,
+	}
+	h.start()
+	pid := h.agent.first().managedCommand().Process.Pid
+
+	//the managed service is pid 1 of its own PID namespace and runs the managed binary, once the shim exec'd it.
+	//the command line reads empty while the exec is under way
+	expected := regexp.MustCompile(fmt.Sprintf(`(?s)NSpid:\s+%v\s+1\n.*NoNewPrivs:\s+1\n`, pid))
+	h.waitFor("the sandboxed managed service", func() bool {
+		status, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%v/status", pid))
+		cmdline, _ := proc.Cmdline(pid)
+		return expected.Match(status) && len(cmdline) > 0 && cmdline[0] == os.Args[0]
+	})
+	for _, namespace := range []string{"mnt", "pid", "ipc"} {
+		own, _ := os.Readlink("/proc/self/ns/" + namespace)
+		managed, _ := os.Readlink(fmt.Sprintf("/proc/%v/ns/%v", pid, namespace))
+		if own == managed {
+			t.Errorf("expected the managed process to have its own %v namespace, both are %v", namespace, own)
+		}
+	}
+
+	//the sandbox is no obstacle to the supervision
+	h.call("PUT", "/service/stop")
+	h.waitStopped()
+}
+
+func TestInvalidSandbox(t *testing.T) {
+	h := newHarness(t)
+	for _, sandbox := range []*conf.Sandbox{
+		{Namespaces: []string{"net"}},
+		{User: "no-such-user-tmgc"},
+		{ReadOnlyPaths: []string{"relative"}},
+	} {
+		h.config.ServiceAgent.ManagedService.Process.Sandbox = sandbox
+		if _, err := New(WithConfig(h.config), WithStateDir(h.stateDir)); err == nil {
+			t.Errorf("expected the sandbox %+v to be rejected", sandbox)
+		}
+	}
+}
+
+// configure a hook of each event that appends the event, its reason and the timer urls to a file
+func (h *harness) recordHooks() string {
+	file := filepath.Join(h.t.TempDir(), "hooks")
+	record := conf.Hook{Command: []string{"/bin/sh", "-c", `echo "$TMGC_HOOK_EVENT|$TMGC_EVENT_REASON|$TMGC_DEPENDENCY_TIMERURL" >>` + file}}
+	hook := []conf.Hook{record}
+	h.config.ServiceAgent.ManagedService.Hooks = &conf.Hooks{PreStart: hook, PostStart: hook, PreStop: hook, PostStop: hook, OnCrash: hook}
+	return file
+}
+
+func (h *harness) hooksRun(file string) []string {
+	data, _ := ioutil.ReadFile(file)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestHooks(t *testing.T) {
+	h := newHarness(t)
+	file := h.recordHooks()
+	h.start()
+	expected := []string{
+		"pre-start|agent started|http://timer.local:9980/time",
+		"post-start|agent started|http://timer.local:9980/time",
+	}
+	if got := h.hooksRun(file); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("unexpected hooks run on start: %q", got)
+	}
+
+	h.call("PUT", "/service/stop")
+	h.waitStopped()
+	expected = append(expected, "pre-stop|stop requested|http://timer.local:9980/time", "post-stop|killed by signal killed|http://timer.local:9980/time")
+	if got := h.hooksRun(file); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("unexpected hooks run on stop: %q", got)
+	}
+
+	h.call("PUT", "/service/start")
+	signalProcessGroup(h.agent.first().managedCommand(), syscall.SIGKILL)
+	h.waitState(lifecycle.Crashed)
+	h.waitFor("the on-crash hook", func() bool {
+		got := h.hooksRun(file)
+		return got[len(got)-1] == "on-crash|killed by signal killed|http://timer.local:9980/time"
+	})
+}
+
+func TestHookFailurePolicy(t *testing.T) {
+	h := newHarness(t)
+	failing := conf.Hook{Command: []string{"/bin/sh", "-c", "echo migration failed; exit 3"}}
+	h.config.ServiceAgent.ManagedService.Hooks = &conf.Hooks{PreStart: []conf.Hook{failing}}
+	if err := h.newAgent().Run(context.Background()); err == nil || !strings.Contains(err.Error(), "migration failed") {
+		t.Errorf("expected the failing pre-start hook to abort the start, got %v", err)
+	}
+
+	//a hook that times out fails too, the start goes on regardless
+	slow := conf.Hook{Command: []string{"/bin/sh", "-c", "sleep 10"}, Timeout: "100ms", OnFailure: "continue"}
+	failing.OnFailure = "continue"
+	h.config.ServiceAgent.ManagedService.Hooks = &conf.Hooks{PreStart: []conf.Hook{failing, slow}}
+	started := time.Now()
+	h.start()
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("the timed out hook was waited for %v", elapsed)
+	}
+}
+
+// wait for the run of the job with the given id to finish
+func (h *harness) waitRun(id int) jobRun {
+	var run jobRun
+	h.waitFor(fmt.Sprintf("run %v", id), func() bool {
+		for _, r := range h.agent.runs() {
+			if r.ID == id && r.Status != runRunning {
+				run = r
+				return true
+			}
+		}
+		return false
+	})
+	return run
+}
+
+func TestJob(t *testing.T) {
+	h := newHarness(t)
+	h.config.ServiceAgent.ManagedService.Job = &conf.Job{Schedule: "@every 1s", History: 2}
+	t.Setenv(jobExitEnv, "0")
+	h.start()
+	serviceId := h.agent.first().managedServiceId()
+	if reg, _ := h.consul.Service(serviceId); reg.Check == nil || reg.Check.TTL != (3*jobHealthInterval).String() {
+		t.Errorf("expected the job to be registered with a TTL check, got %+v", reg.Check)
+	}
+
+	//the first run is due after a second
+	if run := h.waitRun(1); run.Status != runSucceeded || run.Trigger != "schedule" || *run.ExitCode != 0 {
+		t.Errorf("unexpected first run: %+v", run)
+	}
+	if status := h.consul.Status(serviceId); status != consul.HealthPassing {
+		t.Errorf("expected the check of the job to pass, it is %v", status)
+	}
+
+	t.Setenv(jobExitEnv, "3")
+	h.call("PUT", "/service/start")
+	h.waitFor("the failed run", func() bool {
+		runs := h.agent.runs()
+		last := runs[len(runs)-1]
+		return last.Status == runFailed && *last.ExitCode == 3 && last.Reason == "exited with status 3"
+	})
+	h.waitFor("the critical check", func() bool { return h.consul.Status(serviceId) == consul.HealthCritical })
+	if recorder := h.call("GET", "/service/health"); recorder.Code != 503 || !strings.Contains(recorder.Body.String(), "failed: exited with status 3") {
+		t.Errorf("expected the failed job to be unhealthy, got %v: %v", recorder.Code, recorder.Body)
+	}
+
+	var runs []jobRun
+	if err := json.Unmarshal(h.call("GET", "/service/runs").Body.Bytes(), &runs); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Errorf("expected the history to keep the last 2 runs, got %+v", runs)
+	}
+
+	//a run without its dependencies is skipped
+	h.consul.RemoveService("TimerService-Timer-1")
+	h.waitFor("the skipped run", func() bool {
+		runs := h.agent.runs()
+		last := runs[len(runs)-1]
+		return last.Status == runSkipped && strings.Contains(last.Reason, "TimerService")
+	})
+	h.waitFor("the warning check", func() bool { return h.consul.Status(serviceId) == consul.HealthWarning })
+}
+
+func TestJobTimeoutAndConcurrency(t *testing.T) {
+	h := newHarness(t)
+	h.config.ServiceAgent.ManagedService.Job = &conf.Job{Schedule: "@yearly", Timeout: "300ms"}
+	t.Setenv(jobExitEnv, "0")
+	t.Setenv(jobSleepEnv, "10s")
+	h.start()
+
+	h.call("PUT", "/service/start")
+	h.waitFor("the first run", func() bool { runs := h.agent.runs(); return len(runs) == 1 && runs[0].PID != 0 })
+	h.call("PUT", "/service/start")
+	if run := h.waitRun(2); run.Status != runSkipped || run.Reason != "run 1 is still active" {
+		t.Errorf("expected the concurrent run to be skipped, got %+v", run)
+	}
+	if run := h.waitRun(1); run.Status != runTimedOut || run.Reason != "timed out after 300ms" {
+		t.Errorf("expected the first run to time out, got %+v", run)
+	}
+	h.waitFor("the critical check", func() bool { return h.consul.Status(h.agent.first().managedServiceId()) == consul.HealthCritical })
+}
+
+func TestJobReplace(t *testing.T) {
+	h := newHarness(t)
+	h.config.ServiceAgent.ManagedService.Job = &conf.Job{Schedule: "@yearly", Concurrency: "replace"}
+	t.Setenv(jobExitEnv, "0")
+	t.Setenv(jobSleepEnv, "10s")
+	h.start()
+
+	h.call("PUT", "/service/start")
+	h.waitFor("the first run", func() bool { runs := h.agent.runs(); return len(runs) == 1 && runs[0].PID != 0 })
+	h.call("PUT", "/service/start")
+	if run := h.waitRun(1); run.Status != runKilled || run.Reason != "replaced by run 2" {
+		t.Errorf("expected the first run to be replaced, got %+v", run)
+	}
+
+	h.call("PUT", "/service/stop")
+	if run := h.waitRun(2); run.Status != runKilled || run.Reason != "stop requested" {
+		t.Errorf("expected the second run to be stopped, got %+v", run)
+	}
+}
+
+// heldRegistry holds the first dependency lookup once armed, until it is released
+type heldRegistry struct {
+	discovery.Registry
+	armed   int32
+	held    chan struct{}
+	release chan struct{}
+}
+
+func (r *heldRegistry) Lookup(name, tag string, opts *discovery.QueryOptions) ([]*discovery.Instance, error) {
+	if atomic.CompareAndSwapInt32(&r.armed, 1, 0) {
+		close(r.held)
+		<-r.release
+	}
+	return r.Registry.Lookup(name, tag, opts)
+}
+
+func TestJobReplaceDuringLookup(t *testing.T) {
+	h := newHarness(t)
+	h.config.ServiceAgent.ManagedService.Job = &conf.Job{Schedule: "@yearly", Concurrency: "replace"}
+	t.Setenv(jobExitEnv, "0")
+	t.Setenv(jobSleepEnv, "10s")
+	registry := &heldRegistry{Registry: h.agent.registry, held: make(chan struct{}), release: make(chan struct{})}
+	h.agent.registry = registry
+	h.start()
+
+	//the first run is replaced while it still looks up its dependencies
+	atomic.StoreInt32(&registry.armed, 1)
+	h.call("PUT", "/service/start")
+	<-registry.held
+	h.call("PUT", "/service/start")
+	h.waitFor("the second run", func() bool { runs := h.agent.runs(); return len(runs) == 2 && runs[1].PID != 0 })
+	close(registry.release)
+	if run := h.waitRun(1); run.Status != runKilled || run.Reason != "replaced by run 2" || run.PID != 0 {
+		t.Errorf("expected the first run to be replaced before it started, got %+v", run)
+	}
+	if pid := h.agent.first().managedCommand().Process.Pid; pid != h.agent.runs()[1].PID {
+		t.Errorf("expected the second run to be the only one started, the latest process is %v", pid)
+	}
+
+	h.call("PUT", "/service/stop")
+	if run := h.waitRun(2); run.Status != runKilled || run.Reason != "stop requested" {
+		t.Errorf("expected the second run to be stopped, got %+v", run)
+	}
+}
+
+func TestInvalidJob(t *testing.T) {
+	h := newHarness(t)
+	for _, job := range []*conf.Job{
+		{Schedule: "every minute"},
+		{Schedule: "@hourly", Concurrency: "queue"},
+		{Schedule: "@hourly", Timeout: "soon"},
+	} {
+		h.config.ServiceAgent.ManagedService.Job = job
+		if _, err := New(WithConfig(h.config), WithStateDir(h.stateDir)); err == nil {
+			t.Errorf("expected the job %+v to be rejected", job)
+		}
+	}
+	h.config.ServiceAgent.ManagedService.Job = &conf.Job{Schedule: "@hourly"}
+	h.config.ServiceAgent.ManagedService.Restart = &conf.RestartPolicy{Policy: "always"}
+	if _, err := New(WithConfig(h.config), WithStateDir(h.stateDir)); err == nil {
+		t.Error("expected a restart policy to be rejected for a job")
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	h := newHarness(t)
+	managedServiceConf := &h.config.ServiceAgent.ManagedService
+	managedServiceConf.Replicas = 2
+	managedServiceConf.Ports = &conf.Ports{Args: []string{"-port", "{{port}}"}, Env: []string{listenPortEnv + "={{port}}"}}
+	managedServiceConf.Readiness = &conf.Readiness{Probes: []conf.Probe{{Type: "tcp", Address: "127.0.0.1:{{port}}"}}, Interval: "20ms"}
+	managedServiceConf.Restart = &conf.RestartPolicy{Policy: "on-failure", Backoff: "50ms"}
+	h.agent = h.newAgent()
+	h.start()
+
+	//every replica listens on a port of its own, passed as an argument, and is registered on it
+	checkReplicas := func(count int) map[int]int {
+		t.Helper()
+		replicas := h.agent.replicaList()
+		if len(replicas) != count {
+			t.Fatalf("expected %v replicas, got %v", count, len(replicas))
+		}
+		pids := make(map[int]int)
+		ports := make(map[int]bool)
+		for _, r := range replicas {
+			h.waitFor("the replica registration", func() bool { return r.managedServiceId() != "" })
+			reg, ok := h.consul.Service(r.managedServiceId())
+			if !ok || reg.Port != r.port || reg.Meta[replicaMetaKey] != strconv.Itoa(r.index) {
+				t.Errorf("replica %v on port %v is not registered on its port: %+v", r.index, r.port, reg)
+			}
+			args := r.managedCommand().Args
+			if r.port == 0 || ports[r.port] || strings.Join(args[len(args)-2:], " ") != "-port "+strconv.Itoa(r.port) {
+				t.Errorf("replica %v was not given a port of its own: %v, %v", r.index, r.port, args)
+			}
+			ports[r.port] = true
+			pids[r.index] = r.managedCommand().Process.Pid
+		}
+		if regs := h.consul.Services("Rolex"); len(regs) != count {
+			t.Errorf("expected %v registrations, got %v", count, regs)
+		}
+		return pids
+	}
+	pids := checkReplicas(2)
+
+	//replicas are supervised independently
+	second := h.agent.replica(1)
+	signalProcessGroup(second.managedCommand(), syscall.SIGKILL)
+	h.waitFor("the restart of the replica", func() bool {
+		return second.managedService.Lifecycle.Is(lifecycle.Running) && second.managedCommand().Process.Pid != pids[1]
+	})
+	if h.agent.State() != lifecycle.Running || h.agent.first().managedCommand().Process.Pid != pids[0] {
+		t.Errorf("the crash of a replica affected the first one, it is %v", h.agent.State())
+	}
+	checkReplicas(2)
+
+	if recorder := h.call("PUT", "/service/scale?replicas=3"); recorder.Code != 200 {
+		t.Fatalf("unable to scale up, got %v: %v", recorder.Code, recorder.Body)
+	}
+	pids = checkReplicas(3)
+	var scaling scalingStatus
+	json.Unmarshal(h.call("GET", "/service/scaling").Body.Bytes(), &scaling)
+	if len(scaling.Decisions) != 1 || scaling.Decisions[0].Trigger != scaleRequestTrigger || scaling.Decisions[0].From != 2 ||
+		scaling.Decisions[0].To != 3 || scaling.Decisions[0].Outcome != scaledOutcome {
+		t.Errorf("expected the requested scaling to be recorded, got %+v", scaling)
+	}
+	var health managedServiceHealth
+	recorder := h.call("GET", "/service/health?format=json")
+	if err := json.Unmarshal(recorder.Body.Bytes(), &health); err != nil || recorder.Code != 200 || len(health.Replicas) != 3 || !health.Healthy {
+		t.Errorf("expected 3 healthy replicas, got %v: %s", recorder.Code, recorder.Body)
+	}
+
+	//a restarted agent adopts all replicas, on their ports
+	h.start()
+	if adopted := checkReplicas(3); fmt.Sprint(adopted) != fmt.Sprint(pids) {
+		t.Errorf("expected the replicas %v to be adopted, got %v", pids, adopted)
+	}
+
+	removed := h.agent.replicaList()[1:]
+	if recorder := h.call("PUT", "/service/scale?replicas=1"); recorder.Code != 200 {
+		t.Fatalf("unable to scale down, got %v: %v", recorder.Code, recorder.Body)
+	}
+	checkReplicas(1)
+	for _, r := range removed {
+		if !r.managedService.Lifecycle.Is(lifecycle.Stopped) || r.managedCommand().Process.Signal(syscall.Signal(0)) == nil {
+			t.Errorf("removed replica %v is %v", r.index, r.managedService.Lifecycle.State())
+		}
+		if _, err := os.Stat(r.stateFile()); !os.IsNotExist(err) {
+			t.Errorf("the state file of removed replica %v was not deleted: %v", r.index, err)
+		}
+	}
+
+	if recorder := h.call("PUT", "/service/scale?replicas=0"); recorder.Code != 400 {
+		t.Errorf("expected scaling to no replica to be refused, got %v: %v", recorder.Code, recorder.Body)
+	}
+}
+
+func TestAutoscale(t *testing.T) {
+	h := newHarness(t)
+	h.config.ServiceAgent.ManagedService.Autoscale = &conf.Autoscale{
+		Min: 1, Max: 3, Signal: "dependencies", Target: 1, Interval: "50ms", ScaleUpCooldown: "0s", ScaleDownCooldown: "1h",
+	}
+	h.agent = h.newAgent()
+	h.start()
+	scaling := func() scalingStatus {
+		var status scalingStatus
+		json.Unmarshal(h.call("GET", "/service/scaling").Body.Bytes(), &status)
+		return status
+	}
+
+	//one replica per passing instance of the timer service, up to max
+	for i := 2; i <= 4; i++ {
+		h.consul.AddService(&consul.AgentServiceRegistration{ID: fmt.Sprintf("TimerService-Timer-%v", i), Name: "TimerService", Port: 9980, Tags: []string{"Timer"}})
+	}
+	h.waitFor("the scale up", func() bool { return h.agent.Replicas() == 3 })
+	time.Sleep(150 * time.Millisecond)
+	if replicas := h.agent.Replicas(); replicas != 3 {
+		t.Errorf("expected the replicas to stay at the maximum, got %v", replicas)
+	}
+	decision := scaling().Decisions[0]
+	if decision.Trigger != autoscalerTrigger || decision.Signal != "dependencies" || decision.Value == nil || decision.From != 1 || decision.To != 3 || decision.Outcome != scaledOutcome {
+		t.Errorf("unexpected scaling decision: %+v", decision)
+	}
+
+	//the scale down waits for its cooldown, which is recorded once
+	for i := 2; i <= 4; i++ {
+		h.consul.RemoveService(fmt.Sprintf("TimerService-Timer-%v", i))
+	}
+	h.waitFor("the cooldown", func() bool {
+		decisions := scaling().Decisions
+		return decisions[len(decisions)-1].Outcome == cooldownOutcome
+	})
+	time.Sleep(150 * time.Millisecond)
+	status := scaling()
+	if last := status.Decisions[len(status.Decisions)-1]; len(status.Decisions) != 2 || last.From != 3 || last.To != 1 || status.Replicas != 3 {
+		t.Errorf("expected the scale down to be held back once, got %+v", status)
+	}
+
+	//the autoscaler owns the number of replicas
+	for _, replicas := range []string{"2", "4"} {
+		if recorder := h.call("PUT", "/service/scale?replicas="+replicas); recorder.Code != 409 {
+			t.Errorf("expected scaling to %v replicas to be refused, got %v: %v", replicas, recorder.Code, recorder.Body)
+		}
+	}
+	if status := scaling(); status.Replicas != 3 || len(status.Decisions) != 2 {
+		t.Errorf("expected the refused scalings to leave the replicas alone, got %+v", status)
+	}
+}
+
+func TestScrapeMetric(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/metrics" {
+			writer.WriteHeader(404)
+			return
+		}
+		writer.Write([]byte("# HELP requests_in_flight Requests being served.\n" +
+			"# TYPE requests_in_flight gauge\n" +
+			"requests_in_flight{path=\"/a\"} 3\n" +
+			"requests_in_flight{path=\"/b {x}\"} 4.5 1700000000000\n" +
+			"requests_in_flight_total 100\n"))
+	}))
+	defer server.Close()
+
+	if value, err := scrapeMetric(server.URL+"/metrics", "requests_in_flight"); err != nil || value != 7.5 {
+		t.Errorf("expected the samples to add up to 7.5, got %v, %v", value, err)
+	}
+	if _, err := scrapeMetric(server.URL+"/metrics", "requests"); err == nil {
+		t.Error("expected a missing metric to be an error")
+	}
+	if _, err := scrapeMetric(server.URL+"/other", "requests_in_flight"); err == nil {
+		t.Error("expected a failed scrape to be an error")
+	}
+}
+
+func TestInvalidAutoscale(t *testing.T) {
+	h := newHarness(t)
+	for _, autoscale := range []*conf.Autoscale{
+		{Min: 0, Max: 2, Signal: "cpu", Target: 0.5},
+		{Min: 3, Max: 2, Signal: "cpu", Target: 0.5},
+		{Min: 1, Max: 2, Signal: "memory", Target: 0.5},
+		{Min: 1, Max: 2, Signal: "cpu"},
+		{Min: 1, Max: 2, Signal: "metric", Target: 10},
+		{Min: 1, Max: 2, Signal: "metric", Target: 10, Metric: &conf.ScrapedMetric{URL: "http://127.0.0.1:{{port}}/metrics", Name: "requests_total"}},
+		{Min: 1, Max: 2, Signal: "metric", Target: 10, Metric: &conf.ScrapedMetric{URL: "http://127.0.0.1:{{port}}/metrics", Name: "request_seconds_sum"}},
+		{Min: 1, Max: 2, Signal: "cpu", Target: 0.5, ScaleUpCooldown: "a while"},
+	} {
+		h.config.ServiceAgent.ManagedService.Autoscale = autoscale
+		if _, err := New(WithConfig(h.config), WithStateDir(h.stateDir)); err == nil {
+			t.Errorf("expected the autoscaling %+v to be rejected", autoscale)
+		}
+	}
+}
+
+func TestDependencyProxy(t *testing.T) {
+	h := newHarness(t)
+	//instances of the timer service answering with their name and the path they were called on
+	addInstance := func(name string) (string, string) {
+		server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			fmt.Fprintf(writer, "%v %v", name, request.URL.Path)
+		}))
+		t.Cleanup(server.Close)
+		port, _ := strconv.Atoi(server.URL[strings.LastIndex(server.URL, ":")+1:])
+		h.consul.AddService(&consul.AgentServiceRegistration{
+			ID: "TimerService-" + name, Name: "TimerService", Address: "127.0.0.1", Port: port,
+			Tags: []string{"Timer", "proto:http", "route:/v1"},
+		})
+		return "TimerService-" + name, server.URL + "/v1"
+	}
+	h.consul.RemoveService("TimerService-Timer-1")
+	first, firstURL := addInstance("a")
+	addInstance("b")
+	h.config.ServiceAgent.ManagedService.ServiceDependency[1].Proxy = &conf.DependencyProxy{RefreshInterval: "20ms"}
+	h.agent = h.newAgent()
+	h.start()
+
+	//the managed process is given the proxy instead of the instances
+	var proxies []proxyStatus
+	if err := json.Unmarshal(h.call("GET", "/service/proxies").Body.Bytes(), &proxies); err != nil || len(proxies) != 1 || len(proxies[0].Backends) != 2 {
+		t.Fatalf("expected a proxy to both instances, got %+v: %v", proxies, err)
+	}
+	port := proxies[0].Port
+	endpoint := fmt.Sprintf("http://127.0.0.1:%v", port)
+	pid := h.agent.first().managedCommand().Process.Pid
+	if args := h.agent.first().managedCommand().Args; strings.Join(args[1:], " ") != "-timerurl "+endpoint {
+		t.Fatalf("expected the process to be given the proxy, got %v", args)
+	}
+
+	get := func() string {
+		t.Helper()
+		response, err := http.Get(endpoint + "/time")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return string(body)
+	}
+	answers := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		answers[get()] = true
+	}
+	if !answers["a /v1/time"] || !answers["b /v1/time"] || len(answers) != 2 {
+		t.Errorf("expected the requests balanced over both instances, got %v", answers)
+	}
+
+	//the proxy follows the instances, the managed process is left alone
+	h.consul.RemoveService(first)
+	addInstance("c")
+	h.waitFor("the proxy to follow the instances", func() bool {
+		backends := h.agent.proxyList()[0].proxy.Backends()
+		return len(backends) == 2 && backends[0].URL != firstURL && backends[1].URL != firstURL
+	})
+	answers = map[string]bool{}
+	for i := 0; i < 4; i++ {
+		answers[get()] = true
+	}
+	if !answers["b /v1/time"] || !answers["c /v1/time"] || len(answers) != 2 {
+		t.Errorf("expected the requests balanced over the remaining instances, got %v", answers)
+	}
+	if h.agent.first().managedCommand().Process.Pid != pid {
+		t.Error("the managed process was restarted")
+	}
+
+	//a restarted agent adopts the process and proxies on the same port
+	h.start()
+	if h.agent.first().managedCommand().Process.Pid != pid || h.agent.proxyList()[0].port != port {
+		t.Errorf("expected the process adopted and the proxy on port %v, got %v", port, h.agent.proxyList()[0].port)
+	}
+	if answer := get(); answer != "b /v1/time" && answer != "c /v1/time" {
+		t.Errorf("expected the restarted proxy to forward, got %q", answer)
+	}
+}
+
+func TestInvalidProxy(t *testing.T) {
+	h := newHarness(t)
+	for _, config := range []*conf.DependencyProxy{
+		{Mode: "udp"},
+		{Balancing: "random"},
+		{Port: 70000},
+		{Retries: -1},
+		{EjectFor: "a while"},
+	} {
+		h.config.ServiceAgent.ManagedService.ServiceDependency[1].Proxy = config
+		if _, err := New(WithConfig(h.config), WithStateDir(h.stateDir)); err == nil {
+			t.Errorf("expected the proxy %+v to be rejected", config)
+		}
+	}
+	//the proxy takes the endpoint mapping for itself
+	h.config.ServiceAgent.ManagedService.ServiceDependency[1].Proxy = &conf.DependencyProxy{}
+	h.config.ServiceAgent.ManagedService.ServiceDependency[0].EndpointMapping = "timerurl"
+	if _, err := New(WithConfig(h.config), WithStateDir(h.stateDir)); err == nil {
+		t.Error("expected a proxy on a shared endpoint mapping to be rejected")
+	}
+}
+
+func TestEndpointOutliers(t *testing.T) {
+	h := newHarness(t)
+	var failing atomic.Bool
+	failing.Store(true)
+	addInstance := func(name string, handler http.HandlerFunc) string {
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+		port, _ := strconv.Atoi(server.URL[strings.LastIndex(server.URL, ":")+1:])
+		h.consul.AddService(&consul.AgentServiceRegistration{
+			ID: "TimerService-" + name, Name: "TimerService", Address: "127.0.0.1", Port: port, Tags: []string{"Timer"},
+		})
+		return server.URL
+	}
+	h.consul.RemoveService("TimerService-Timer-1")
+	healthy := addInstance("a", func(http.ResponseWriter, *http.Request) {})
+	erroring := addInstance("b", func(writer http.ResponseWriter, _ *http.Request) {
+		if failing.Load() {
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	slow := addInstance("c", func(http.ResponseWriter, *http.Request) { time.Sleep(100 * time.Millisecond) })
+	h.config.ServiceAgent.ManagedService.ServiceDependency[1].Probe = &conf.EndpointProbe{
+		Path: "/health", Interval: "20ms", Failures: 2, MaxLatency: "50ms", MaxEjectedPercent: 100,
+	}
+	h.agent = h.newAgent()
+	h.start()
+
+	ejected := func() map[string]bool {
+		var dependencies []dependencyEndpoints
+		if err := json.Unmarshal(h.call("GET", "/service/dependencies").Body.Bytes(), &dependencies); err != nil || len(dependencies) != 1 {
+			t.Fatalf("expected the endpoints of the probed dependency, got %+v: %v", dependencies, err)
+		}
+		ejected := make(map[string]bool)
+		for _, endpoint := range dependencies[0].Endpoints {
+			if endpoint.Ejected {
+				ejected[endpoint.URL] = true
+			}
+		}
+		return ejected
+	}
+	h.waitFor("the ejection of the outliers", func() bool {
+		e := ejected()
+		return len(e) == 2 && e[erroring] && e[slow]
+	})
+	endpoints, err := h.agent.discoverManagedServiceDependencies()
+	if err != nil || len(endpoints["timerurl"]) != 1 || endpoints["timerurl"][0].URL != healthy {
+		t.Errorf("expected only the healthy endpoint to be given to the managed service, got %v: %v", endpoints, err)
+	}
+	//the running process is started again without them
+	arguments := func() string {
+		if command := h.agent.first().managedCommand(); command != nil && h.running() {
+			return strings.Join(command.Args[1:], " ")
+		}
+		return ""
+	}
+	h.waitFor("the restart without the outliers", func() bool { return arguments() == "-timerurl "+healthy })
+
+	//a recovered endpoint is readmitted
+	failing.Store(false)
+	h.waitFor("the readmission of the recovered endpoint", func() bool { return !ejected()[erroring] })
+	if e := ejected(); !e[slow] {
+		t.Errorf("expected the slow endpoint to stay ejected, got %v", e)
+	}
+	h.waitFor("the restart with the recovered endpoint", func() bool { return strings.Contains(arguments(), erroring) })
+}
+
+func TestOutlierEjectionLimit(t *testing.T) {
+	h := newHarness(t)
+	dependency := conf.ServiceDependency{ServiceName: "TimerService", Probe: &conf.EndpointProbe{}}
+	var entries []*endpointHealth
+	for i := 0; i < 4; i++ {
+		health := &endpointHealth{URL: fmt.Sprintf("http://timer-%v", i)}
+		for j := 0; j < 3; j++ {
+			health.record(time.Now(), 0, fmt.Errorf("connection refused"))
+		}
+		entries = append(entries, health)
+	}
+	//at most half of the endpoints are ejected by default
+	h.agent.detectOutliers(dependency, entries)
+	ejected := 0
+	for _, health := range entries {
+		if health.Ejected {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Errorf("expected 2 of the 4 failing endpoints to be ejected, got %v", ejected)
+	}
+
+	//never all of them
+	dependency.Probe.MaxEjectedPercent = 100
+	h.agent.detectOutliers(dependency, entries)
+	if !entries[0].Ejected || !entries[1].Ejected || !entries[2].Ejected || entries[3].Ejected {
+		t.Errorf("expected all endpoints but one to be ejected: %+v", entries)
+	}
+}
+
+func TestInvalidEndpointProbe(t *testing.T) {
+	h := newHarness(t)
+	for _, config := range []*conf.EndpointProbe{
+		{Type: "exec"},
+		{Interval: "often"},
+		{Failures: -1},
+		{MaxEjectedPercent: 120},
+	} {
+		h.config.ServiceAgent.ManagedService.ServiceDependency[1].Probe = config
+		if _, err := New(WithConfig(h.config), WithStateDir(h.stateDir)); err == nil {
+			t.Errorf("expected the probe %+v to be rejected", config)
+		}
+	}
+}
+
+func TestDependencySelector(t *testing.T) {
+	h := newHarness(t)
+	h.consul.RemoveService("TimerService-Timer-1")
+	instance := func(n int, tags ...string) *consul.AgentServiceRegistration {
+		return &consul.AgentServiceRegistration{
+			ID: fmt.Sprintf("TimerService-%v", n), Name: "TimerService", Address: fmt.Sprintf("timer-%v.local", n), Port: 9980,
+			Tags: append([]string{"Timer"}, tags...),
+		}
+	}
+	h.consul.AddServiceOn("node-2", consultest.Datacenter, instance(1))
+	h.consul.AddServiceOn("node-2", consultest.Datacenter, instance(2))
+	heavy := instance(3)
+	heavy.Weights = &consul.AgentWeights{Passing: 10, Warning: 1}
+	h.consul.AddServiceOn("node-3", consultest.Datacenter, heavy)
+	h.consul.AddService(instance(4))
+	h.consul.AddServiceOn("node-4", consultest.Datacenter, instance(5, "zone:a"))
+
+	order := func(selector *conf.DependencySelector) []string {
+		t.Helper()
+		h.config.ServiceAgent.ManagedService.ServiceDependency[1].Select = selector
+		endpoints, err := h.newAgent().discoverManagedServiceDependencies()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hosts []string
+		for _, endpoint := range endpoints["timerurl"] {
+			hosts = append(hosts, strings.TrimSuffix(strings.TrimPrefix(endpoint.URL, "http://timer-"), ".local:9980"))
+		}
+		return hosts
+	}
+
+	prefer := []string{"same-node", "zone:a", "same-datacenter"}
+	if got := strings.Join(order(&conf.DependencySelector{Prefer: prefer, Order: "weight"}), ","); got != "4,5,3,1,2" {
+		t.Errorf("expected the local node, the zone, then the datacenter by weight, got %v", got)
+	}
+	if got := strings.Join(order(&conf.DependencySelector{Prefer: prefer[:2], Strict: true}), ","); got != "4,5" {
+		t.Errorf("expected the instances of other nodes and zones left out, got %v", got)
+	}
+	if got := strings.Join(order(&conf.DependencySelector{Prefer: []string{"tag:zone:b"}, Strict: true, Limit: 2}), ","); got != "1,2" {
+		t.Errorf("expected the registry order without a matching preference, limited to 2, got %v", got)
+	}
+
+	//a shuffle is the same for the same seed
+	shuffled := order(&conf.DependencySelector{Order: "shuffle", Seed: "agent-1"})
+	if again := order(&conf.DependencySelector{Order: "shuffle", Seed: "agent-1"}); len(shuffled) != 5 || strings.Join(again, ",") != strings.Join(shuffled, ",") {
+		t.Errorf("expected the same shuffle for the same seed, got %v and %v", shuffled, again)
+	}
+}
+
+func TestWeightedShuffle(t *testing.T) {
+	heavy := discovery.Endpoint{URL: "http://heavy", Weight: 10}
+	light := discovery.Endpoint{URL: "http://light", Weight: 1}
+	first := 0
+	for i := 0; i < 1000; i++ {
+		seed := strconv.Itoa(i)
+		if shuffleKey(seed, heavy) > shuffleKey(seed, light) {
+			first++
+		}
+	}
+	//10 out of 11 on average
+	if first < 850 || first > 960 {
+		t.Errorf("expected the heavy endpoint first about 909 times out of 1000, got %v", first)
+	}
+}
+
+func TestInvalidSelector(t *testing.T) {
+	h := newHarness(t)
+	for _, selector := range []*conf.DependencySelector{
+		{Prefer: []string{"same-rack"}},
+		{Prefer: []string{"zone:"}},
+		{Order: "random"},
+		{Limit: -1},
+	} {
+		h.config.ServiceAgent.ManagedService.ServiceDependency[1].Select = selector
+		if _, err := New(WithConfig(h.config), WithStateDir(h.stateDir)); err == nil {
+			t.Errorf("expected the selector %+v to be rejected", selector)
+		}
+	}
+}
+
+func TestDependencyFallback(t *testing.T) {
+	h := newHarness(t)
+	h.consul.AddService(&consul.AgentServiceRegistration{
+		ID: "BackupTimer-1", Name: "BackupTimer", Address: "backup.local", Port: 9980, Tags: []string{"Timer"},
+	})
+	h.consul.AddServiceOn("node-2", "dc2", &consul.AgentServiceRegistration{
+		ID: "TimerService-dc2", Name: "TimerService", Address: "timer-dc2.local", Port: 9980, Tags: []string{"Timer"},
+	})
+	dependency := &h.config.ServiceAgent.ManagedService.ServiceDependency[1]
+	dependency.UnavailablityImpact = suspendManagedServiceImpact
+	dependency.Fallback = []conf.DependencyFallback{{ServiceName: "BackupTimer"}, {Datacenter: "dc2"}}
+	h.agent = h.newAgent()
+	h.start()
+
+	expect := func(tier int, state lifecycle.State, endpoint string) {
+		t.Helper()
+		var fallbacks []dependencyFallbacks
+		if err := json.Unmarshal(h.call("GET", "/service/fallbacks").Body.Bytes(), &fallbacks); err != nil || len(fallbacks) != 1 || fallbacks[0].Active == nil {
+			t.Fatalf("expected the active tier of the dependency, got %+v: %v", fallbacks, err)
+		}
+		if active := fallbacks[0].Active; active.Tier != tier {
+			t.Errorf("expected tier %v to be active, got %+v", tier, active)
+		}
+		if got := h.agent.first().managedService.Lifecycle.State(); got != state {
+			t.Errorf("expected the managed service to be %v, it is %v", state, got)
+		}
+		if args := h.agent.first().managedCommand().Args; !strings.Contains(strings.Join(args, " "), endpoint) {
+			t.Errorf("expected the process to be given %v, got %v", endpoint, args)
+		}
+	}
+	expect(0, lifecycle.Running, "http://timer.local:9980/time")
+
+	//the backup service takes over before the impact applies, and the process is started again with it
+	h.consul.SetStatus("TimerService-Timer-1", consul.HealthCritical)
+	h.agent.checkDependencyHealth()
+	expect(1, lifecycle.Running, "http://backup.local:9980")
+
+	//then the instances of the other datacenter
+	h.consul.RemoveService("BackupTimer-1")
+	h.agent.checkDependencyHealth()
+	expect(2, lifecycle.Running, "http://timer-dc2.local:9980")
+
+	//the impact applies once no tier is left
+	h.consul.RemoveService("TimerService-dc2")
+	h.agent.checkDependencyHealth()
+	expect(-1, lifecycle.Suspended, "http://timer-dc2.local:9980")
+
+	//the dependency is back: the process is resumed, then given its instances again
+	h.consul.SetStatus("TimerService-Timer-1", consul.HealthPassing)
+	h.agent.checkDependencyHealth()
+	expect(0, lifecycle.Running, "http://timer.local:9980/time")
+}
+
+func TestInvalidFallback(t *testing.T) {
+	h := newHarness(t)
+	for _, fallback := range []conf.DependencyFallback{{}, {ServiceType: "Clock"}} {
+		h.config.ServiceAgent.ManagedService.ServiceDependency[1].Fallback = []conf.DependencyFallback{fallback}
+		if _, err := New(WithConfig(h.config), WithStateDir(h.stateDir)); err == nil {
+			t.Errorf("expected the fallback %+v to be rejected", fallback)
+		}
+	}
+}
+
+func TestDatacenterFailover(t *testing.T) {
+	h := newHarness(t)
+	h.consul.AddService(&consul.AgentServiceRegistration{
+		ID: "TimerService-Timer-2", Name: "TimerService", Address: "timer-2.local", Port: 9980, Tags: []string{"Timer"},
+	})
+	for _, name := range []string{"a", "b"} {
+		h.consul.AddServiceOn("node-"+name, "dc2", &consul.AgentServiceRegistration{
+			ID: "TimerService-dc2-" + name, Name: "TimerService", Address: "timer-dc2-" + name + ".local", Port: 9980, Tags: []string{"Timer"},
+		})
+	}
+	dependency := &h.config.ServiceAgent.ManagedService.ServiceDependency[1]
+	dependency.Datacenters, dependency.MinInstances = []string{consultest.Datacenter, "dc2"}, 2
+	h.agent = h.newAgent()
+	h.start()
+
+	expect := func(datacenter string, passing int, endpoint string) {
+		t.Helper()
+		var datacenters []dependencyDatacenters
+		if err := json.Unmarshal(h.call("GET", "/service/datacenters").Body.Bytes(), &datacenters); err != nil || len(datacenters) != 1 || datacenters[0].Active == nil {
+			t.Fatalf("expected the active datacenter of the dependency, got %+v: %v", datacenters, err)
+		}
+		if active := datacenters[0].Active; active.Datacenter != datacenter || active.Passing != passing {
+			t.Errorf("expected %v passing instances in %v, got %+v", passing, datacenter, active)
+		}
+		if args := h.agent.first().managedCommand().Args; !strings.Contains(strings.Join(args, " "), endpoint) {
+			t.Errorf("expected the process to be given %v, got %v", endpoint, args)
+		}
+	}
+	expect(consultest.Datacenter, 2, "http://timer-2.local:9980")
+
+	//below min-instances locally, the remote datacenter takes over and the process is started again with it
+	h.consul.SetStatus("TimerService-Timer-1", consul.HealthCritical)
+	h.agent.checkDependencyHealth()
+	expect("dc2", 2, "http://timer-dc2-a.local:9980")
+
+	//without enough instances anywhere, the datacenter with the most is used
+	h.consul.RemoveService("TimerService-dc2-b")
+	h.consul.RemoveService("TimerService-Timer-2")
+	h.agent.checkDependencyHealth()
+	expect("dc2", 1, "http://timer-dc2-a.local:9980")
+
+	//back to the local datacenter once it recovers
+	h.consul.SetStatus("TimerService-Timer-1", consul.HealthPassing)
+	h.consul.AddService(&consul.AgentServiceRegistration{
+		ID: "TimerService-Timer-2", Name: "TimerService", Address: "timer-2.local", Port: 9980, Tags: []string{"Timer"},
+	})
+	h.agent.checkDependencyHealth()
+	expect(consultest.Datacenter, 2, "http://timer-2.local:9980")
+	if state := h.agent.first().managedService.Lifecycle.State(); state != lifecycle.Running {
+		t.Errorf("expected the managed service to be running, it is %v", state)
+	}
+}
+
+func TestPreparedQuery(t *testing.T) {
+	h := newHarness(t)
+	h.consul.AddServiceOn("node-2", "dc2", &consul.AgentServiceRegistration{
+		ID: "TimerService-dc2", Name: "TimerService", Address: "timer-dc2.local", Port: 9980, Tags: []string{"Timer"},
+	})
+	h.consul.AddQuery(consul.PreparedQueryDefinition{Name: "timer", Service: consul.ServiceQuery{
+		Service: "TimerService", Tags: []string{"Timer"}, Failover: consul.QueryFailoverOptions{Datacenters: []string{"dc2"}},
+	}})
+	dependency := &h.config.ServiceAgent.ManagedService.ServiceDependency[1]
+	dependency.PreparedQuery = "timer"
+
+	hosts := func() []string {
+		t.Helper()
+		endpoints, err := h.newAgent().discoverManagedServiceDependencies()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hosts []string
+		for _, endpoint := range endpoints["timerurl"] {
+			hosts = append(hosts, endpoint.URL)
+		}
+		return hosts
+	}
+	if got := hosts(); len(got) != 1 || got[0] != "http://timer.local:9980/time" {
+		t.Errorf("expected the local instance, got %v", got)
+	}
+
+	//the failover of the query answers from the other datacenter
+	h.consul.SetStatus("TimerService-Timer-1", consul.HealthCritical)
+	if got := hosts(); len(got) != 1 || got[0] != "http://timer-dc2.local:9980" {
+		t.Errorf("expected the instance of the failover datacenter, got %v", got)
+	}
+
+	//executed in each of the datacenters, the query answers from the second one
+	h.consul.SetStatus("TimerService-Timer-1", consul.HealthPassing)
+	dependency.Datacenters, dependency.MinInstances = []string{"dc3", "dc2"}, 1
+	if got := hosts(); len(got) != 1 || got[0] != "http://timer-dc2.local:9980" {
+		t.Errorf("expected the instance of the second datacenter, got %v", got)
+	}
+}
+
+func TestInvalidFailover(t *testing.T) {
+	h := newHarness(t)
+	for _, invalid := range []func(*conf.ServiceDependency){
+		func(d *conf.ServiceDependency) { d.SRVName, d.PreparedQuery = "_timer._tcp.service.consul", "timer" },
+		func(d *conf.ServiceDependency) { d.Datacenter, d.Datacenters = "dc1", []string{"dc2"} },
+		func(d *conf.ServiceDependency) { d.Datacenters = []string{"dc1", ""} },
+		func(d *conf.ServiceDependency) { d.MinInstances = -1 },
+	} {
+		dependency := h.config.ServiceAgent.ManagedService.ServiceDependency[1]
+		invalid(&h.config.ServiceAgent.ManagedService.ServiceDependency[1])
+		if _, err := New(WithConfig(h.config), WithStateDir(h.stateDir)); err == nil {
+			t.Errorf("expected %+v to be rejected", h.config.ServiceAgent.ManagedService.ServiceDependency[1])
+		}
+		h.config.ServiceAgent.ManagedService.ServiceDependency[1] = dependency
+	}
+}
+
+func TestDependencyGroups(t *testing.T) {
+	h := newHarness(t)
+	managedService := &h.config.ServiceAgent.ManagedService
+	managedService.Process.Args = append(managedService.Process.Args, "timerv2url")
+	managedService.ServiceDependency[1].Group = "timers"
+	managedService.ServiceDependency = append(managedService.ServiceDependency, conf.ServiceDependency{
+		EndpointMapping: "timerv2url", ServiceName: "TimerServiceV2", ServiceType: "Timer", Group: "timers",
+	})
+	managedService.DependencyGroups = []conf.DependencyGroup{{Name: "timers", Require: "any", UnavailablityImpact: suspendManagedServiceImpact}}
+	h.agent = h.newAgent()
+	//either timer service is enough to start
+	h.start()
+
+	expect := func(state lifecycle.State, available ...string) {
+		t.Helper()
+		h.agent.checkDependencyHealth()
+		if got := h.agent.first().managedService.Lifecycle.State(); got != state {
+			t.Errorf("expected the managed service to be %v, it is %v", state, got)
+		}
+		var groups []groupState
+		if err := json.Unmarshal(h.call("GET", "/service/dependency-groups").Body.Bytes(), &groups); err != nil || len(groups) != 1 {
+			t.Fatalf("expected the state of the group, got %+v: %v", groups, err)
+		}
+		if strings.Join(groups[0].Available, ",") != strings.Join(available, ",") || groups[0].Satisfied != (len(available) > 0) {
+			t.Errorf("expected %v available, got %+v", available, groups[0])
+		}
+	}
+	expect(lifecycle.Running, "TimerService")
+
+	h.consul.SetStatus("TimerService-Timer-1", consul.HealthCritical)
+	expect(lifecycle.Suspended)
+
+	h.consul.AddService(&consul.AgentServiceRegistration{
+		ID: "TimerServiceV2-1", Name: "TimerServiceV2", Address: "timer-v2.local", Port: 9980, Tags: []string{"Timer"},
+	})
+	expect(lifecycle.Running, "TimerServiceV2")
+	//resumed and started again with the endpoint of the member that is available now
+	args := strings.Join(h.agent.first().managedCommand().Args, " ")
+	if !strings.Contains(args, "-timerv2url http://timer-v2.local:9980") || strings.Contains(args, "-timerurl") {
+		t.Errorf("expected the managed service to be given the TimerServiceV2 endpoint only, its arguments are %v", args)
+	}
+}
+
+func TestDependencyQuorum(t *testing.T) {
+	h := newHarness(t)
+	managedService := &h.config.ServiceAgent.ManagedService
+	managedService.ServiceDependency = nil
+	for _, name := range []string{"a", "b", "c"} {
+		managedService.ServiceDependency = append(managedService.ServiceDependency, conf.ServiceDependency{
+			EndpointMapping: "cache" + name, ServiceName: "Cache-" + name, ServiceType: "Weather", Group: "caches",
+		})
+	}
+	managedService.DependencyGroups = []conf.DependencyGroup{{Name: "caches", Require: "quorum", UnavailablityImpact: shutdownManagedServiceImpact}}
+	addCache := func(name string) {
+		h.consul.AddService(&consul.AgentServiceRegistration{
+			ID: "Cache-" + name, Name: "Cache-" + name, Address: "cache-" + name + ".local", Port: 6379, Tags: []string{"Weather"},
+		})
+	}
+
+	addCache("a")
+	if _, err := h.newAgent().discoverManagedServiceDependencies(); err == nil || !strings.Contains(err.Error(), "1 of 3 members available") {
+		t.Errorf("expected the group without a quorum to be unavailable, got %v", err)
+	}
+	addCache("c")
+	endpoints, err := h.newAgent().discoverManagedServiceDependencies()
+	if err != nil {
+		t.Fatalf("expected a quorum of 2 out of 3 members, got %v", err)
+	}
+	if len(endpoints["cachea"]) != 1 || len(endpoints["cacheb"]) != 0 || len(endpoints["cachec"]) != 1 {
+		t.Errorf("expected the endpoints of the available members, got %v", endpoints)
+	}
+
+	managedService.DependencyGroups[0].Quorum = 3
+	if _, err := h.newAgent().discoverManagedServiceDependencies(); err == nil {
+		t.Error("expected the quorum of 3 to be unavailable")
+	}
+}
+
+func TestInvalidDependencyGroup(t *testing.T) {
+	h := newHarness(t)
+	for _, groups := range [][]conf.DependencyGroup{
+		{{Name: "timers", Require: "most", UnavailablityImpact: suspendManagedServiceImpact}},
+		{{Name: "timers", Require: "quorum", Quorum: 2, UnavailablityImpact: suspendManagedServiceImpact}},
+		{{Name: "timers", UnavailablityImpact: "ignore"}},
+		{{Name: "timers", UnavailablityImpact: suspendManagedServiceImpact}, {Name: "timers", UnavailablityImpact: suspendManagedServiceImpact}},
+		{{Name: "others", UnavailablityImpact: suspendManagedServiceImpact}},
+		{{Name: "timers", UnavailablityImpact: suspendManagedServiceImpact}, {Name: "others", Require: "any", UnavailablityImpact: suspendManagedServiceImpact}},
+	} {
+		h.config.ServiceAgent.ManagedService.ServiceDependency[1].Group = "timers"
+		h.config.ServiceAgent.ManagedService.DependencyGroups = groups
+		if _, err := New(WithConfig(h.config), WithStateDir(h.stateDir)); err == nil {
+			t.Errorf("expected the groups %+v to be rejected", groups)
+		}
+	}
+}
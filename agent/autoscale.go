@@ -0,0 +1,357 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/julienschmidt/httprouter"
+)
+
+/********************************************************************************************
+	            autoscaling of the replicas of the managed service
+ *******************************************************************************************/
+
+//The autoscaler evaluates its signal every interval and scales the replicas so that the signal per replica is at the
+//target: the CPU time the process groups of the replicas used since the previous evaluation, a metric scraped from
+//each replica, or the number of passing instances of the dependencies. Replicas without a sample (just started,
+//not running, not answering the scrape) are left out of the average. The number of replicas stays between min and
+//max, and is not changed again before the cooldown of the direction expired. Every decision to change the number
+//of replicas is logged and kept in the audit trail served by GET /service/scaling. PUT /service/scale is refused
+//while the autoscaler owns the number of replicas, since it would revert the scaling at its next evaluation. The
+//scraped metric must be a gauge: a counter only grows, and would keep the replicas at max.
+
+var (
+	cpuSignal          = "cpu"
+	metricSignal       = "metric"
+	dependenciesSignal = "dependencies"
+	validScaleSignals  = []string{cpuSignal, metricSignal, dependenciesSignal}
+
+	// the suffixes of the Prometheus counters, which can not be scaled on
+	counterSuffixes = []string{"_total", "_count", "_sum", "_bucket"}
+
+	defaultAutoscaleInterval = 30 * time.Second
+	defaultScaleUpCooldown   = time.Minute
+	defaultScaleDownCooldown = 5 * time.Minute
+	defaultScalingHistory    = 50
+	metricScrapeTimeout      = 5 * time.Second
+)
+
+// who decided a scaling, and what came of it
+var (
+	autoscalerTrigger   = "autoscaler"
+	scaleRequestTrigger = "api"
+
+	scaledOutcome   = "scaled"
+	cooldownOutcome = "cooldown"
+	failedOutcome   = "failed"
+)
+
+// scalingDecision records a change of the number of replicas, made or held back
+type scalingDecision struct {
+	Time    time.Time `json:"time"`
+	Trigger string    `json:"trigger"`
+	// the signal and its value per replica (the total for dependencies) the autoscaler decided on
+	Signal  string   `json:"signal,omitempty"`
+	Value   *float64 `json:"value,omitempty"`
+	From    int      `json:"from"`
+	To      int      `json:"to"`
+	Outcome string   `json:"outcome"`
+	Reason  string   `json:"reason,omitempty"`
+}
+
+// the CPU time of the process group of a replica when the autoscaler last sampled it
+type cpuSample struct {
+	pid     int
+	seconds float64
+	at      time.Time
+}
+
+func validateAutoscale(autoscale *conf.Autoscale) error {
+	if autoscale == nil {
+		return nil
+	}
+	if autoscale.Min < 1 || autoscale.Max < autoscale.Min {
+		return fmt.Errorf("invalid bounds %v-%v, expected 1 <= min <= max", autoscale.Min, autoscale.Max)
+	}
+	if !validateValue(autoscale.Signal, validScaleSignals) {
+		return fmt.Errorf("invalid signal: %v, valid signals are: %v", autoscale.Signal, validScaleSignals)
+	}
+	if autoscale.Target <= 0 {
+		return fmt.Errorf("invalid target: %v", autoscale.Target)
+	}
+	if autoscale.Signal == metricSignal && (autoscale.Metric == nil || autoscale.Metric.URL == "" || autoscale.Metric.Name == "") {
+		return fmt.Errorf("the metric signal requires a metric url and name")
+	}
+	if autoscale.Signal == metricSignal {
+		for _, suffix := range counterSuffixes {
+			if strings.HasSuffix(autoscale.Metric.Name, suffix) {
+				return fmt.Errorf("invalid metric: %v is a counter, the metric signal requires a gauge", autoscale.Metric.Name)
+			}
+		}
+	}
+	for _, duration := range []string{autoscale.Interval, autoscale.ScaleUpCooldown, autoscale.ScaleDownCooldown} {
+		if _, err := parseDuration(duration, 0); err != nil {
+			return err
+		}
+	}
+	if autoscale.History < 0 {
+		return fmt.Errorf("invalid history: %v", autoscale.History)
+	}
+	return nil
+}
+
+// start evaluating the autoscaling signal until the agent shuts down
+func (a *Agent) autoscaleJob() {
+	autoscale := a.config.ServiceAgent.ManagedService.Autoscale
+	if autoscale == nil {
+		return
+	}
+	interval, _ := parseDuration(autoscale.Interval, defaultAutoscaleInterval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-ticker.C:
+			}
+			if !a.quiesced() {
+				a.autoscale()
+			}
+		}
+	}()
+}
+
+// evaluate the signal once and scale the replicas if needed
+func (a *Agent) autoscale() {
+	autoscale := a.config.ServiceAgent.ManagedService.Autoscale
+	current := len(a.replicaList())
+	value, ok := a.scalingSignal()
+	desired := current
+	if ok {
+		if autoscale.Signal == dependenciesSignal {
+			desired = int(math.Ceil(value / autoscale.Target))
+		} else {
+			desired = int(math.Ceil(value * float64(current) / autoscale.Target))
+		}
+	}
+	//the bounds apply even without a signal
+	if desired < autoscale.Min {
+		desired = autoscale.Min
+	} else if desired > autoscale.Max {
+		desired = autoscale.Max
+	}
+	if desired == current {
+		return
+	}
+
+	decision := scalingDecision{Time: a.clock.Now(), Trigger: autoscalerTrigger, From: current, To: desired}
+	if ok {
+		decision.Signal, decision.Value = autoscale.Signal, &value
+	}
+	if cooldown := a.scalingCooldown(desired > current); cooldown > 0 {
+		decision.Outcome, decision.Reason = cooldownOutcome, fmt.Sprintf("%v of cooldown left", cooldown)
+		a.recordScaling(decision)
+		return
+	}
+	if err := a.Scale(desired); err != nil {
+		decision.Outcome, decision.Reason = failedOutcome, err.Error()
+	} else {
+		decision.Outcome = scaledOutcome
+	}
+	a.recordScaling(decision)
+}
+
+// the value of the signal: per replica for cpu and metric, the total for dependencies. false without any sample
+func (a *Agent) scalingSignal() (float64, bool) {
+	autoscale := a.config.ServiceAgent.ManagedService.Autoscale
+	if autoscale.Signal == dependenciesSignal {
+		instances := 0
+		for _, dependency := range a.config.ServiceAgent.ManagedService.ServiceDependency {
+			if dependency.Skip {
+				continue
+			}
+			//an unavailable dependency has no passing instance
+			if passing, err := a.lookupDependency(dependency); err == nil {
+				instances += len(passing)
+			}
+		}
+		return float64(instances), true
+	}
+
+	var total float64
+	samples := 0
+	for _, r := range a.replicaList() {
+		var value float64
+		var err error
+		if autoscale.Signal == cpuSignal {
+			value, err = r.cpuRate()
+		} else {
+			value, err = scrapeMetric(r.expand(autoscale.Metric.URL), autoscale.Metric.Name)
+		}
+		if err != nil {
+			continue
+		}
+		total += value
+		samples++
+	}
+	if samples == 0 {
+		return 0, false
+	}
+	return total / float64(samples), true
+}
+
+// the CPUs used by the process group of the replica since the previous sample. only the autoscaler samples
+func (r *replica) cpuRate() (float64, error) {
+	usage, err := r.usage()
+	if err != nil {
+		return 0, err
+	}
+	sample := cpuSample{pid: r.managedCommand().Process.Pid, seconds: usage.CPUSeconds, at: r.clock.Now()}
+	previous := r.cpuSample
+	r.cpuSample = sample
+	//a new process starts counting from zero
+	if previous.pid != sample.pid || !sample.at.After(previous.at) {
+		return 0, fmt.Errorf("no previous sample of process %v", sample.pid)
+	}
+	return (sample.seconds - previous.seconds) / sample.at.Sub(previous.at).Seconds(), nil
+}
+
+// scrape a metric in the Prometheus text format, adding up the values of its samples
+func scrapeMetric(url, name string) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), metricScrapeTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return 0, fmt.Errorf("%v answered %v", url, response.Status)
+	}
+
+	var total float64
+	found := false
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		//name{labels} value [timestamp]
+		end := strings.IndexAny(line, "{ ")
+		if end < 0 || line[:end] != name {
+			continue
+		}
+		rest := line[end:]
+		if strings.HasPrefix(rest, "{") {
+			if closing := strings.LastIndex(rest, "}"); closing >= 0 {
+				rest = rest[closing+1:]
+			}
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value of %v: %v", name, fields[0])
+		}
+		total += value
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("%v does not expose %v", url, name)
+	}
+	return total, nil
+}
+
+// how much longer the replicas may not be scaled in the direction, zero once the cooldown expired
+func (a *Agent) scalingCooldown(up bool) time.Duration {
+	autoscale := a.config.ServiceAgent.ManagedService.Autoscale
+	cooldown, _ := parseDuration(autoscale.ScaleDownCooldown, defaultScaleDownCooldown)
+	if up {
+		cooldown, _ = parseDuration(autoscale.ScaleUpCooldown, defaultScaleUpCooldown)
+	}
+	a.mu.Lock()
+	lastScaled := a.lastScaled
+	a.mu.Unlock()
+	if lastScaled.IsZero() {
+		return 0
+	}
+	if left := lastScaled.Add(cooldown).Sub(a.clock.Now()); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// log a scaling decision and add it to the audit trail. a decision held back by the cooldown is only recorded once
+// while it stays the same
+func (a *Agent) recordScaling(decision scalingDecision) {
+	history := defaultScalingHistory
+	if autoscale := a.config.ServiceAgent.ManagedService.Autoscale; autoscale != nil && autoscale.History > 0 {
+		history = autoscale.History
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if decision.Outcome == cooldownOutcome && len(a.scalingDecisions) > 0 {
+		last := a.scalingDecisions[len(a.scalingDecisions)-1]
+		if last.Outcome == cooldownOutcome && last.From == decision.From && last.To == decision.To {
+			return
+		}
+	}
+	a.scalingDecisions = append(a.scalingDecisions, decision)
+	if len(a.scalingDecisions) > history {
+		a.scalingDecisions = a.scalingDecisions[len(a.scalingDecisions)-history:]
+	}
+
+	signal := ""
+	if decision.Signal != "" {
+		signal = fmt.Sprintf(" on %v %v", decision.Signal, strconv.FormatFloat(*decision.Value, 'f', -1, 64))
+	}
+	reason := ""
+	if decision.Reason != "" {
+		reason = ": " + decision.Reason
+	}
+	a.logger.Printf("scaling of service %v from %v to %v replicas (%v%v) %v%v", a.config.ServiceAgent.ManagedService.Name,
+		decision.From, decision.To, decision.Trigger, signal, decision.Outcome, reason)
+}
+
+// the JSON body of /service/scaling
+type scalingStatus struct {
+	Replicas  int               `json:"replicas"`
+	Min       int               `json:"min,omitempty"`
+	Max       int               `json:"max,omitempty"`
+	Signal    string            `json:"signal,omitempty"`
+	Decisions []scalingDecision `json:"decisions"`
+}
+
+func (a *Agent) scalingHandler(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	status := scalingStatus{Replicas: len(a.replicaList())}
+	if autoscale := a.config.ServiceAgent.ManagedService.Autoscale; autoscale != nil {
+		status.Min, status.Max, status.Signal = autoscale.Min, autoscale.Max, autoscale.Signal
+	}
+	a.mu.Lock()
+	status.Decisions = append([]scalingDecision{}, a.scalingDecisions...)
+	a.mu.Unlock()
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(status)
+}
@@ -0,0 +1,349 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/discovery"
+	"github.com/aambhaik/tmgcagent/lifecycle"
+	"github.com/robfig/cron"
+)
+
+// get addressable urls for the dependency services
+func (a *Agent) discoverManagedServiceDependencies() (serviceDepMap map[string][]discovery.Endpoint, err error) {
+	dependencyEndpointsMap := make(map[string][]discovery.Endpoint)
+	//availability of the members of the dependency groups, by dependency key
+	available := make(map[string]bool)
+	for _, service := range a.config.ServiceAgent.ManagedService.ServiceDependency {
+		if service.Skip {
+			continue
+		}
+
+		if !validateValue(service.ServiceType, validServiceTypes) {
+			a.logger.Printf("Invalid type found in the service configuration: %v, valid types are: %v", service.ServiceType, validServiceTypes)
+			return nil, fmt.Errorf("invalid type found in the service configuration: %v", service.ServiceType)
+		}
+
+		//the members of a group have the impact of their group
+		if service.Group == "" && !validateValue(service.UnavailablityImpact, validImpactTypes) {
+			a.logger.Printf("Invalid impact type found in the service configuration: %v, valid types are: %v", service.UnavailablityImpact, validImpactTypes)
+			return nil, fmt.Errorf("invalid type found in the service configuration: %v", service.UnavailablityImpact)
+		}
+
+		if !validateValue(service.TaggedAddress, discovery.ValidTaggedAddresses) {
+			a.logger.Printf("Invalid tagged address found in the service configuration: %v, valid values are: %v", service.TaggedAddress, discovery.ValidTaggedAddresses)
+			return nil, fmt.Errorf("invalid tagged address found in the service configuration: %v", service.TaggedAddress)
+		}
+		//query consul (or DNS) for service with specific Type. the scheme, path, tls server name and weight come from
+		//the instance's service meta, falling back on its tags
+		endpoints, err := a.resolveDependency(service)
+		if err != nil {
+			a.logger.Printf("Unable to access service from the registry. name: %v, type: %v", service.ServiceName, service.ServiceType)
+			if service.Group != "" {
+				//whether the managed service can do without it is up to its group
+				continue
+			}
+			return nil, err
+		}
+		available[dependencyKey(service)] = len(endpoints) > 0
+		//without the endpoints the agent's own probes ejected, up to the limit of the selector
+		dependencyEndpointsMap[service.EndpointMapping] = a.usableEndpoints(service, endpoints)
+	}
+
+	for _, state := range a.evaluateGroups(available) {
+		if !state.Satisfied {
+			return nil, fmt.Errorf("dependency group %v is unavailable: %v", state.Name, state.summary())
+		}
+	}
+	return dependencyEndpointsMap, nil
+}
+
+// look up the healthy instances of a dependency, through its DNS SRV record if it has a srv-name and through the
+// registry (in its datacenters, or by its prepared query) otherwise. answers are cached by the resolver for their
+// TTL, so each health check re-resolves expired records.
+func (a *Agent) lookupDependency(service conf.ServiceDependency) ([]*discovery.Instance, error) {
+	if service.SRVName == "" {
+		return a.lookupDatacenters(service)
+	}
+
+	targets, err := a.resolver.LookupSRV(service.SRVName)
+	if err != nil {
+		a.logger.Printf("unable to resolve the SRV record %v: %v", service.SRVName, err)
+		return nil, err
+	}
+
+	//TXT records on the SRV name carry the endpoint metadata: key=value records (as consul DNS publishes service
+	//meta) become meta, key:value records are treated like tags. the service label of the SRV name is the
+	//fallback for the scheme
+	var tags []string
+	meta := make(map[string]string)
+	txt, err := a.resolver.LookupTXT(service.SRVName)
+	if err != nil {
+		a.logger.Printf("unable to resolve TXT records for %v, continuing without them: %v", service.SRVName, err)
+	}
+	for _, record := range txt {
+		if kv := strings.SplitN(record, "=", 2); len(kv) == 2 {
+			meta[kv[0]] = kv[1]
+		} else {
+			tags = append(tags, record)
+		}
+	}
+	if label := strings.SplitN(service.SRVName, ".", 2)[0]; label == "_http" || label == "_https" {
+		tags = append(tags, "proto:"+label[1:])
+	}
+
+	var instances []*discovery.Instance
+	for _, target := range targets {
+		address := target.Address
+		if address == "" {
+			address = target.Host
+		}
+		instances = append(instances, &discovery.Instance{
+			Name:    service.ServiceName,
+			Address: address,
+			Port:    target.Port,
+			Tags:    tags,
+			Meta:    meta,
+		})
+	}
+	return instances, nil
+}
+
+// map each dependency url onto the managed process argument named by its endpoint mapping
+func managedProcessArguments(managedProcessArgNames []string, serviceDependencyEndpointsMap map[string][]discovery.Endpoint) []string {
+	var processArguments []string
+	for _, managedProcessArgName := range managedProcessArgNames {
+		dependencyServiceEndpoints := serviceDependencyEndpointsMap[managedProcessArgName]
+		for _, serviceEndpoint := range dependencyServiceEndpoints {
+			processArguments = append(processArguments, "-"+managedProcessArgName)
+			processArguments = append(processArguments, serviceEndpoint.URL)
+		}
+	}
+	return processArguments
+}
+
+// cron job to check dependent service health
+func (a *Agent) checkDependencyHealthJob() {
+	c := cron.New()
+
+	c.AddFunc("@every "+a.config.ServiceAgent.DependencyCheckInterval, func() {
+		if !a.quiesced() {
+			a.checkDependencyHealth()
+		}
+	})
+
+	c.Start()
+	a.mu.Lock()
+	a.cron = c
+	a.mu.Unlock()
+}
+
+// where the endpoints of a dependency come from: its active tier and the datacenter the tier is looked up in, less
+// the endpoints the probes of the agent ejected, or nowhere for a member of a group that is not available. called
+// with a.mu held
+func (a *Agent) dependencySource(dependency conf.ServiceDependency) string {
+	if available, ok := a.memberAvailability[dependencyKey(dependency)]; ok && !available {
+		return "no instance"
+	}
+	tier := 0
+	if active, ok := a.activeTiers[dependencyKey(dependency)]; ok && active.Tier >= 0 {
+		tier = active.Tier
+	}
+	source := fmt.Sprintf("tier %v", tier)
+	if active, ok := a.activeDatacenters[dependencyKey(dependencyTiers(dependency)[tier])]; ok && active.Datacenter != "" {
+		source += " in datacenter " + active.Datacenter
+	}
+	if ejected := a.ejectedEndpoints(dependency); len(ejected) > 0 {
+		source += " without " + strings.Join(ejected, ", ")
+	}
+	return source
+}
+
+// the sources of the endpoints of the dependencies, by dependency key
+func (a *Agent) currentSources() map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sources := make(map[string]string)
+	for _, dependency := range a.config.ServiceAgent.ManagedService.ServiceDependency {
+		if !dependency.Skip {
+			sources[dependencyKey(dependency)] = a.dependencySource(dependency)
+		}
+	}
+	return sources
+}
+
+func (r *replica) setDependencySources(sources map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dependencySources = sources
+}
+
+// the source of the endpoints of the dependency when the replica was given others, empty otherwise. the replica
+// adopted from a previous agent is taken for one given the endpoints of the current source
+func (r *replica) otherSource(dependency conf.ServiceDependency) string {
+	r.Agent.mu.Lock()
+	current := r.Agent.dependencySource(dependency)
+	r.Agent.mu.Unlock()
+
+	key := dependencyKey(dependency)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	given, ok := r.dependencySources[key]
+	if !ok {
+		if r.dependencySources == nil {
+			r.dependencySources = make(map[string]string)
+		}
+		r.dependencySources[key] = current
+		return ""
+	}
+	if given == current {
+		return ""
+	}
+	return current
+}
+
+// start the running replicas given the endpoints of a dependency from another source than the current one again,
+// with the current endpoints
+func (a *Agent) switchSources(replicas []*replica, service conf.ServiceDependency) {
+	for _, r := range replicas {
+		if !r.managedService.Lifecycle.Is(lifecycle.Running) {
+			continue
+		}
+		source := r.otherSource(service)
+		if source == "" {
+			continue
+		}
+		a.logger.Printf("Restarting the managed service %v with the instances of dependency %v from %v", r.name(), service.ServiceName, source)
+		if err := r.switchDependencies(fmt.Sprintf("dependency %v switched to %v", service.ServiceName, source)); err != nil {
+			a.logger.Printf("Error restarting the managed service [%v] with the instances of dependency %v from %v : [%v]", r.name(), service.ServiceName, source, err)
+		}
+	}
+}
+
+// stop the running replica and start it again with the current endpoints of its dependencies
+func (r *replica) switchDependencies(reason string) error {
+	machine := r.managedService.Lifecycle
+	if err := r.stopManagedService(reason); err != nil {
+		return err
+	}
+	waitStopped(machine, removeTimeout)
+	if !machine.Is(lifecycle.Stopped) {
+		return fmt.Errorf("the managed service %v did not stop, it is %v", r.name(), machine.State())
+	}
+
+	endpoints, err := r.discoverManagedServiceDependencies()
+	if err != nil {
+		return fmt.Errorf("unable to resolve service dependency : %v", err)
+	}
+	command := r.managedProcessCommand(endpoints)
+	machine.Transition(lifecycle.Starting, reason)
+	if err := r.launchManagedProcess(command, reason); err != nil {
+		return fmt.Errorf("unable to start the managed service %v: %v", r.name(), err)
+	}
+	serviceId, err := r.registerManagedService()
+	if err != nil {
+		return fmt.Errorf("unable to register the managed service: %v", err)
+	}
+	r.setManagedServiceId(serviceId)
+	return nil
+}
+
+// stop the replicas of the managed service as the impact of an unavailable dependency
+func (a *Agent) shutDownReplicas(replicas []*replica, reason string) {
+	for _, r := range replicas {
+		a.logger.Printf("Shutting down the managed process %v ", r.name())
+		if err := r.stopManagedService(reason); err != nil {
+			a.logger.Printf("Error stopping the managed service [%v] of type [%v] : [%v]", r.name(), a.config.ServiceAgent.ManagedService.Type, err)
+		}
+	}
+}
+
+// check the dependent service health once and apply the unavailability impact of any dependency (or dependency
+// group) that is down to the replicas of the managed service
+func (a *Agent) checkDependencyHealth() {
+	var replicas []*replica
+	for _, r := range a.replicaList() {
+		if r.managedService.Lifecycle.Is(lifecycle.Running, lifecycle.Suspended) {
+			replicas = append(replicas, r)
+		} else {
+			a.logger.Printf("Managed service %v is %v, skipping dependency check", r.name(), r.managedService.Lifecycle.State())
+		}
+	}
+	if len(replicas) == 0 {
+		return
+	}
+	managedServiceConf := a.config.ServiceAgent.ManagedService
+
+	var suspendReason string
+	var switches []conf.ServiceDependency
+	available := make(map[string]bool)
+	for _, service := range managedServiceConf.ServiceDependency {
+		if service.Skip {
+			continue
+		}
+		//query consul for service with specific Type
+		a.logger.Printf("Checking dependency at %v", a.clock.Now().Format("Jan 02 15:04:05.000 MST"))
+		services, err := a.lookupTiers(service)
+		ok := err == nil && services != nil
+		available[dependencyKey(service)] = ok
+		//proxies forward to the instances of the active tier and datacenter by themselves. the members of a group
+		//come and go without the group being unavailable
+		if service.Proxy == nil && (service.Group != "" || ok && (len(service.Fallback) > 0 || len(service.Datacenters) > 0)) {
+			switches = append(switches, service)
+		}
+		if ok || service.Group != "" {
+			//the impact of a group applies below
+			continue
+		}
+
+		reason := fmt.Sprintf("dependency %v of type %v is unavailable", service.ServiceName, service.ServiceType)
+		if service.UnavailablityImpact == shutdownManagedServiceImpact {
+			a.logger.Printf("Unable to access service from the registry. name: %v, type: %v", service.ServiceName, service.ServiceType)
+			a.shutDownReplicas(replicas, reason)
+			return
+		} else if service.UnavailablityImpact == suspendManagedServiceImpact {
+			suspendReason = reason
+		} else if service.UnavailablityImpact == reviveDependencyServiceImpact {
+			a.logger.Printf("Need to revive the managed service. name: %v, type: %v", service.ServiceName, service.ServiceType)
+		}
+	}
+
+	//a dependency group applies its impact once too few of its members are available
+	for i, state := range a.evaluateGroups(available) {
+		if state.Satisfied {
+			continue
+		}
+		group := managedServiceConf.DependencyGroups[i]
+		reason := fmt.Sprintf("dependency group %v is unavailable: %v", state.Name, state.summary())
+		if group.UnavailablityImpact == shutdownManagedServiceImpact {
+			a.shutDownReplicas(replicas, reason)
+			return
+		} else if group.UnavailablityImpact == suspendManagedServiceImpact {
+			suspendReason = reason
+		} else if group.UnavailablityImpact == reviveDependencyServiceImpact {
+			a.logger.Printf("Need to revive the managed service. group: %v", state.Name)
+		}
+	}
+
+	//the managed service stays suspended for as long as any dependency with the suspend impact is unavailable
+	for _, r := range replicas {
+		if suspendReason != "" && r.managedService.Lifecycle.Is(lifecycle.Running) {
+			a.logger.Printf("Suspending the managed service. name: %v, type: %v", r.name(), managedServiceConf.Type)
+			if err := r.suspendManagedService(suspendReason); err != nil {
+				a.logger.Printf("Error suspending the managed service [%v] of type [%v] : [%v]", r.name(), managedServiceConf.Type, err)
+			}
+		} else if suspendReason == "" && r.managedService.Lifecycle.Is(lifecycle.Suspended) {
+			a.logger.Printf("Resuming the managed service. name: %v, type: %v", r.name(), managedServiceConf.Type)
+			if err := r.resumeManagedService("dependencies available again"); err != nil {
+				a.logger.Printf("Error resuming the managed service [%v] of type [%v] : [%v]", r.name(), managedServiceConf.Type, err)
+			}
+		}
+	}
+
+	//the replicas given the endpoints of another tier or datacenter of a dependency than the active one, or given
+	//the endpoints of a group member that is gone or none of one that is back, are started again
+	for _, service := range switches {
+		a.switchSources(replicas, service)
+	}
+}
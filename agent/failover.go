@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/discovery"
+	"github.com/julienschmidt/httprouter"
+)
+
+/********************************************************************************************
+	            failover of the dependencies across datacenters
+ *******************************************************************************************/
+
+//A dependency is looked up in the registry by its service name and type, or through a prepared query of the
+//registry, whose own failover policy applies. A dependency with datacenters is looked up in each of them in order,
+//and the first with at least min-instances passing instances is used, so the agent fails over to a remote
+//datacenter when the local instances drop below min-instances and fails back as soon as they recover. When no
+//datacenter has enough, the one with the most passing instances is used.
+
+// the datacenter a dependency with datacenters is looked up in
+type activeDatacenter struct {
+	// empty while no datacenter has a passing instance
+	Datacenter string    `json:"datacenter"`
+	Passing    int       `json:"passing"`
+	Since      time.Time `json:"since"`
+}
+
+func validateFailover(dependencies []conf.ServiceDependency) error {
+	for _, dependency := range dependencies {
+		if dependency.SRVName != "" && (dependency.PreparedQuery != "" || len(dependency.Datacenters) > 0) {
+			return fmt.Errorf("the dependency %v is resolved through its srv-name, it can not have a prepared-query or datacenters", dependency.ServiceName)
+		}
+		if dependency.Datacenter != "" && len(dependency.Datacenters) > 0 {
+			return fmt.Errorf("the dependency %v can not have both a datacenter and datacenters", dependency.ServiceName)
+		}
+		for _, datacenter := range dependency.Datacenters {
+			if datacenter == "" {
+				return fmt.Errorf("the datacenters of %v can not be empty", dependency.ServiceName)
+			}
+		}
+		if dependency.MinInstances < 0 {
+			return fmt.Errorf("invalid min-instances of %v: %v", dependency.ServiceName, dependency.MinInstances)
+		}
+	}
+	return nil
+}
+
+// look up the passing instances of a dependency in the registry, in the first of its datacenters with at least
+// min-instances of them
+func (a *Agent) lookupDatacenters(service conf.ServiceDependency) ([]*discovery.Instance, error) {
+	if len(service.Datacenters) == 0 {
+		return a.lookupRegistry(service, service.Datacenter)
+	}
+	enough := minInstances(service)
+	var most []*discovery.Instance
+	var mostDatacenter string
+	var lastErr error
+	for _, datacenter := range service.Datacenters {
+		instances, err := a.lookupRegistry(service, datacenter)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(instances) >= enough {
+			a.setActiveDatacenter(service, datacenter, len(instances))
+			return instances, nil
+		}
+		if len(instances) > len(most) {
+			most, mostDatacenter = instances, datacenter
+		}
+	}
+	a.setActiveDatacenter(service, mostDatacenter, len(most))
+	if len(most) > 0 {
+		return most, nil
+	}
+	return nil, lastErr
+}
+
+func minInstances(service conf.ServiceDependency) int {
+	if service.MinInstances == 0 {
+		return 1
+	}
+	return service.MinInstances
+}
+
+// look up the passing instances of a dependency in a datacenter, the local one if empty
+func (a *Agent) lookupRegistry(service conf.ServiceDependency, datacenter string) ([]*discovery.Instance, error) {
+	if service.PreparedQuery != "" {
+		querier, ok := a.registry.(discovery.Querier)
+		if !ok {
+			return nil, fmt.Errorf("the registry does not support prepared queries, unable to resolve %v", service.PreparedQuery)
+		}
+		return querier.Query(service.PreparedQuery, datacenter)
+	}
+	var opts *discovery.QueryOptions
+	if datacenter != "" {
+		opts = &discovery.QueryOptions{Datacenter: datacenter}
+	}
+	return a.registry.Lookup(service.ServiceName, service.ServiceType, opts)
+}
+
+// record the datacenter a dependency is looked up in, logging the failovers and failbacks
+func (a *Agent) setActiveDatacenter(service conf.ServiceDependency, datacenter string, passing int) {
+	key := dependencyKey(service)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	previous, ok := a.activeDatacenters[key]
+	if ok && previous.Datacenter == datacenter {
+		previous.Passing = passing
+		return
+	}
+	if a.activeDatacenters == nil {
+		a.activeDatacenters = make(map[string]*activeDatacenter)
+	}
+	switch {
+	case datacenter == "":
+		a.logger.Printf("no datacenter of %v has a passing instance of dependency %v", service.Datacenters, service.ServiceName)
+	case datacenter != service.Datacenters[0]:
+		a.logger.Printf("dependency %v fails over to datacenter %v with %v passing instances, the datacenters before it have fewer than %v",
+			service.ServiceName, datacenter, passing, minInstances(service))
+	case ok:
+		a.logger.Printf("dependency %v fails back to datacenter %v with %v passing instances", service.ServiceName, datacenter, passing)
+	}
+	a.activeDatacenters[key] = &activeDatacenter{Datacenter: datacenter, Passing: passing, Since: a.clock.Now()}
+}
+
+// the JSON body of /service/datacenters, one per dependency (or fallback of a dependency) with datacenters
+type dependencyDatacenters struct {
+	EndpointMapping string   `json:"endpoint-mapping"`
+	ServiceName     string   `json:"service-name"`
+	ServiceType     string   `json:"service-type"`
+	PreparedQuery   string   `json:"prepared-query,omitempty"`
+	Datacenters     []string `json:"datacenters"`
+	MinInstances    int      `json:"min-instances"`
+	// nil until the dependency is first looked up
+	Active *activeDatacenter `json:"active"`
+}
+
+func (a *Agent) datacentersHandler(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	dependencies := []dependencyDatacenters{}
+	a.mu.Lock()
+	for _, dependency := range a.config.ServiceAgent.ManagedService.ServiceDependency {
+		if dependency.Skip {
+			continue
+		}
+		for _, tier := range dependencyTiers(dependency) {
+			if len(tier.Datacenters) == 0 {
+				continue
+			}
+			entry := dependencyDatacenters{
+				EndpointMapping: tier.EndpointMapping,
+				ServiceName:     tier.ServiceName,
+				ServiceType:     tier.ServiceType,
+				PreparedQuery:   tier.PreparedQuery,
+				Datacenters:     tier.Datacenters,
+				MinInstances:    tier.MinInstances,
+			}
+			if active, ok := a.activeDatacenters[dependencyKey(tier)]; ok {
+				copied := *active
+				entry.Active = &copied
+			}
+			dependencies = append(dependencies, entry)
+		}
+	}
+	a.mu.Unlock()
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(dependencies)
+}
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/discovery"
+	"github.com/julienschmidt/httprouter"
+)
+
+/********************************************************************************************
+	            fallbacks of the dependencies
+ *******************************************************************************************/
+
+//A dependency with fallbacks is resolved tier by tier: the dependency itself first, then each fallback in order,
+//another service name, service type or datacenter. The first tier with passing instances is the active one and
+//gives the endpoints of the managed service; the unavailability impact only applies once no tier has any. When the
+//active tier changes, proxied dependencies forward to the new instances on their next refresh, while the replicas
+//given the endpoints of another tier as arguments are started again by the dependency check.
+
+// the active tier of a dependency with fallbacks
+type dependencyTier struct {
+	// 0 for the dependency itself, n for its nth fallback, -1 while no tier has a passing instance
+	Tier        int       `json:"tier"`
+	ServiceName string    `json:"service-name,omitempty"`
+	ServiceType string    `json:"service-type,omitempty"`
+	Datacenter  string    `json:"datacenter,omitempty"`
+	Since       time.Time `json:"since"`
+}
+
+func validateFallbacks(dependencies []conf.ServiceDependency) error {
+	for _, dependency := range dependencies {
+		for _, fallback := range dependency.Fallback {
+			if fallback.ServiceName == "" && fallback.ServiceType == "" && fallback.Datacenter == "" {
+				return fmt.Errorf("a fallback of %v needs a service name, a service type or a datacenter", dependency.ServiceName)
+			}
+			if fallback.ServiceType != "" && !validateValue(fallback.ServiceType, validServiceTypes) {
+				return fmt.Errorf("invalid service type of a fallback of %v: %v, valid types are: %v", dependency.ServiceName, fallback.ServiceType, validServiceTypes)
+			}
+		}
+	}
+	return nil
+}
+
+// the tiers of a dependency: the dependency itself, then its fallbacks in order
+func dependencyTiers(dependency conf.ServiceDependency) []conf.ServiceDependency {
+	tiers := []conf.ServiceDependency{dependency}
+	for _, fallback := range dependency.Fallback {
+		tier := dependency
+		tier.SRVName, tier.PreparedQuery, tier.Fallback = "", "", nil
+		if fallback.ServiceName != "" {
+			tier.ServiceName = fallback.ServiceName
+		}
+		if fallback.ServiceType != "" {
+			tier.ServiceType = fallback.ServiceType
+		}
+		if fallback.Datacenter != "" {
+			tier.Datacenter, tier.Datacenters = fallback.Datacenter, nil
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers
+}
+
+// look up the passing instances of the first tier of the dependency that has any, and record it as the active
+// tier. the error is only returned when every tier failed with one
+func (a *Agent) lookupTiers(dependency conf.ServiceDependency) ([]*discovery.Instance, error) {
+	tiers := dependencyTiers(dependency)
+	var lastErr error
+	failed := 0
+	for tier, candidate := range tiers {
+		instances, err := a.lookupDependency(candidate)
+		if err != nil {
+			lastErr = err
+			failed++
+			continue
+		}
+		if len(instances) > 0 {
+			a.setActiveTier(dependency, tier, candidate)
+			return instances, nil
+		}
+	}
+	a.setActiveTier(dependency, -1, dependency)
+	if failed < len(tiers) {
+		lastErr = nil
+	}
+	return nil, lastErr
+}
+
+// record the active tier of a dependency with fallbacks, logging the switches
+func (a *Agent) setActiveTier(dependency conf.ServiceDependency, tier int, active conf.ServiceDependency) {
+	if len(dependency.Fallback) == 0 {
+		return
+	}
+	key := dependencyKey(dependency)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	previous, ok := a.activeTiers[key]
+	if ok && previous.Tier == tier {
+		return
+	}
+	if a.activeTiers == nil {
+		a.activeTiers = make(map[string]*dependencyTier)
+	}
+	switch {
+	case tier < 0:
+		a.logger.Printf("no tier of dependency %v has a passing instance", dependency.ServiceName)
+	case tier == 0 && ok:
+		a.logger.Printf("dependency %v is back on its own instances", dependency.ServiceName)
+	case tier > 0:
+		a.logger.Printf("dependency %v falls back on %v of type %v in datacenter %q (fallback %v)", dependency.ServiceName,
+			active.ServiceName, active.ServiceType, active.Datacenter, tier)
+	}
+	entry := &dependencyTier{Tier: tier, Since: a.clock.Now()}
+	if tier >= 0 {
+		entry.ServiceName, entry.ServiceType, entry.Datacenter = active.ServiceName, active.ServiceType, active.Datacenter
+	}
+	a.activeTiers[key] = entry
+}
+
+// the JSON body of /service/fallbacks, one per dependency with fallbacks
+type dependencyFallbacks struct {
+	EndpointMapping string                    `json:"endpoint-mapping"`
+	ServiceName     string                    `json:"service-name"`
+	ServiceType     string                    `json:"service-type"`
+	Fallback        []conf.DependencyFallback `json:"fallback"`
+	// nil until the dependency is first looked up
+	Active *dependencyTier `json:"active"`
+}
+
+func (a *Agent) fallbacksHandler(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	dependencies := []dependencyFallbacks{}
+	a.mu.Lock()
+	for _, dependency := range a.config.ServiceAgent.ManagedService.ServiceDependency {
+		if dependency.Skip || len(dependency.Fallback) == 0 {
+			continue
+		}
+		entry := dependencyFallbacks{
+			EndpointMapping: dependency.EndpointMapping,
+			ServiceName:     dependency.ServiceName,
+			ServiceType:     dependency.ServiceType,
+			Fallback:        dependency.Fallback,
+		}
+		if active, ok := a.activeTiers[dependencyKey(dependency)]; ok {
+			copied := *active
+			entry.Active = &copied
+		}
+		dependencies = append(dependencies, entry)
+	}
+	a.mu.Unlock()
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(dependencies)
+}
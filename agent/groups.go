@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/julienschmidt/httprouter"
+)
+
+/********************************************************************************************
+	            groups of dependencies
+ *******************************************************************************************/
+
+//The dependencies of a group are evaluated together: the group is available when all of its members are, any of
+//them is, or a quorum of them is. The unavailability impact of the group applies instead of those of its members,
+//and only when the group is unavailable; a member that is not available meanwhile gives the managed service no
+//endpoint. Skipped dependencies are not members of their group.
+
+var (
+	requireAll         = "all"
+	requireAny         = "any"
+	requireQuorum      = "quorum"
+	validGroupRequires = []string{requireAll, requireAny, requireQuorum}
+)
+
+// the state of a dependency group as of the last dependency check
+type groupState struct {
+	Name    string `json:"name"`
+	Require string `json:"require"`
+	// number of available members the group needs
+	Needed      int       `json:"needed"`
+	Available   []string  `json:"available"`
+	Unavailable []string  `json:"unavailable"`
+	Satisfied   bool      `json:"satisfied"`
+	Since       time.Time `json:"since"`
+}
+
+func validateDependencyGroups(groups []conf.DependencyGroup, dependencies []conf.ServiceDependency) error {
+	members := make(map[string]int)
+	for _, dependency := range dependencies {
+		if dependency.Group != "" && !dependency.Skip {
+			members[dependency.Group]++
+		}
+	}
+	names := make(map[string]bool)
+	for _, group := range groups {
+		if group.Name == "" || names[group.Name] {
+			return fmt.Errorf("every dependency group needs a name of its own")
+		}
+		names[group.Name] = true
+		if members[group.Name] == 0 {
+			return fmt.Errorf("the dependency group %v has no member", group.Name)
+		}
+		if group.Require != "" && !validateValue(group.Require, validGroupRequires) {
+			return fmt.Errorf("invalid require of the group %v: %v, valid values are: %v", group.Name, group.Require, validGroupRequires)
+		}
+		if group.Quorum < 0 || group.Quorum > members[group.Name] {
+			return fmt.Errorf("invalid quorum of the group %v: %v, it has %v members", group.Name, group.Quorum, members[group.Name])
+		}
+		if !validateValue(group.UnavailablityImpact, validImpactTypes) {
+			return fmt.Errorf("invalid impact type of the group %v: %v, valid types are: %v", group.Name, group.UnavailablityImpact, validImpactTypes)
+		}
+	}
+	for _, dependency := range dependencies {
+		if dependency.Group != "" && !names[dependency.Group] {
+			return fmt.Errorf("the dependency %v belongs to the unknown group %v", dependency.ServiceName, dependency.Group)
+		}
+	}
+	return nil
+}
+
+// the number of available members a group needs
+func neededMembers(group conf.DependencyGroup, members int) int {
+	switch group.Require {
+	case requireAny:
+		return 1
+	case requireQuorum:
+		if group.Quorum > 0 {
+			return group.Quorum
+		}
+		return members/2 + 1
+	}
+	return members
+}
+
+// evaluate the groups from the availability of their members, by dependency key, and record their states
+func (a *Agent) evaluateGroups(available map[string]bool) []*groupState {
+	var states []*groupState
+	members := make(map[string]bool)
+	for _, group := range a.config.ServiceAgent.ManagedService.DependencyGroups {
+		state := &groupState{Name: group.Name, Require: group.Require, Available: []string{}, Unavailable: []string{}}
+		if state.Require == "" {
+			state.Require = requireAll
+		}
+		count := 0
+		for _, dependency := range a.config.ServiceAgent.ManagedService.ServiceDependency {
+			if dependency.Skip || dependency.Group != group.Name {
+				continue
+			}
+			count++
+			members[dependencyKey(dependency)] = available[dependencyKey(dependency)]
+			if available[dependencyKey(dependency)] {
+				state.Available = append(state.Available, dependency.ServiceName)
+			} else {
+				state.Unavailable = append(state.Unavailable, dependency.ServiceName)
+			}
+		}
+		state.Needed = neededMembers(group, count)
+		state.Satisfied = len(state.Available) >= state.Needed
+		states = append(states, state)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.memberAvailability = members
+	if a.groupStates == nil {
+		a.groupStates = make(map[string]*groupState)
+	}
+	for _, state := range states {
+		previous, ok := a.groupStates[state.Name]
+		state.Since = a.clock.Now()
+		if ok && previous.Satisfied == state.Satisfied {
+			state.Since = previous.Since
+		} else if ok || !state.Satisfied {
+			a.logger.Printf("dependency group %v is %v: %v", state.Name, state.availability(), state.summary())
+		}
+		a.groupStates[state.Name] = state
+	}
+	return states
+}
+
+func (s *groupState) availability() string {
+	if s.Satisfied {
+		return "available"
+	}
+	return "unavailable"
+}
+
+func (s *groupState) summary() string {
+	return fmt.Sprintf("%v of %v members available (%v), %v needed", len(s.Available), len(s.Available)+len(s.Unavailable), s.Available, s.Needed)
+}
+
+func (a *Agent) dependencyGroupsHandler(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	groups := []groupState{}
+	a.mu.Lock()
+	for _, group := range a.config.ServiceAgent.ManagedService.DependencyGroups {
+		if state, ok := a.groupStates[group.Name]; ok {
+			groups = append(groups, *state)
+		}
+	}
+	a.mu.Unlock()
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(groups)
+}
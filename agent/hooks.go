@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+)
+
+/********************************************************************************************
+	            lifecycle hooks of the managed service
+ *******************************************************************************************/
+
+//Hooks are commands the agent runs around the lifecycle transitions of the managed service. Pre-start hooks run
+//before every start (the first one, restarts and /service/start) and post-start hooks once the process is ready,
+//before it is running: with the abort policy a failing one fails the start. Pre-stop and post-stop hooks run
+//around stops by the agent, on-crash hooks when the process exits without being asked to or fails its liveness
+//probes. Those events can not be undone, abort only skips the remaining hooks of the event.
+
+var (
+	preStartHook  = "pre-start"
+	postStartHook = "post-start"
+	preStopHook   = "pre-stop"
+	postStopHook  = "post-stop"
+	onCrashHook   = "on-crash"
+
+	abortOnHookFailure       = "abort"
+	continueOnHookFailure    = "continue"
+	validHookFailurePolicies = []string{abortOnHookFailure, continueOnHookFailure}
+
+	defaultHookTimeout = 30 * time.Second
+	//bytes of the output of a failed hook that are logged
+	hookOutputLimit = 1024
+	//how long the output of a killed hook is waited for
+	hookWaitDelay = time.Second
+)
+
+func validateHooks(hooks *conf.Hooks) error {
+	if hooks == nil {
+		return nil
+	}
+	for _, eventHooks := range [][]conf.Hook{hooks.PreStart, hooks.PostStart, hooks.PreStop, hooks.PostStop, hooks.OnCrash} {
+		for _, hook := range eventHooks {
+			if len(hook.Command) == 0 {
+				return fmt.Errorf("hook without a command")
+			}
+			if hook.OnFailure != "" && !validateValue(hook.OnFailure, validHookFailurePolicies) {
+				return fmt.Errorf("invalid hook failure policy: %v, valid policies are: %v", hook.OnFailure, validHookFailurePolicies)
+			}
+			if _, err := parseDuration(hook.Timeout, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Agent) hooks(event string) []conf.Hook {
+	hooks := a.config.ServiceAgent.ManagedService.Hooks
+	if hooks == nil {
+		return nil
+	}
+	switch event {
+	case preStartHook:
+		return hooks.PreStart
+	case postStartHook:
+		return hooks.PostStart
+	case preStopHook:
+		return hooks.PreStop
+	case postStopHook:
+		return hooks.PostStop
+	case onCrashHook:
+		return hooks.OnCrash
+	}
+	return nil
+}
+
+// run the hooks of an event of the managed process in order. the error of a failing hook with the abort policy
+// is returned, the hooks after it are skipped
+func (r *replica) runHooks(event string, command *exec.Cmd, reason string) error {
+	hooks := r.hooks(event)
+	if len(hooks) == 0 {
+		return nil
+	}
+	env := append(os.Environ(), r.hookEnvironment(event, command, reason)...)
+	for _, hook := range hooks {
+		err := r.runHook(hook, env)
+		if err == nil {
+			continue
+		}
+		r.logger.Printf("the %v hook %v of the managed service %v failed: %v", event, hook.Command, r.managedService.Name, err)
+		if hook.OnFailure != continueOnHookFailure {
+			return fmt.Errorf("%v hook %v failed: %v", event, hook.Command, err)
+		}
+	}
+	return nil
+}
+
+func (a *Agent) runHook(hook conf.Hook, env []string) error {
+	timeout, _ := parseDuration(hook.Timeout, defaultHookTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	command.Env = env
+	//kill whatever the hook started along with it
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	command.Cancel = func() error { return syscall.Kill(-command.Process.Pid, syscall.SIGKILL) }
+	command.WaitDelay = hookWaitDelay
+
+	a.logger.Printf("running hook %v", hook.Command)
+	output, err := command.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		if len(output) > hookOutputLimit {
+			output = output[len(output)-hookOutputLimit:]
+		}
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// the environment describing the event to the hooks: TMGC_HOOK_EVENT, TMGC_EVENT_REASON, TMGC_SERVICE_NAME,
+// TMGC_SERVICE_TYPE, TMGC_SERVICE_ID, TMGC_SERVICE_STATE, TMGC_REPLICA, TMGC_PORT (when one is allocated), TMGC_PID
+// (when there is a process) and the urls of each dependency as a comma separated TMGC_DEPENDENCY_<ENDPOINT MAPPING>
+func (r *replica) hookEnvironment(event string, command *exec.Cmd, reason string) []string {
+	managedService := &r.managedService
+	env := []string{
+		"TMGC_HOOK_EVENT=" + event,
+		"TMGC_EVENT_REASON=" + reason,
+		"TMGC_SERVICE_NAME=" + managedService.Name,
+		"TMGC_SERVICE_TYPE=" + managedService.Type,
+		"TMGC_SERVICE_ID=" + r.managedServiceId(),
+		"TMGC_SERVICE_STATE=" + string(managedService.Lifecycle.State()),
+		"TMGC_REPLICA=" + strconv.Itoa(r.index),
+	}
+	if r.port != 0 {
+		env = append(env, "TMGC_PORT="+strconv.Itoa(r.port))
+	}
+	if command == nil {
+		return env
+	}
+	if command.Process != nil {
+		env = append(env, "TMGC_PID="+strconv.Itoa(command.Process.Pid))
+	}
+	for mapping, urls := range dependencyURLs(r.config.ServiceAgent.ManagedService.ServiceDependency, command.Args) {
+		env = append(env, "TMGC_DEPENDENCY_"+environmentName(mapping)+"="+strings.Join(urls, ","))
+	}
+	return env
+}
+
+// the dependency urls passed to the managed process, by endpoint mapping. see managedProcessArguments
+func dependencyURLs(dependencies []conf.ServiceDependency, args []string) map[string][]string {
+	mappings := make(map[string]bool)
+	for _, dependency := range dependencies {
+		mappings[dependency.EndpointMapping] = true
+	}
+	urls := make(map[string][]string)
+	for i := 1; i+1 < len(args); i++ {
+		if mapping := strings.TrimPrefix(args[i], "-"); mapping != args[i] && mappings[mapping] {
+			urls[mapping] = append(urls[mapping], args[i+1])
+			i++
+		}
+	}
+	return urls
+}
+
+// upper case, with anything but letters and digits replaced by _
+func environmentName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/aambhaik/tmgcagent/lifecycle"
+	"github.com/julienschmidt/httprouter"
+)
+
+/********************************************************************************************
+	            life-cycle management of the managed service
+ *******************************************************************************************/
+
+//HTTP routes exposed by the service agent
+
+// Handler returns the management API of the agent, for binaries that serve it themselves
+func (a *Agent) Handler() http.Handler {
+	router := httprouter.New()
+	router.GET("/agent/health", a.agentHealthHandler)
+	router.GET("/service/health", a.managedServiceHealthHandler)
+	router.GET("/service/events", a.managedServiceEventsHandler)
+	router.PUT("/service/start", a.managedServiceStartHandler)
+	router.PUT("/service/stop", a.managedServiceStopHandler)
+	router.PUT("/service/scale", a.managedServiceScaleHandler)
+	router.GET("/service/scaling", a.scalingHandler)
+	router.PUT("/agent/upgrade", a.agentUpgradeHandler)
+	router.GET("/service/runs", a.jobRunsHandler)
+	router.GET("/service/proxies", a.proxiesHandler)
+	router.GET("/service/dependencies", a.dependencyEndpointsHandler)
+	router.GET("/service/fallbacks", a.fallbacksHandler)
+	router.GET("/service/datacenters", a.datacentersHandler)
+	router.GET("/service/dependency-groups", a.dependencyGroupsHandler)
+	router.GET("/metrics", a.metricsHandler)
+	return router
+}
+
+// listen on the management port (unless a listener was given) and create the management server
+func (a *Agent) listen() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.listener == nil {
+		if os.Getenv(listenFdEnv) != "" {
+			a.logger.Printf("taking over the management socket from the previous agent")
+		}
+		port := a.config.ServiceAgent.ManagementPort
+		listener, err := managementListen(port)
+		if err != nil {
+			return fmt.Errorf("unable to listen on the management port %v: %v", port, err)
+		}
+		a.listener = listener
+	}
+	a.accepting = newHandoffListener(a.listener)
+	a.server = &http.Server{Handler: a.Handler(), ConnState: a.trackConnState}
+	a.logger.Printf("Starting Service Agent service on %v", a.listener.Addr())
+	return nil
+}
+
+func (a *Agent) agentHealthHandler(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	writer.WriteHeader(200)
+	writer.Write([]byte(fmt.Sprintf("Service Agent for managed service [%v] running successfully", a.config.ServiceAgent.ManagedService.Name)))
+}
+
+// the managed service is healthy when all of its replicas are running and live
+func (a *Agent) managedServiceHealthHandler(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	if a.isJob() {
+		a.jobHealthHandler(writer, request)
+		return
+	}
+	managedServiceConf := a.config.ServiceAgent.ManagedService
+	replicas := a.replicaList()
+	healthy := 0
+	for _, r := range replicas {
+		if r.healthy() {
+			healthy++
+		}
+	}
+
+	status := 503
+	if healthy == len(replicas) {
+		status = 200
+	}
+	if wantsJSON(request) {
+		a.writeHealthJSON(writer, status, replicas)
+		return
+	}
+
+	writer.WriteHeader(status)
+	if len(replicas) > 1 {
+		writer.Write([]byte(fmt.Sprintf("Managed Service [%v] of type [%v] has %v of %v replicas running successfully", managedServiceConf.Name, managedServiceConf.Type, healthy, len(replicas))))
+		return
+	}
+	currentState, livenessErr := replicas[0].managedService.Lifecycle.State(), replicas[0].liveness()
+	if currentState == lifecycle.Running && livenessErr != nil {
+		writer.Write([]byte(fmt.Sprintf("Managed Service [%v] of type [%v] is running but failing its liveness probes: %v", managedServiceConf.Name, managedServiceConf.Type, livenessErr)))
+	} else if currentState == lifecycle.Running {
+		writer.Write([]byte(fmt.Sprintf("Managed Service [%v] of type [%v] running successfully", managedServiceConf.Name, managedServiceConf.Type)))
+	} else {
+		writer.Write([]byte(fmt.Sprintf("Managed Service [%v] of type [%v] is not running, it is %v", managedServiceConf.Name, managedServiceConf.Type, currentState)))
+	}
+}
+
+// the lifecycle events of a replica, the first one unless ?replica= selects another
+func (a *Agent) managedServiceEventsHandler(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	index := 0
+	if value := request.URL.Query().Get("replica"); value != "" {
+		var err error
+		if index, err = strconv.Atoi(value); err != nil {
+			index = -1
+		}
+	}
+	r := a.replica(index)
+	if r == nil {
+		writer.WriteHeader(404)
+		writer.Write([]byte(fmt.Sprintf("Managed service [%v] has no replica %v", a.config.ServiceAgent.ManagedService.Name, request.URL.Query().Get("replica"))))
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(r.managedService.Lifecycle.History())
+}
+
+func (a *Agent) managedServiceStartHandler(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	managedServiceConf := a.config.ServiceAgent.ManagedService
+	if err := a.start("start requested"); err != nil {
+		a.logger.Printf("Unable to start the service %v: %v", managedServiceConf.Name, err)
+		writer.WriteHeader(500)
+		writer.Write([]byte(fmt.Sprintf("Error starting the managed service [%v] of type [%v] : [%v]", managedServiceConf.Name, managedServiceConf.Type, err)))
+		return
+	}
+	writer.WriteHeader(200)
+	writer.Write([]byte(fmt.Sprintf("Managed service [%v] of type [%v] started successfully", managedServiceConf.Name, managedServiceConf.Type)))
+}
+
+func (a *Agent) managedServiceStopHandler(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	managedServiceConf := a.config.ServiceAgent.ManagedService
+	if err := a.Stop("stop requested"); err != nil {
+		writer.WriteHeader(500)
+		writer.Write([]byte(fmt.Sprintf("Error stopping the managed service [%v] of type [%v] : [%v]", managedServiceConf.Name, managedServiceConf.Type, err)))
+		return
+	}
+	writer.WriteHeader(200)
+	writer.Write([]byte(fmt.Sprintf("Managed service [%v] of type [%v] stopped successfully", managedServiceConf.Name, managedServiceConf.Type)))
+}
+
+func (a *Agent) managedServiceScaleHandler(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	managedServiceConf := a.config.ServiceAgent.ManagedService
+	replicas, err := strconv.Atoi(request.URL.Query().Get("replicas"))
+	if err != nil || replicas < 1 {
+		writer.WriteHeader(400)
+		writer.Write([]byte(fmt.Sprintf("Invalid number of replicas [%v], expected a positive number", request.URL.Query().Get("replicas"))))
+		return
+	}
+	//the autoscaler would revert the scaling at its next evaluation
+	if autoscale := managedServiceConf.Autoscale; autoscale != nil {
+		writer.WriteHeader(409)
+		writer.Write([]byte(fmt.Sprintf("Managed service [%v] of type [%v] is autoscaled between %v and %v replicas, change the bounds in the configuration instead",
+			managedServiceConf.Name, managedServiceConf.Type, autoscale.Min, autoscale.Max)))
+		return
+	}
+	decision := scalingDecision{Time: a.clock.Now(), Trigger: scaleRequestTrigger, From: len(a.replicaList()), To: replicas, Outcome: scaledOutcome}
+	err = a.Scale(replicas)
+	if err != nil {
+		decision.Outcome, decision.Reason = failedOutcome, err.Error()
+	}
+	if decision.From != decision.To {
+		a.recordScaling(decision)
+	}
+	if err != nil {
+		a.logger.Printf("Unable to scale the service %v: %v", managedServiceConf.Name, err)
+		writer.WriteHeader(500)
+		writer.Write([]byte(fmt.Sprintf("Error scaling the managed service [%v] of type [%v] : [%v]", managedServiceConf.Name, managedServiceConf.Type, err)))
+		return
+	}
+	writer.WriteHeader(200)
+	writer.Write([]byte(fmt.Sprintf("Managed service [%v] of type [%v] scaled to %v replicas", managedServiceConf.Name, managedServiceConf.Type, replicas)))
+}
@@ -0,0 +1,335 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/discovery"
+	"github.com/julienschmidt/httprouter"
+	"github.com/robfig/cron"
+)
+
+/********************************************************************************************
+	            managed service run as a scheduled job
+ *******************************************************************************************/
+
+//A job is registered like a service, but the agent only runs its process on the schedule, to completion. Each run
+//first looks up the dependencies: a run with an unavailable dependency is skipped, the others get the dependency
+//urls as arguments like a service. The result of the last run is reported through the TTL check of the
+//registration, which the agent keeps refreshing between runs. Jobs don't go through the lifecycle state machine,
+//readiness, liveness, restart policies and hooks don't apply to them.
+
+var (
+	forbidConcurrentRuns       = "forbid"
+	allowConcurrentRuns        = "allow"
+	replaceConcurrentRuns      = "replace"
+	validJobConcurrencyPolices = []string{forbidConcurrentRuns, allowConcurrentRuns, replaceConcurrentRuns}
+
+	defaultJobHistory = 20
+	//interval at which the result of the last run is reported again, keeping the TTL check from expiring
+	jobHealthInterval = 10 * time.Second
+)
+
+// the status of a job run
+var (
+	runRunning   = "running"
+	runSucceeded = "succeeded"
+	runFailed    = "failed"
+	runTimedOut  = "timed-out"
+	runKilled    = "killed"
+	runSkipped   = "skipped"
+)
+
+// jobRun records a run of the job
+type jobRun struct {
+	ID       int       `json:"id"`
+	Trigger  string    `json:"trigger"`
+	Start    time.Time `json:"start"`
+	Duration string    `json:"duration,omitempty"`
+	Status   string    `json:"status"`
+	PID      int       `json:"pid,omitempty"`
+	ExitCode *int      `json:"exit-code,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+
+	command *exec.Cmd
+	//why the agent killed the run, if it did
+	killed   string
+	timedOut bool
+}
+
+func validateJob(job *conf.Job) error {
+	if job == nil {
+		return nil
+	}
+	if _, err := cron.Parse(job.Schedule); err != nil {
+		return fmt.Errorf("invalid schedule %v: %v", job.Schedule, err)
+	}
+	if _, err := parseDuration(job.Timeout, 0); err != nil {
+		return err
+	}
+	if job.Concurrency != "" && !validateValue(job.Concurrency, validJobConcurrencyPolices) {
+		return fmt.Errorf("invalid concurrency policy: %v, valid policies are: %v", job.Concurrency, validJobConcurrencyPolices)
+	}
+	if job.History < 0 {
+		return fmt.Errorf("invalid history: %v", job.History)
+	}
+	return nil
+}
+
+func (a *Agent) isJob() bool {
+	return a.config.ServiceAgent.ManagedService.Job != nil
+}
+
+// register the job and schedule its runs until the agent shuts down
+func (a *Agent) scheduleJob() error {
+	managedServiceConf := a.config.ServiceAgent.ManagedService
+	r := a.first()
+	a.cleanupStaleRegistrations()
+	serviceId, err := r.registerManagedService()
+	if err != nil {
+		return fmt.Errorf("unable to register the job %v: %v", managedServiceConf.Name, err)
+	}
+	a.logger.Printf("job %v registered successfully", managedServiceConf.Name)
+	r.setManagedServiceId(serviceId)
+	r.reportHealth(discovery.HealthPassing, "no run yet")
+
+	c := cron.New()
+	if err := c.AddFunc(managedServiceConf.Job.Schedule, func() {
+		//the upgraded agent runs the job from now on
+		if !a.quiesced() {
+			a.runJob("schedule")
+		}
+	}); err != nil {
+		return err
+	}
+	c.Start()
+	a.mu.Lock()
+	a.cron = c
+	a.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(jobHealthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-ticker.C:
+			}
+			r.mu.Lock()
+			status, output := r.healthStatus, r.healthOutput
+			r.mu.Unlock()
+			r.reportHealth(status, output)
+		}
+	}()
+	return nil
+}
+
+// start a run of the job in the background
+func (a *Agent) triggerJob(reason string) error {
+	go a.runJob(reason)
+	return nil
+}
+
+// run the job to completion, unless the concurrency policy or an unavailable dependency skips the run
+func (a *Agent) runJob(trigger string) {
+	job := a.config.ServiceAgent.ManagedService.Job
+	//a job runs as the first and only replica
+	r := a.first()
+	run := &jobRun{Trigger: trigger, Start: a.clock.Now(), Status: runRunning}
+
+	a.mu.Lock()
+	a.nextRunId++
+	run.ID = a.nextRunId
+	var active []*jobRun
+	for _, previous := range a.jobRuns {
+		if previous.Status == runRunning {
+			active = append(active, previous)
+		}
+	}
+	a.jobRuns = append(a.jobRuns, run)
+	if len(active) > 0 && (job.Concurrency == "" || job.Concurrency == forbidConcurrentRuns) {
+		a.mu.Unlock()
+		a.finishRun(run, runSkipped, nil, fmt.Sprintf("run %v is still active", active[0].ID))
+		return
+	}
+	if job.Concurrency == replaceConcurrentRuns {
+		for _, previous := range active {
+			previous.killed = fmt.Sprintf("replaced by run %v", run.ID)
+			signalProcessGroup(previous.command, syscall.SIGKILL)
+		}
+	}
+	a.mu.Unlock()
+
+	//the dependencies are looked up for every run, a run without them is pointless
+	endpoints, err := a.discoverManagedServiceDependencies()
+	if err != nil {
+		err = fmt.Errorf("unable to resolve the dependencies: %v", err)
+	} else {
+		err = missingDependency(a.config.ServiceAgent.ManagedService.ServiceDependency, endpoints)
+	}
+	if err != nil {
+		a.finishRun(run, runSkipped, nil, err.Error())
+		r.reportHealth(discovery.HealthWarning, fmt.Sprintf("run %v skipped: %v", run.ID, err))
+		return
+	}
+
+	//a run replaced or stopped while it looked up the dependencies has no process to kill, it must not start one
+	a.mu.Lock()
+	killed := run.killed
+	a.mu.Unlock()
+	if killed != "" {
+		a.finishRun(run, runKilled, nil, killed)
+		return
+	}
+
+	args := managedProcessArguments(a.config.ServiceAgent.ManagedService.Process.Args, a.proxiedEndpoints(endpoints))
+	command, err := r.startManagedProcess(exec.Command(a.config.ServiceAgent.ManagedService.Process.Exec, args...))
+	if err != nil {
+		a.finishRun(run, runFailed, nil, fmt.Sprintf("failed to start: %v", err))
+		r.reportHealth(discovery.HealthCritical, fmt.Sprintf("run %v failed to start: %v", run.ID, err))
+		return
+	}
+	a.mu.Lock()
+	run.command, run.PID = command, command.Process.Pid
+	killed = run.killed
+	a.mu.Unlock()
+	if killed != "" {
+		//replaced or stopped while starting
+		signalProcessGroup(command, syscall.SIGKILL)
+	}
+	//the usage reports cover the latest run
+	r.setManagedCommand(command)
+	a.logger.Printf("job %v run %v started (%v)", a.config.ServiceAgent.ManagedService.Name, run.ID, trigger)
+
+	if timeout, _ := parseDuration(job.Timeout, 0); timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			a.mu.Lock()
+			run.killed, run.timedOut = fmt.Sprintf("timed out after %v", timeout), true
+			a.mu.Unlock()
+			signalProcessGroup(command, syscall.SIGKILL)
+		})
+		defer timer.Stop()
+	}
+
+	err = command.Wait()
+	exitCode := -1
+	if command.ProcessState != nil {
+		exitCode = command.ProcessState.ExitCode()
+	}
+	a.mu.Lock()
+	killed, timedOut := run.killed, run.timedOut
+	a.mu.Unlock()
+	switch {
+	case err == nil:
+		a.finishRun(run, runSucceeded, &exitCode, "")
+		r.reportHealth(discovery.HealthPassing, fmt.Sprintf("run %v succeeded in %v", run.ID, run.Duration))
+	case timedOut:
+		a.finishRun(run, runTimedOut, &exitCode, killed)
+		r.reportHealth(discovery.HealthCritical, fmt.Sprintf("run %v %v", run.ID, killed))
+	case killed != "":
+		//the run that replaced it or the stop decide the health
+		a.finishRun(run, runKilled, &exitCode, killed)
+	default:
+		a.finishRun(run, runFailed, &exitCode, exitReason(err))
+		r.reportHealth(discovery.HealthCritical, fmt.Sprintf("run %v failed: %v", run.ID, exitReason(err)))
+	}
+}
+
+// the error naming the first dependency without any endpoint
+func missingDependency(dependencies []conf.ServiceDependency, endpoints map[string][]discovery.Endpoint) error {
+	for _, dependency := range dependencies {
+		if !dependency.Skip && len(endpoints[dependency.EndpointMapping]) == 0 {
+			return fmt.Errorf("dependency %v of type %v is unavailable", dependency.ServiceName, dependency.ServiceType)
+		}
+	}
+	return nil
+}
+
+// record the end of a run and trim the history
+func (a *Agent) finishRun(run *jobRun, status string, exitCode *int, reason string) {
+	history := a.config.ServiceAgent.ManagedService.Job.History
+	if history == 0 {
+		history = defaultJobHistory
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	run.Status, run.ExitCode, run.Reason = status, exitCode, reason
+	run.Duration = a.clock.Now().Sub(run.Start).String()
+	//active runs are never trimmed
+	for len(a.jobRuns) > history && a.jobRuns[0].Status != runRunning {
+		a.jobRuns = a.jobRuns[1:]
+	}
+	if reason != "" {
+		status += ": " + reason
+	}
+	a.logger.Printf("job %v run %v %v", a.config.ServiceAgent.ManagedService.Name, run.ID, status)
+}
+
+// kill the active runs of the job
+func (a *Agent) stopJobRuns(reason string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, run := range a.jobRuns {
+		if run.Status == runRunning {
+			//a run without a process yet doesn't start one
+			run.killed = reason
+			signalProcessGroup(run.command, syscall.SIGKILL)
+		}
+	}
+	return nil
+}
+
+// copies of the recorded runs, the oldest first
+func (a *Agent) runs() []jobRun {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	runs := make([]jobRun, len(a.jobRuns))
+	for i, run := range a.jobRuns {
+		runs[i] = *run
+	}
+	return runs
+}
+
+func (a *Agent) jobRunsHandler(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(a.runs())
+}
+
+// the health of a job is the result of its last run
+func (a *Agent) jobHealthHandler(writer http.ResponseWriter, request *http.Request) {
+	managedServiceConf := a.config.ServiceAgent.ManagedService
+	r := a.first()
+	r.mu.Lock()
+	status, output := r.healthStatus, r.healthOutput
+	r.mu.Unlock()
+
+	code := 200
+	if status != discovery.HealthPassing {
+		code = 503
+	}
+	if !wantsJSON(request) {
+		writer.WriteHeader(code)
+		writer.Write([]byte(fmt.Sprintf("Job [%v] of type [%v]: %v", managedServiceConf.Name, managedServiceConf.Type, output)))
+		return
+	}
+
+	//the state of a job is the one of its latest run
+	health := managedServiceHealth{Name: managedServiceConf.Name, Type: managedServiceConf.Type, State: "idle", Healthy: code == 200, Output: output}
+	if runs := a.runs(); len(runs) > 0 {
+		health.LastRun = &runs[len(runs)-1]
+		health.State = health.LastRun.Status
+	}
+	if health.State == runRunning {
+		health.Usage, _ = r.usage()
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	json.NewEncoder(writer).Encode(health)
+}
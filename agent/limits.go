@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/aambhaik/tmgcagent/cgroup"
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/sandbox"
+	"golang.org/x/sys/unix"
+)
+
+/********************************************************************************************
+	            resource limits of the managed process
+ *******************************************************************************************/
+
+//The rlimits of the managed process are set by the sandbox shim before it execs the managed binary, see package
+//sandbox. Where cgroup v2 is available, the process is started directly in a cgroup of its own (<cgroup-parent>/
+//<service name>, suffixed with the index for replicas after the first) carrying the memory, CPU and pids limits,
+//so that the OOM kills in it can be told apart from other SIGKILLs.
+
+const defaultCgroupParent = "tmgc"
+
+func validateLimits(limits *conf.Limits) error {
+	if limits == nil {
+		return nil
+	}
+	if _, err := parseSize(limits.MemoryMax); err != nil {
+		return err
+	}
+	if _, err := parsePercent(limits.CPUQuota); err != nil {
+		return err
+	}
+	if limits.CPUWeight < 0 || limits.CPUWeight > 10000 {
+		return fmt.Errorf("invalid cpu-weight %v, valid weights are 1 to 10000", limits.CPUWeight)
+	}
+	return nil
+}
+
+// parse a size in bytes, with an optional K, M, G or T (binary) suffix
+func parseSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	if i := strings.IndexAny(strings.ToUpper(value), "KMGT"); i > 0 && i == len(value)-1 {
+		multiplier = 1 << (10 * (strings.Index("KMGT", strings.ToUpper(value[i:])) + 1))
+		value = value[:i]
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size %v", value)
+	}
+	return size * multiplier, nil
+}
+
+// parse a percentage like 150%
+func parsePercent(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil || percent <= 0 || !strings.HasSuffix(value, "%") {
+		return 0, fmt.Errorf("invalid percentage %v", value)
+	}
+	return percent, nil
+}
+
+// create (or reuse) the cgroup of the replica with the configured limits. nil if no cgroup limit is
+// configured, or cgroups are not usable here
+func (r *replica) managedCgroup() *cgroup.Group {
+	limits := r.config.ServiceAgent.ManagedService.Process.Limits
+	if limits == nil {
+		return nil
+	}
+	memoryMax, _ := parseSize(limits.MemoryMax)
+	cpuQuota, _ := parsePercent(limits.CPUQuota)
+	cgroupLimits := cgroup.Limits{MemoryMax: memoryMax, CPUWeight: limits.CPUWeight, CPUQuota: cpuQuota, PidsMax: limits.PidsMax}
+	if cgroupLimits == (cgroup.Limits{}) {
+		return nil
+	}
+	if !cgroup.Available() {
+		r.logger.Printf("cgroup v2 is not available, the memory, cpu and pids limits of %v are not applied", r.managedService.Name)
+		return nil
+	}
+
+	parent := limits.CgroupParent
+	if parent == "" {
+		parent = defaultCgroupParent
+	}
+	group, err := cgroup.Create(parent, r.name(), cgroupLimits)
+	if err != nil {
+		r.logger.Printf("unable to create the cgroup of %v, its memory, cpu and pids limits are not applied: %v", r.managedService.Name, err)
+		return nil
+	}
+	return group
+}
+
+// start the managed process within its resource limits
+func (r *replica) startLimited(command *exec.Cmd) (*exec.Cmd, error) {
+	group := r.managedCgroup()
+	if group == nil {
+		if _, err := startProcess(command); err != nil {
+			return nil, err
+		}
+		r.setCgroup(nil, 0)
+		return command, nil
+	}
+
+	oomKills, _ := group.OOMKills()
+	r.setCgroup(group, oomKills)
+	if group.Cloneable() {
+		dir, err := group.Open()
+		if err != nil {
+			return nil, err
+		}
+		if command.SysProcAttr == nil {
+			command.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		command.SysProcAttr.UseCgroupFD, command.SysProcAttr.CgroupFD = true, int(dir.Fd())
+		_, err = startProcess(command)
+		dir.Close()
+		if err == nil {
+			return command, nil
+		}
+		if !errors.Is(err, syscall.ENOSYS) && !errors.Is(err, syscall.EINVAL) {
+			return nil, err
+		}
+		//starting in a cgroup needs clone3 with CLONE_INTO_CGROUP (linux 5.7), move the process in right after it
+		//started instead
+		r.logger.Printf("unable to start %v in its cgroup, moving it there after the start: %v", command.Path, err)
+		retry := exec.Command(command.Path)
+		retry.Args, retry.Env, retry.Dir = command.Args, command.Env, command.Dir
+		retry.Stdout, retry.Stderr = command.Stdout, command.Stderr
+		attr := *command.SysProcAttr
+		attr.UseCgroupFD = false
+		retry.SysProcAttr = &attr
+		command = retry
+	}
+	if _, err := startProcess(command); err != nil {
+		return nil, err
+	}
+	if err := group.AddProcess(command.Process.Pid); err != nil {
+		r.logger.Printf("unable to move %v into its cgroup, its memory, cpu and pids limits are not applied: %v", command.Process.Pid, err)
+	}
+	return command, nil
+}
+
+// the configured rlimits of the managed process
+func (a *Agent) rlimits() []sandbox.Rlimit {
+	limits := a.config.ServiceAgent.ManagedService.Process.Limits
+	if limits == nil {
+		return nil
+	}
+	var rlimits []sandbox.Rlimit
+	if limits.OpenFiles > 0 {
+		rlimits = append(rlimits, sandbox.Rlimit{Resource: unix.RLIMIT_NOFILE, Value: limits.OpenFiles})
+	}
+	if limits.Processes > 0 {
+		rlimits = append(rlimits, sandbox.Rlimit{Resource: unix.RLIMIT_NPROC, Value: limits.Processes})
+	}
+	if limits.CoreSize != nil {
+		rlimits = append(rlimits, sandbox.Rlimit{Resource: unix.RLIMIT_CORE, Value: *limits.CoreSize})
+	}
+	return rlimits
+}
+
+func (r *replica) setCgroup(group *cgroup.Group, oomKills uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cgroup = group
+	r.oomKills = oomKills
+}
+
+// whether the OOM killer killed a process of the cgroup of the managed service since it started
+func (r *replica) oomKilled() bool {
+	r.mu.Lock()
+	group, oomKills := r.cgroup, r.oomKills
+	r.mu.Unlock()
+	if group == nil {
+		return false
+	}
+	kills, err := group.OOMKills()
+	return err == nil && kills > oomKills
+}
@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/discovery"
+	"github.com/aambhaik/tmgcagent/lifecycle"
+)
+
+/********************************************************************************************
+	            liveness of the managed service
+ *******************************************************************************************/
+
+//While the managed service is running the agent probes it periodically. Once a probe failed failure-threshold
+//times in a row the service is unhealthy: /service/health reports it, its TTL check in the registry turns critical
+//and, if the restart policy says so, the process group is killed and restarted. The TTL check also turns critical
+//when the service is not running, or when the agent stops updating it.
+
+var (
+	validLivenessProbeTypes = []string{httpProbe, tcpProbe, execProbe, grpcProbe}
+
+	defaultLivenessInterval = 10 * time.Second
+	defaultFailureThreshold = 3
+)
+
+func validateLiveness(liveness *conf.Liveness) error {
+	if liveness == nil {
+		return nil
+	}
+	if _, err := parseDuration(liveness.Interval, 0); err != nil {
+		return err
+	}
+	if liveness.FailureThreshold < 0 {
+		return fmt.Errorf("invalid failure-threshold: %v", liveness.FailureThreshold)
+	}
+	return validateProbes(liveness.Probes, validLivenessProbeTypes)
+}
+
+func livenessSettings(liveness *conf.Liveness) (time.Duration, int) {
+	interval, _ := parseDuration(liveness.Interval, defaultLivenessInterval)
+	threshold := liveness.FailureThreshold
+	if threshold == 0 {
+		threshold = defaultFailureThreshold
+	}
+	return interval, threshold
+}
+
+// the TTL of the registry check of the managed service, zero (the registry probes the service) without liveness
+// probes. the check of a job reports its last run
+func (a *Agent) checkTTL() time.Duration {
+	if a.isJob() {
+		return 3 * jobHealthInterval
+	}
+	liveness := a.config.ServiceAgent.ManagedService.Liveness
+	if liveness == nil || len(liveness.Probes) == 0 {
+		return 0
+	}
+	//a few missed updates turn the check critical, e.g. when the agent is gone
+	interval, _ := livenessSettings(liveness)
+	return 3 * interval
+}
+
+// start probing the liveness of the replicas of the managed service until the agent shuts down
+func (a *Agent) checkLivenessJob() {
+	liveness := a.config.ServiceAgent.ManagedService.Liveness
+	if liveness == nil || len(liveness.Probes) == 0 {
+		return
+	}
+	interval, threshold := livenessSettings(liveness)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-ticker.C:
+			}
+			if a.quiesced() {
+				continue
+			}
+			for _, r := range a.replicaList() {
+				r.livenessFailures = r.checkLiveness(r.livenessProbes(), r.livenessFailures, threshold)
+			}
+		}
+	}()
+}
+
+// the liveness probes of the replica, with its port
+func (r *replica) livenessProbes() []timedProbe {
+	var probes []timedProbe
+	for _, config := range r.config.ServiceAgent.ManagedService.Liveness.Probes {
+		p, _ := newProbe(r.expandProbe(config), "")
+		probes = append(probes, newTimedProbe(p, config))
+	}
+	return probes
+}
+
+// run one round of liveness probes, returning the number of consecutive failures
+func (r *replica) checkLiveness(probes []timedProbe, failures, threshold int) int {
+	managedService := &r.managedService
+	if state := managedService.Lifecycle.State(); state != lifecycle.Running {
+		r.reportHealth(discovery.HealthCritical, fmt.Sprintf("managed service is %v", state))
+		return 0
+	}
+
+	err := checkAll(probes)
+	if err == nil {
+		r.setLiveness(nil)
+		r.reportHealth(discovery.HealthPassing, "liveness probes passing")
+		return 0
+	}
+	failures++
+	r.logger.Printf("Managed service [%v] of type [%v] failed its liveness probes (%v of %v): %v", managedService.Name, managedService.Type, failures, threshold, err)
+	if failures < threshold {
+		r.reportHealth(discovery.HealthPassing, fmt.Sprintf("liveness probes failed %v of %v times: %v", failures, threshold, err))
+		return failures
+	}
+
+	r.setLiveness(err)
+	r.reportHealth(discovery.HealthCritical, fmt.Sprintf("liveness probes failed %v times: %v", failures, err))
+	if !r.restarts(true) {
+		return failures
+	}
+	reason := fmt.Sprintf("liveness probe failed: %v", err)
+	if managedService.Lifecycle.TransitionFrom([]lifecycle.State{lifecycle.Running}, lifecycle.Crashed, reason) == nil {
+		command := r.managedCommand()
+		signalProcessGroup(command, syscall.SIGKILL)
+		r.runHooks(onCrashHook, command, reason)
+		r.restartAfterCrash(true)
+	}
+	return 0
+}
+
+func (r *replica) setLiveness(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.livenessErr = err
+}
+
+// the error of the failing liveness probes, nil if the managed service is live
+func (r *replica) liveness() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.livenessErr
+}
+
+// set the status of the registry check of the replica
+func (r *replica) reportHealth(status, output string) {
+	r.mu.Lock()
+	r.healthStatus, r.healthOutput = status, output
+	r.mu.Unlock()
+
+	serviceId := r.managedServiceId()
+	if serviceId == "" {
+		return
+	}
+	if summary := r.usageSummary(); summary != "" {
+		output += "\n" + summary
+	}
+	if err := r.registry.UpdateHealth(serviceId, status, output); err != nil {
+		r.logger.Printf("unable to update the health of the service %v: %v", serviceId, err)
+	}
+}
@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/discovery"
+)
+
+/********************************************************************************************
+	            selection of the instances of the dependencies
+ *******************************************************************************************/
+
+//The passing instances of a dependency with a selector are ordered before they become the endpoints of the managed
+//service: by the first locality preference they match, then within a locality by weight or in a shuffle weighted by
+//the weights. The shuffle derives the key of every instance from the seed and its endpoint, so the order only
+//changes when the instances do, while agents with different seeds spread over them. The limit keeps the first
+//endpoints that were not ejected as outliers.
+
+var (
+	sameNodePreference       = "same-node"
+	sameDatacenterPreference = "same-datacenter"
+	zonePreferencePrefix     = "zone:"
+	tagPreferencePrefix      = "tag:"
+
+	registryOrder       = "registry"
+	weightOrder         = "weight"
+	shuffleOrder        = "shuffle"
+	validInstanceOrders = []string{registryOrder, weightOrder, shuffleOrder}
+)
+
+func validateSelectors(dependencies []conf.ServiceDependency) error {
+	for _, dependency := range dependencies {
+		selector := dependency.Select
+		if selector == nil {
+			continue
+		}
+		for _, preference := range selector.Prefer {
+			if !validPreference(preference) {
+				return fmt.Errorf("invalid preference of %v: %v, valid preferences are: %v, %v, %v<zone> and %v<tag>", dependency.ServiceName,
+					preference, sameNodePreference, sameDatacenterPreference, zonePreferencePrefix, tagPreferencePrefix)
+			}
+		}
+		if selector.Order != "" && !validateValue(selector.Order, validInstanceOrders) {
+			return fmt.Errorf("invalid order of %v: %v, valid orders are: %v", dependency.ServiceName, selector.Order, validInstanceOrders)
+		}
+		if selector.Limit < 0 {
+			return fmt.Errorf("invalid limit of %v: %v", dependency.ServiceName, selector.Limit)
+		}
+	}
+	return nil
+}
+
+func validPreference(preference string) bool {
+	if preference == sameNodePreference || preference == sameDatacenterPreference {
+		return true
+	}
+	for _, prefix := range []string{zonePreferencePrefix, tagPreferencePrefix} {
+		if strings.HasPrefix(preference, prefix) && len(preference) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// look up the passing instances of the active tier of a dependency, ordered as its selector says
+func (a *Agent) resolveDependency(dependency conf.ServiceDependency) ([]discovery.Endpoint, error) {
+	instances, err := a.lookupTiers(dependency)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []discovery.Endpoint
+	for _, instance := range instances {
+		endpoints = append(endpoints, instance.Endpoint(dependency.TaggedAddress))
+	}
+	return a.orderEndpoints(dependency.Select, endpoints), nil
+}
+
+// order the endpoints by locality, then by weight or in a weighted shuffle. with a strict selector the endpoints
+// matching no preference are left out, unless none matches any
+func (a *Agent) orderEndpoints(selector *conf.DependencySelector, endpoints []discovery.Endpoint) []discovery.Endpoint {
+	if selector == nil || len(endpoints) == 0 {
+		return endpoints
+	}
+	var locality discovery.Locality
+	for _, preference := range selector.Prefer {
+		if preference == sameNodePreference || preference == sameDatacenterPreference {
+			locality = a.registryLocality()
+			break
+		}
+	}
+	seed := selector.Seed
+	if seed == "" {
+		host, _ := os.Hostname()
+		seed = host + "/" + a.config.ServiceAgent.ManagedService.Name
+	}
+
+	type ranked struct {
+		endpoint discovery.Endpoint
+		tier     int
+		key      float64
+	}
+	var ranks []ranked
+	preferred := false
+	for _, endpoint := range endpoints {
+		rank := ranked{endpoint: endpoint, tier: len(selector.Prefer)}
+		for tier, preference := range selector.Prefer {
+			if matchesPreference(preference, endpoint.Instance, locality) {
+				rank.tier, preferred = tier, true
+				break
+			}
+		}
+		switch selector.Order {
+		case weightOrder:
+			rank.key = float64(endpoint.Weight)
+		case shuffleOrder:
+			rank.key = shuffleKey(seed, endpoint)
+		}
+		ranks = append(ranks, rank)
+	}
+	sort.SliceStable(ranks, func(i, j int) bool {
+		if ranks[i].tier != ranks[j].tier {
+			return ranks[i].tier < ranks[j].tier
+		}
+		return ranks[i].key > ranks[j].key
+	})
+
+	var ordered []discovery.Endpoint
+	for _, rank := range ranks {
+		if selector.Strict && preferred && rank.tier == len(selector.Prefer) {
+			continue
+		}
+		ordered = append(ordered, rank.endpoint)
+	}
+	return ordered
+}
+
+func matchesPreference(preference string, instance *discovery.Instance, locality discovery.Locality) bool {
+	if instance == nil {
+		return false
+	}
+	switch {
+	case preference == sameNodePreference:
+		return locality.Node != "" && instance.Node == locality.Node
+	case preference == sameDatacenterPreference:
+		return locality.Datacenter != "" && instance.Datacenter == locality.Datacenter
+	case strings.HasPrefix(preference, zonePreferencePrefix):
+		return instance.Zone() == strings.TrimPrefix(preference, zonePreferencePrefix)
+	case strings.HasPrefix(preference, tagPreferencePrefix):
+		return validateValue(strings.TrimPrefix(preference, tagPreferencePrefix), instance.Tags)
+	}
+	return false
+}
+
+// the key of an endpoint in a weighted shuffle: u^(1/weight), u being uniform in (0, 1) and derived from the seed and
+// the endpoint, so that sorting by the keys draws the endpoints with a probability proportional to their weight
+func shuffleKey(seed string, endpoint discovery.Endpoint) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(seed + "/" + endpoint.URL))
+	u := (float64(hash.Sum64()>>11) + 0.5) / (1 << 53)
+	return math.Pow(u, 1/float64(endpoint.Weight))
+}
+
+// the node and the datacenter of the local agent of the registry, empty if the registry does not know them. a
+// failed query is tried again on the next lookup
+func (a *Agent) registryLocality() discovery.Locality {
+	a.mu.Lock()
+	cached := a.locality
+	a.mu.Unlock()
+	if cached != nil {
+		return *cached
+	}
+	locator, ok := a.registry.(discovery.Locator)
+	if !ok {
+		return discovery.Locality{}
+	}
+	locality, err := locator.Locality()
+	if err != nil {
+		a.logger.Printf("unable to find the locality of the agent, the same-node and same-datacenter preferences match nothing: %v", err)
+		return discovery.Locality{}
+	}
+	a.mu.Lock()
+	a.locality = &locality
+	a.mu.Unlock()
+	return locality
+}
+
+// the endpoints of a dependency given to the managed service: those not ejected as outliers, up to the limit of the
+// selector
+func (a *Agent) usableEndpoints(dependency conf.ServiceDependency, endpoints []discovery.Endpoint) []discovery.Endpoint {
+	endpoints = a.withoutOutliers(dependency, endpoints)
+	if dependency.Select != nil && dependency.Select.Limit > 0 && len(endpoints) > dependency.Select.Limit {
+		endpoints = endpoints[:dependency.Select.Limit]
+	}
+	return endpoints
+}
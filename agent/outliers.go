@@ -0,0 +1,347 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/discovery"
+	"github.com/aambhaik/tmgcagent/probe"
+	"github.com/julienschmidt/httprouter"
+)
+
+/********************************************************************************************
+	            outlier detection of the endpoints of the dependencies
+ *******************************************************************************************/
+
+//The endpoints of a dependency with a probe are probed by the agent every interval, on top of the health checks of
+//the registry. An endpoint is ejected after consecutive failed probes, or when its average latency over its recent
+//probes is above max-latency or too far above the median of the endpoints, and readmitted after consecutive passed
+//probes. Ejected endpoints are left out of the endpoints given to the managed process when it starts and of the
+//instances its proxy forwards to. Without a proxy to follow them, an ejection or readmission starts the running
+//replicas again with the current endpoints. No more than max-ejected-percent of the endpoints, and never all, are
+//ejected.
+
+var (
+	validEndpointProbeTypes = []string{httpProbe, tcpProbe}
+
+	defaultEndpointProbeInterval = 10 * time.Second
+	defaultEndpointProbeTimeout  = 2 * time.Second
+	defaultEjectFailures         = 3
+	defaultReadmitSuccesses      = 2
+	defaultMaxEjectedPercent     = 50
+	//number of recent probes the latency of an endpoint is averaged over
+	latencyWindow = 5
+)
+
+// the probed health of an endpoint of a dependency
+type endpointHealth struct {
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	Ejected bool   `json:"ejected"`
+	Reason  string `json:"reason,omitempty"`
+	// average latency of the recent passed probes
+	Latency string `json:"latency,omitempty"`
+	// consecutive failed and passed probes
+	Failures  int       `json:"failures"`
+	Successes int       `json:"successes"`
+	LastError string    `json:"last-error,omitempty"`
+	LastProbe time.Time `json:"last-probe"`
+	latencies []time.Duration
+}
+
+func validateEndpointProbes(dependencies []conf.ServiceDependency) error {
+	for _, dependency := range dependencies {
+		config := dependency.Probe
+		if config == nil {
+			continue
+		}
+		if config.Type != "" && !validateValue(config.Type, validEndpointProbeTypes) {
+			return fmt.Errorf("invalid probe type of %v: %v, valid types are: %v", dependency.ServiceName, config.Type, validEndpointProbeTypes)
+		}
+		for _, duration := range []string{config.Interval, config.Timeout, config.MaxLatency} {
+			if _, err := parseDuration(duration, 0); err != nil {
+				return err
+			}
+		}
+		if config.Failures < 0 || config.Successes < 0 || config.LatencyFactor < 0 {
+			return fmt.Errorf("failures, successes and latency-factor of %v can not be negative", dependency.ServiceName)
+		}
+		if config.MaxEjectedPercent < 0 || config.MaxEjectedPercent > 100 {
+			return fmt.Errorf("invalid max-ejected-percent of %v: %v", dependency.ServiceName, config.MaxEjectedPercent)
+		}
+	}
+	return nil
+}
+
+// the key of the probed endpoints of a dependency
+func dependencyKey(dependency conf.ServiceDependency) string {
+	return dependency.EndpointMapping + "/" + dependency.ServiceName + "/" + dependency.ServiceType
+}
+
+// start probing the endpoints of the dependencies with a probe until the agent shuts down
+func (a *Agent) probeDependenciesJob() {
+	for _, dependency := range a.config.ServiceAgent.ManagedService.ServiceDependency {
+		if dependency.Skip || dependency.Probe == nil {
+			continue
+		}
+		interval, _ := parseDuration(dependency.Probe.Interval, defaultEndpointProbeInterval)
+		a.probing.Add(1)
+		go func(dependency conf.ServiceDependency) {
+			defer a.probing.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				a.probeEndpoints(dependency)
+				select {
+				case <-a.done:
+					return
+				case <-ticker.C:
+				}
+			}
+		}(dependency)
+	}
+}
+
+// probe every passing instance of the dependency once, and eject or readmit its endpoints
+func (a *Agent) probeEndpoints(dependency conf.ServiceDependency) {
+	endpoints, err := a.resolveDependency(dependency)
+	if err != nil {
+		a.logger.Printf("unable to look up the instances of %v to probe them: %v", dependency.ServiceName, err)
+		return
+	}
+
+	latencies := make([]time.Duration, len(endpoints))
+	errs := make([]error, len(endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint discovery.Endpoint) {
+			defer wg.Done()
+			latencies[i], errs[i] = probeEndpoint(dependency.Probe, endpoint)
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	now := a.clock.Now()
+	key := dependencyKey(dependency)
+	a.mu.Lock()
+	if a.endpointHealth == nil {
+		a.endpointHealth = make(map[string][]*endpointHealth)
+	}
+	previous := make(map[string]*endpointHealth)
+	for _, health := range a.endpointHealth[key] {
+		previous[health.URL] = health
+	}
+	var entries []*endpointHealth
+	for i, endpoint := range endpoints {
+		health, ok := previous[endpoint.URL]
+		if !ok {
+			health = &endpointHealth{URL: endpoint.URL}
+		}
+		health.record(now, latencies[i], errs[i])
+		entries = append(entries, health)
+	}
+	a.endpointHealth[key] = entries
+	a.detectOutliers(dependency, entries)
+	a.mu.Unlock()
+
+	//the proxy of the dependency stops forwarding to the ejected endpoints right away
+	for _, dp := range a.proxyList() {
+		if dp.dependency.EndpointMapping == dependency.EndpointMapping {
+			dp.setBackends(a.usableEndpoints(dependency, endpoints))
+		}
+	}
+	//without a proxy, the replicas given endpoints ejected or readmitted since are started again
+	if dependency.Proxy == nil && !a.quiesced() {
+		a.switchSources(a.replicaList(), dependency)
+	}
+}
+
+// probe an endpoint, returning how long the probe took
+func probeEndpoint(config *conf.EndpointProbe, endpoint discovery.Endpoint) (time.Duration, error) {
+	var p probe.Probe = &probe.HTTP{URL: strings.TrimSuffix(endpoint.URL, "/") + config.Path}
+	if config.Type == tcpProbe {
+		target, err := url.Parse(endpoint.URL)
+		if err != nil {
+			return 0, err
+		}
+		p = &probe.TCP{Address: target.Host}
+	}
+	timeout, _ := parseDuration(config.Timeout, defaultEndpointProbeTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	err := p.Check(ctx)
+	return time.Since(start), err
+}
+
+// record the outcome of a probe
+func (h *endpointHealth) record(at time.Time, latency time.Duration, err error) {
+	h.LastProbe, h.Healthy = at, err == nil
+	if err != nil {
+		h.Failures, h.Successes, h.LastError = h.Failures+1, 0, err.Error()
+		return
+	}
+	h.Failures, h.Successes, h.LastError = 0, h.Successes+1, ""
+	h.latencies = append(h.latencies, latency)
+	if len(h.latencies) > latencyWindow {
+		h.latencies = h.latencies[len(h.latencies)-latencyWindow:]
+	}
+	h.Latency = h.averageLatency().String()
+}
+
+func (h *endpointHealth) averageLatency() time.Duration {
+	if len(h.latencies) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, latency := range h.latencies {
+		total += latency
+	}
+	return total / time.Duration(len(h.latencies))
+}
+
+// eject the outliers among the endpoints of a dependency and readmit the recovered ones. called with a.mu held
+func (a *Agent) detectOutliers(dependency conf.ServiceDependency, entries []*endpointHealth) {
+	config := dependency.Probe
+	failures, successes, maxPercent := config.Failures, config.Successes, config.MaxEjectedPercent
+	if failures == 0 {
+		failures = defaultEjectFailures
+	}
+	if successes == 0 {
+		successes = defaultReadmitSuccesses
+	}
+	if maxPercent == 0 {
+		maxPercent = defaultMaxEjectedPercent
+	}
+	maxLatency, _ := parseDuration(config.MaxLatency, 0)
+
+	var averages []time.Duration
+	for _, health := range entries {
+		if len(health.latencies) > 0 {
+			averages = append(averages, health.averageLatency())
+		}
+	}
+	sort.Slice(averages, func(i, j int) bool { return averages[i] < averages[j] })
+	var median time.Duration
+	if len(averages) > 0 {
+		median = averages[len(averages)/2]
+	}
+
+	outlier := func(health *endpointHealth) string {
+		average := health.averageLatency()
+		switch {
+		case health.Failures >= failures:
+			return fmt.Sprintf("%v consecutive failed probes: %v", health.Failures, health.LastError)
+		case maxLatency > 0 && average > maxLatency:
+			return fmt.Sprintf("average latency %v above %v", average, maxLatency)
+		case config.LatencyFactor > 0 && len(averages) >= 3 && float64(average) > config.LatencyFactor*float64(median):
+			return fmt.Sprintf("average latency %v above %v times the median %v", average, config.LatencyFactor, median)
+		}
+		return ""
+	}
+
+	limit := len(entries) * maxPercent / 100
+	if limit >= len(entries) {
+		limit = len(entries) - 1
+	}
+	ejected := 0
+	var candidates []*endpointHealth
+	for _, health := range entries {
+		reason := outlier(health)
+		switch {
+		case health.Ejected && reason == "" && health.Successes >= successes:
+			health.Ejected, health.Reason = false, ""
+			a.logger.Printf("readmitting endpoint %v of %v after %v passed probes", health.URL, dependency.ServiceName, health.Successes)
+		case health.Ejected:
+			ejected++
+			if reason != "" {
+				health.Reason = reason
+			}
+		case reason != "":
+			health.Reason = reason
+			candidates = append(candidates, health)
+		default:
+			health.Reason = ""
+		}
+	}
+	for _, health := range candidates {
+		if ejected >= limit {
+			break
+		}
+		health.Ejected = true
+		ejected++
+		a.logger.Printf("ejecting endpoint %v of %v: %v", health.URL, dependency.ServiceName, health.Reason)
+	}
+}
+
+// the sorted urls of the ejected endpoints of a dependency. called with a.mu held
+func (a *Agent) ejectedEndpoints(dependency conf.ServiceDependency) []string {
+	var ejected []string
+	for _, health := range a.endpointHealth[dependencyKey(dependency)] {
+		if health.Ejected {
+			ejected = append(ejected, health.URL)
+		}
+	}
+	sort.Strings(ejected)
+	return ejected
+}
+
+// the endpoints of a dependency without the ejected ones. endpoints not probed yet are kept
+func (a *Agent) withoutOutliers(dependency conf.ServiceDependency, endpoints []discovery.Endpoint) []discovery.Endpoint {
+	if dependency.Probe == nil {
+		return endpoints
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ejected := make(map[string]bool)
+	for _, health := range a.endpointHealth[dependencyKey(dependency)] {
+		ejected[health.URL] = health.Ejected
+	}
+	var healthy []discovery.Endpoint
+	for _, endpoint := range endpoints {
+		if !ejected[endpoint.URL] {
+			healthy = append(healthy, endpoint)
+		}
+	}
+	return healthy
+}
+
+// the JSON body of /service/dependencies, one per probed dependency
+type dependencyEndpoints struct {
+	EndpointMapping string           `json:"endpoint-mapping"`
+	ServiceName     string           `json:"service-name"`
+	ServiceType     string           `json:"service-type"`
+	Endpoints       []endpointHealth `json:"endpoints"`
+}
+
+func (a *Agent) dependencyEndpointsHandler(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	dependencies := []dependencyEndpoints{}
+	a.mu.Lock()
+	for _, dependency := range a.config.ServiceAgent.ManagedService.ServiceDependency {
+		if dependency.Skip || dependency.Probe == nil {
+			continue
+		}
+		endpoints := []endpointHealth{}
+		for _, health := range a.endpointHealth[dependencyKey(dependency)] {
+			endpoints = append(endpoints, *health)
+		}
+		dependencies = append(dependencies, dependencyEndpoints{
+			EndpointMapping: dependency.EndpointMapping,
+			ServiceName:     dependency.ServiceName,
+			ServiceType:     dependency.ServiceType,
+			Endpoints:       endpoints,
+		})
+	}
+	a.mu.Unlock()
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(dependencies)
+}
@@ -0,0 +1,297 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/discovery"
+	"github.com/aambhaik/tmgcagent/proxy"
+	"github.com/aambhaik/tmgcagent/state"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/sys/unix"
+)
+
+/********************************************************************************************
+	            local proxies to the dependencies of the managed service
+ *******************************************************************************************/
+
+//A dependency with a proxy is passed to the managed process as the URL of a port on 127.0.0.1 the agent listens on,
+//instead of the endpoints of its instances. The agent forwards what it accepts there to the passing instances,
+//which it looks up again every refresh interval, so the managed process keeps its endpoint when the instances
+//change. An allocated port is kept in the state file, so that an adopted process finds the proxy where it was; the
+//proxies listen with SO_REUSEPORT, so that an upgraded agent binds them while the previous agent still serves them.
+
+var (
+	validProxyModes     = []string{proxy.HTTP, proxy.TCP}
+	validProxyBalancing = []string{proxy.RoundRobin, proxy.LeastConnections}
+
+	defaultProxyRefresh    = 5 * time.Second
+	defaultProxyEjectAfter = 3
+	defaultProxyEjectFor   = 30 * time.Second
+)
+
+// a running proxy of a dependency
+type dependencyProxy struct {
+	dependency conf.ServiceDependency
+	proxy      *proxy.Proxy
+	listener   net.Listener
+	port       int
+}
+
+func validateProxies(dependencies []conf.ServiceDependency) error {
+	mappings := make(map[string]int)
+	for _, dependency := range dependencies {
+		mappings[dependency.EndpointMapping]++
+	}
+	for _, dependency := range dependencies {
+		config := dependency.Proxy
+		if config == nil {
+			continue
+		}
+		if dependency.EndpointMapping == "" || mappings[dependency.EndpointMapping] > 1 {
+			return fmt.Errorf("the proxied dependency %v needs an endpoint mapping of its own", dependency.ServiceName)
+		}
+		if config.Mode != "" && !validateValue(config.Mode, validProxyModes) {
+			return fmt.Errorf("invalid mode: %v, valid modes are: %v", config.Mode, validProxyModes)
+		}
+		if config.Balancing != "" && !validateValue(config.Balancing, validProxyBalancing) {
+			return fmt.Errorf("invalid balancing: %v, valid balancings are: %v", config.Balancing, validProxyBalancing)
+		}
+		if config.Port < 0 || config.Port > 65535 {
+			return fmt.Errorf("invalid port: %v", config.Port)
+		}
+		if config.Retries < 0 || config.EjectAfter < 0 {
+			return fmt.Errorf("retries and eject-after can not be negative")
+		}
+		for _, duration := range []string{config.EjectFor, config.RefreshInterval} {
+			if _, err := parseDuration(duration, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// listen on the ports of the proxies, on the configured or previously allocated ports, and start forwarding
+func (a *Agent) startProxies() error {
+	path := a.first().stateFile()
+	agentState, err := state.Load(path)
+	if err != nil {
+		agentState = &state.State{}
+	}
+	ports := make(map[string]int)
+	for _, dependency := range a.config.ServiceAgent.ManagedService.ServiceDependency {
+		if dependency.Skip || dependency.Proxy == nil {
+			continue
+		}
+		port := dependency.Proxy.Port
+		if port == 0 {
+			port = agentState.ProxyPorts[dependency.EndpointMapping]
+		}
+		listener, err := proxyListen(port)
+		if err != nil && port != dependency.Proxy.Port {
+			a.logger.Printf("unable to listen on the previous port %v of the proxy of %v, allocating another: %v", port, dependency.EndpointMapping, err)
+			listener, err = proxyListen(0)
+		}
+		if err != nil {
+			a.stopProxies()
+			return fmt.Errorf("unable to listen for the proxy of %v: %v", dependency.EndpointMapping, err)
+		}
+
+		ejectFor, _ := parseDuration(dependency.Proxy.EjectFor, defaultProxyEjectFor)
+		ejectAfter := dependency.Proxy.EjectAfter
+		if ejectAfter == 0 {
+			ejectAfter = defaultProxyEjectAfter
+		}
+		dp := &dependencyProxy{
+			dependency: dependency,
+			listener:   listener,
+			port:       listener.Addr().(*net.TCPAddr).Port,
+			proxy: proxy.New(proxy.Config{
+				Name:       dependency.EndpointMapping,
+				Mode:       proxyMode(dependency.Proxy),
+				Balancing:  dependency.Proxy.Balancing,
+				Retries:    dependency.Proxy.Retries,
+				EjectAfter: ejectAfter,
+				EjectFor:   ejectFor,
+				Logger:     a.logger,
+			}),
+		}
+		a.mu.Lock()
+		a.proxies = append(a.proxies, dp)
+		a.mu.Unlock()
+		ports[dependency.EndpointMapping] = dp.port
+		a.refreshProxy(dp)
+		go dp.proxy.Serve(listener)
+		a.logger.Printf("proxying %v to the instances of %v on %v", dependency.EndpointMapping, dependency.ServiceName, listener.Addr())
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+
+	a.saveProxyPorts(ports)
+	a.refreshProxiesJob()
+	return nil
+}
+
+func proxyMode(config *conf.DependencyProxy) string {
+	if config.Mode == "" {
+		return proxy.HTTP
+	}
+	return config.Mode
+}
+
+// listen on 127.0.0.1 with SO_REUSEPORT, so that the agent taking over through an upgrade can bind the port too
+func proxyListen(port int) (net.Listener, error) {
+	config := net.ListenConfig{Control: func(_, _ string, conn syscall.RawConn) error {
+		var sockErr error
+		if err := conn.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	return config.Listen(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+}
+
+// persist the ports of the proxies in the state file of the first replica
+func (a *Agent) saveProxyPorts(ports map[string]int) {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+	path := a.first().stateFile()
+	agentState, err := state.Load(path)
+	if err != nil {
+		agentState = &state.State{}
+	}
+	agentState.ProxyPorts = ports
+	if err := state.Save(path, agentState); err != nil {
+		a.logger.Printf("unable to persist the ports of the proxies of %v: %v", a.config.ServiceAgent.ManagedService.Name, err)
+	}
+}
+
+// look up the passing instances of the proxied dependencies again every refresh interval, until the agent shuts down
+func (a *Agent) refreshProxiesJob() {
+	for _, dp := range a.proxyList() {
+		interval, _ := parseDuration(dp.dependency.Proxy.RefreshInterval, defaultProxyRefresh)
+		go func(dp *dependencyProxy) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-a.done:
+					return
+				case <-ticker.C:
+				}
+				a.refreshProxy(dp)
+			}
+		}(dp)
+	}
+}
+
+// forward to the passing instances of the dependency. the instances are kept if the lookup fails
+func (a *Agent) refreshProxy(dp *dependencyProxy) {
+	endpoints, err := a.resolveDependency(dp.dependency)
+	if err != nil {
+		a.logger.Printf("unable to look up the instances of %v for its proxy, keeping the previous ones: %v", dp.dependency.ServiceName, err)
+		return
+	}
+	dp.setBackends(a.usableEndpoints(dp.dependency, endpoints))
+}
+
+func (dp *dependencyProxy) setBackends(endpoints []discovery.Endpoint) {
+	var backends []proxy.Backend
+	for _, endpoint := range endpoints {
+		target, err := url.Parse(endpoint.URL)
+		if err != nil {
+			continue
+		}
+		backends = append(backends, proxy.Backend{Address: target.Host, URL: endpoint.URL})
+	}
+	dp.proxy.SetBackends(backends)
+}
+
+// the URL of the proxy: http, unless connections are forwarded to instances called over another scheme
+func (dp *dependencyProxy) url(endpoints []discovery.Endpoint) string {
+	scheme := "http"
+	if proxyMode(dp.dependency.Proxy) == proxy.TCP && len(endpoints) > 0 {
+		if target, err := url.Parse(endpoints[0].URL); err == nil {
+			scheme = target.Scheme
+		}
+	}
+	return scheme + "://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(dp.port))
+}
+
+// replace the endpoints of the proxied dependencies by the endpoint of their proxy, which forwards to them from now
+// on. a proxied member of a dependency group without any instance is given the proxy endpoint too, the proxy
+// forwards to the instances that show up later. any other dependency without an instance fails the discovery first
+func (a *Agent) proxiedEndpoints(endpoints map[string][]discovery.Endpoint) map[string][]discovery.Endpoint {
+	proxies := a.proxyList()
+	if len(proxies) == 0 {
+		return endpoints
+	}
+	proxied := make(map[string][]discovery.Endpoint)
+	for mapping, mapped := range endpoints {
+		proxied[mapping] = mapped
+	}
+	for _, dp := range proxies {
+		mapped := endpoints[dp.dependency.EndpointMapping]
+		dp.setBackends(mapped)
+		proxied[dp.dependency.EndpointMapping] = []discovery.Endpoint{{URL: dp.url(mapped)}}
+	}
+	return proxied
+}
+
+func (a *Agent) proxyList() []*dependencyProxy {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*dependencyProxy{}, a.proxies...)
+}
+
+// stop listening on the ports of the proxies. forwarded connections are not interrupted
+func (a *Agent) stopProxies() {
+	a.mu.Lock()
+	proxies := a.proxies
+	a.proxies = nil
+	a.mu.Unlock()
+	for _, dp := range proxies {
+		dp.listener.Close()
+		dp.proxy.Close()
+	}
+}
+
+// the JSON body of /service/proxies, one per proxied dependency
+type proxyStatus struct {
+	EndpointMapping string                `json:"endpoint-mapping"`
+	ServiceName     string                `json:"service-name"`
+	Mode            string                `json:"mode"`
+	Port            int                   `json:"port"`
+	Backends        []proxy.BackendStatus `json:"backends"`
+}
+
+func (a *Agent) proxiesHandler(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	statuses := []proxyStatus{}
+	for _, dp := range a.proxyList() {
+		backends := dp.proxy.Backends()
+		if backends == nil {
+			backends = []proxy.BackendStatus{}
+		}
+		statuses = append(statuses, proxyStatus{
+			EndpointMapping: dp.dependency.EndpointMapping,
+			ServiceName:     dp.dependency.ServiceName,
+			Mode:            proxyMode(dp.dependency.Proxy),
+			Port:            dp.port,
+			Backends:        backends,
+		})
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(statuses)
+}
@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/lifecycle"
+	"github.com/aambhaik/tmgcagent/probe"
+)
+
+/********************************************************************************************
+	            readiness of the managed service
+ *******************************************************************************************/
+
+//A started managed service stays in the starting state, unregistered, until all of its readiness probes pass.
+//If they don't pass within the startup timeout, or the process exits first, the start fails: the process group
+//is killed and the service moves to crashed with the reason.
+
+var (
+	httpProbe       = "http"
+	tcpProbe        = "tcp"
+	execProbe       = "exec"
+	logProbe        = "log"
+	fileProbe       = "file"
+	grpcProbe       = "grpc"
+	validProbeTypes = []string{httpProbe, tcpProbe, execProbe, logProbe, fileProbe, grpcProbe}
+
+	defaultProbeInterval  = time.Second
+	defaultProbeTimeout   = time.Second
+	defaultStartupTimeout = 60 * time.Second
+)
+
+// check the readiness configuration, so that a bad probe is reported when the agent is created
+func validateReadiness(readiness *conf.Readiness) error {
+	if readiness == nil {
+		return nil
+	}
+	for _, durations := range []string{readiness.Interval, readiness.StartupTimeout} {
+		if _, err := parseDuration(durations, 0); err != nil {
+			return err
+		}
+	}
+	return validateProbes(readiness.Probes, validProbeTypes)
+}
+
+func validateProbes(probes []conf.Probe, validTypes []string) error {
+	for _, p := range probes {
+		if !validateValue(p.Type, validTypes) {
+			return fmt.Errorf("invalid probe type found in the service configuration: %v, valid types are: %v", p.Type, validTypes)
+		}
+		if _, err := newProbe(p, ""); err != nil {
+			return err
+		}
+		if _, err := parseDuration(p.Timeout, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// create the probe described by the configuration. output is the file a log probe watches when it has no path
+func newProbe(config conf.Probe, output string) (probe.Probe, error) {
+	if !validateValue(config.Type, validProbeTypes) {
+		return nil, fmt.Errorf("invalid probe type found in the service configuration: %v, valid types are: %v", config.Type, validProbeTypes)
+	}
+	switch config.Type {
+	case httpProbe:
+		if config.URL == "" {
+			return nil, fmt.Errorf("the http probe requires a url")
+		}
+		return &probe.HTTP{URL: config.URL}, nil
+	case tcpProbe:
+		if config.Address == "" {
+			return nil, fmt.Errorf("the tcp probe requires an address")
+		}
+		return &probe.TCP{Address: config.Address}, nil
+	case execProbe:
+		if len(config.Command) == 0 {
+			return nil, fmt.Errorf("the exec probe requires a command")
+		}
+		return &probe.Exec{Command: config.Command}, nil
+	case logProbe:
+		path := config.Path
+		if path == "" {
+			path = output
+		}
+		return probe.NewLog(path, config.Pattern)
+	case fileProbe:
+		if config.Path == "" {
+			return nil, fmt.Errorf("the file probe requires a path")
+		}
+		return &probe.File{Path: config.Path}, nil
+	case grpcProbe:
+		if config.Address == "" {
+			return nil, fmt.Errorf("the grpc probe requires an address")
+		}
+		return &probe.GRPC{Address: config.Address, Service: config.Service}, nil
+	}
+	return nil, fmt.Errorf("unsupported probe type: %v", config.Type)
+}
+
+func parseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %v: %v", value, err)
+	}
+	return duration, nil
+}
+
+// a probe with the timeout of one attempt
+type timedProbe struct {
+	probe.Probe
+	config  conf.Probe
+	timeout time.Duration
+}
+
+// create the readiness probes of the managed service. they are created before the process starts, so that log
+// probes only look at its output. an adopted process is checked without its log probes: the lines they wait for
+// were written while the previous agent was watching
+func (r *replica) readinessProbes(adopted bool) ([]timedProbe, error) {
+	readiness := r.config.ServiceAgent.ManagedService.Readiness
+	if readiness == nil {
+		return nil, nil
+	}
+	var probes []timedProbe
+	for _, config := range readiness.Probes {
+		if adopted && config.Type == logProbe {
+			continue
+		}
+		p, err := newProbe(r.expandProbe(config), r.outputFile())
+		if err != nil {
+			return nil, err
+		}
+		probes = append(probes, newTimedProbe(p, config))
+	}
+	return probes, nil
+}
+
+func newTimedProbe(p probe.Probe, config conf.Probe) timedProbe {
+	timeout, _ := parseDuration(config.Timeout, defaultProbeTimeout)
+	return timedProbe{Probe: p, config: config, timeout: timeout}
+}
+
+// wait until all readiness probes pass, the startup timeout expires or the managed process exits
+func (r *replica) waitReady(probes []timedProbe) error {
+	if len(probes) == 0 {
+		return nil
+	}
+	readiness := r.config.ServiceAgent.ManagedService.Readiness
+	interval, _ := parseDuration(readiness.Interval, defaultProbeInterval)
+	startupTimeout, _ := parseDuration(readiness.StartupTimeout, defaultStartupTimeout)
+	deadline := time.Now().Add(startupTimeout)
+
+	for {
+		err := checkAll(probes)
+		if err == nil {
+			return nil
+		}
+		if state := r.managedService.Lifecycle.State(); state != lifecycle.Starting {
+			return fmt.Errorf("the managed service became %v before it was ready", state)
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("not ready after %v: %v", startupTimeout, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func checkAll(probes []timedProbe) error {
+	for _, p := range probes {
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+		err := p.Check(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%v probe: %v", p.config.Type, err)
+		}
+	}
+	return nil
+}
+
+// whether the output of the managed process has to be kept for a log probe
+func (a *Agent) capturesOutput() bool {
+	readiness := a.config.ServiceAgent.ManagedService.Readiness
+	if readiness == nil {
+		return false
+	}
+	for _, p := range readiness.Probes {
+		if p.Type == logProbe && p.Path == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// location of the file receiving the output of the process of the replica, when a log probe watches it
+func (r *replica) outputFile() string {
+	return filepath.Join(r.stateDir, r.name()+".log")
+}
+
+// send the output of the managed process to the output file. a file, unlike a pipe to the agent, stays writable
+// when the agent restarts or is upgraded. the returned file is closed by the caller once the process started
+func (r *replica) captureOutput(command *exec.Cmd) (*os.File, error) {
+	if !r.capturesOutput() {
+		return nil, nil
+	}
+	if err := os.MkdirAll(r.stateDir, 0755); err != nil {
+		return nil, err
+	}
+	output, err := os.OpenFile(r.outputFile(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	command.Stdout = output
+	command.Stderr = output
+	return output, nil
+}
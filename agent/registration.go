@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aambhaik/tmgcagent/discovery"
+	"github.com/aambhaik/tmgcagent/proc"
+	"github.com/aambhaik/tmgcagent/state"
+)
+
+// location of the state file of the replica
+func (r *replica) stateFile() string {
+	return filepath.Join(r.stateDir, r.name()+".json")
+}
+
+// the registration of the replica under the given service id, a new one if empty
+func (r *replica) registration(serviceId string) *discovery.Registration {
+	managedServiceConf := r.config.ServiceAgent.ManagedService
+	meta := map[string]string{agentMetaKey: agentMetaValue, replicaMetaKey: strconv.Itoa(r.index)}
+	port := r.port
+	if port == 0 {
+		port = defaultServicePort
+	}
+	return &discovery.Registration{
+		ID:       serviceId,
+		Name:     managedServiceConf.Name,
+		Type:     managedServiceConf.Type,
+		Address:  "localhost",
+		Port:     port,
+		Meta:     meta,
+		CheckTTL: r.checkTTL(),
+	}
+}
+
+// register the replica under the service id persisted by a previous run (minting and persisting one on the first
+// run)
+func (r *replica) registerManagedService() (string, error) {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	agentState, err := state.Load(r.stateFile())
+	if err != nil {
+		r.logger.Printf("unable to read the agent state, a new service id will be used: %v", err)
+		agentState = &state.State{}
+	}
+
+	//1. register the managed service
+	serviceId, err := r.registry.Register(r.registration(agentState.ServiceID))
+	if err != nil {
+		return "", err
+	}
+
+	agentState.ServiceID = serviceId
+	if err := state.Save(r.stateFile(), agentState); err != nil {
+		r.logger.Printf("unable to persist the service id %v, the next run will register a new one: %v", serviceId, err)
+	}
+
+	//2. create the metadata for the managed service in consul.
+	bytes, err := json.Marshal(r.config)
+	if err != nil {
+		return "", err
+	}
+	if err := r.registry.PutKV(serviceId, bytes); err != nil {
+		return "", fmt.Errorf("unable to add metadata to the service %v: %v", serviceId, err)
+	}
+	return serviceId, nil
+}
+
+// delete the metadata and the usage of a registration from the registry
+func (a *Agent) deleteMetadata(serviceId string) error {
+	if err := a.registry.DeleteKV(serviceId); err != nil {
+		return err
+	}
+	return a.registry.DeleteKV(usageKey(serviceId))
+}
+
+// find the managed process recorded in the state file and, if it is still alive and is the same process (same
+// start time, process group and command line, so a reused pid is not mistaken for it), wrap it in a command the
+// agent can manage. an adopted process is not a child of the agent, so its exit is noticed through Signal(0)
+func (r *replica) adoptManagedProcess() (*exec.Cmd, bool) {
+	agentState, err := state.Load(r.stateFile())
+	if err != nil || agentState.Process == nil {
+		return nil, false
+	}
+	recorded := agentState.Process
+
+	stat, err := proc.ReadStat(recorded.PID)
+	if err != nil || stat.State == "Z" {
+		r.logger.Printf("managed process %v from a previous run is no longer running", recorded.PID)
+		return nil, false
+	}
+	cmdline, err := proc.Cmdline(recorded.PID)
+	if err != nil || stat.StartTime != recorded.StartTime || stat.Pgrp != recorded.Pgid || strings.Join(cmdline, "\x00") != strings.Join(recorded.Cmdline, "\x00") {
+		r.logger.Printf("pid %v from a previous run now belongs to a different process, not adopting it", recorded.PID)
+		return nil, false
+	}
+
+	process, err := os.FindProcess(recorded.PID)
+	if err != nil {
+		return nil, false
+	}
+	command := exec.Command(cmdline[0], cmdline[1:]...)
+	command.Process = process
+	//the replica keeps the port it was started with
+	r.port = agentState.Port
+	r.logger.Printf("adopted managed process %v (pgid %v) started by a previous run of the agent", recorded.PID, recorded.Pgid)
+	return command, true
+}
+
+// record the identity of a freshly started managed process in the state file, so that it can be adopted if the
+// agent restarts while it is still running
+func (r *replica) recordManagedProcess(command *exec.Cmd) {
+	pid := command.Process.Pid
+	stat, err := proc.ReadStat(pid)
+	if err != nil {
+		r.logger.Printf("unable to read the process information of %v, it can not be adopted after an agent restart: %v", pid, err)
+		return
+	}
+	cmdline, err := proc.Cmdline(pid)
+	if err != nil {
+		cmdline = command.Args
+	}
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	agentState, err := state.Load(r.stateFile())
+	if err != nil {
+		agentState = &state.State{}
+	}
+	agentState.Process = &state.Process{PID: pid, Pgid: stat.Pgrp, StartTime: stat.StartTime, Cmdline: cmdline}
+	agentState.Port = r.port
+	if err := state.Save(r.stateFile(), agentState); err != nil {
+		r.logger.Printf("unable to persist the managed process %v, it can not be adopted after an agent restart: %v", pid, err)
+	}
+}
+
+// deregister the registrations of the managed service on this node that were made by earlier runs of the agent,
+// and delete their metadata. registrations are recognized by the agent meta, or by the name-type- id prefix used
+// before the meta existed. the ids persisted by the replicas are kept
+func (a *Agent) cleanupStaleRegistrations() {
+	managedServiceConf := a.config.ServiceAgent.ManagedService
+	current := make(map[string]bool)
+	for _, r := range a.replicaList() {
+		if agentState, err := state.Load(r.stateFile()); err == nil && agentState.ServiceID != "" {
+			current[agentState.ServiceID] = true
+		}
+	}
+	instances, err := a.registry.LocalServices(managedServiceConf.Name)
+	if err != nil {
+		a.logger.Printf("unable to list the local registrations of %v, skipping the cleanup: %v", managedServiceConf.Name, err)
+		return
+	}
+
+	idPrefix := managedServiceConf.Name + "-" + managedServiceConf.Type + "-"
+	for _, instance := range instances {
+		if current[instance.ID] {
+			continue
+		}
+		if instance.Meta[agentMetaKey] != agentMetaValue && !strings.HasPrefix(instance.ID, idPrefix) {
+			continue
+		}
+		a.logger.Printf("deregistering stale registration %v of service %v", instance.ID, managedServiceConf.Name)
+		if err := a.registry.Deregister(instance.ID); err != nil {
+			a.logger.Printf("unable to deregister stale registration %v: %v", instance.ID, err)
+			continue
+		}
+		if err := a.deleteMetadata(instance.ID); err != nil {
+			a.logger.Printf("unable to delete the metadata of stale registration %v: %v", instance.ID, err)
+		}
+	}
+}
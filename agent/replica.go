@@ -0,0 +1,407 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/cgroup"
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/discovery"
+	"github.com/aambhaik/tmgcagent/lifecycle"
+	"github.com/aambhaik/tmgcagent/state"
+)
+
+/********************************************************************************************
+	            replicas of the managed service
+ *******************************************************************************************/
+
+//The agent runs the configured number of replicas (processes) of the managed service, one by default. Each replica
+//is supervised on its own: it has its own lifecycle, state file, registration (a service instance of its own), TTL
+//check, cgroup and restarts. With ports configured every replica gets a free port, which it is registered on and
+//which is passed to its process through the port arguments and environment. PUT /service/scale changes the number
+//of replicas: new replicas are started like the first ones, the ones with the highest indexes are stopped and
+//deregistered. The dependency checks and the management API act on all replicas.
+
+const (
+	portTemplate    = "{{port}}"
+	replicaTemplate = "{{replica}}"
+
+	//port a replica is registered on when the agent does not allocate one
+	defaultServicePort = 9985
+	//how long a replica that is scaled away, or started again with other dependency endpoints, has to exit
+	removeTimeout = 10 * time.Second
+)
+
+// replica is one process of the managed service. the agent fields are shared by all replicas
+type replica struct {
+	*Agent
+	index int
+	//allocated before the replica is started, zero without ports
+	port int
+	//closed when the replica is scaled away, which cancels its pending restart
+	removed chan struct{}
+	//consecutive failed rounds of liveness probes, only used by the liveness job
+	livenessFailures int
+	//last CPU sample, only used by the autoscaler
+	cpuSample cpuSample
+
+	//guards managedService.Command and managedService.ServiceId, which are replaced on every start
+	mu             sync.Mutex
+	managedService conf.ManagedServiceInstance
+	//error of the failing liveness probes, nil while the replica is live
+	livenessErr error
+	//when the replica last became ready, and the delay before its next restart
+	readyAt      time.Time
+	restartDelay time.Duration
+	//cgroup of the process and its OOM kill count when the process started
+	cgroup   *cgroup.Group
+	oomKills uint64
+	//status and output last reported to the registry check of the replica
+	healthStatus string
+	healthOutput string
+	//sources (tier and datacenter) of the endpoints of the dependencies the process was given, by dependency key
+	dependencySources map[string]string
+}
+
+func validateReplicas(replicas int, ports *conf.Ports) error {
+	if replicas < 0 {
+		return fmt.Errorf("invalid number of replicas: %v", replicas)
+	}
+	if ports == nil {
+		return nil
+	}
+	if ports.Range != "" {
+		if _, _, err := parsePortRange(ports.Range); err != nil {
+			return err
+		}
+	}
+	for _, variable := range ports.Env {
+		if !strings.Contains(variable, "=") {
+			return fmt.Errorf("invalid environment variable %v, expected NAME=value", variable)
+		}
+	}
+	return nil
+}
+
+// parse a port range like 31000-31999
+func parsePortRange(value string) (int, int, error) {
+	bounds := strings.SplitN(value, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %v", value)
+	}
+	low, lowErr := strconv.Atoi(bounds[0])
+	high, highErr := strconv.Atoi(bounds[1])
+	if lowErr != nil || highErr != nil || low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %v", value)
+	}
+	return low, high, nil
+}
+
+func (a *Agent) newReplica(index int) *replica {
+	managedServiceConf := a.config.ServiceAgent.ManagedService
+	//an in-memory struct holding all the metadata about the process of the replica. this is necessary to support
+	//life-cycle operations, without using system-level calls.
+	return &replica{
+		Agent:   a,
+		index:   index,
+		removed: make(chan struct{}),
+		managedService: conf.ManagedServiceInstance{
+			Name:      managedServiceConf.Name,
+			Type:      managedServiceConf.Type,
+			Config:    a.config,
+			Exec:      managedServiceConf.Process.Exec,
+			Lifecycle: lifecycle.NewMachine(a.clock.Now),
+		},
+	}
+}
+
+// the name of the replica: the name of the managed service for the first one, suffixed with the index for the
+// others. it names the state file, the output file and the cgroup of the replica
+func (r *replica) name() string {
+	if r.index == 0 {
+		return r.config.ServiceAgent.ManagedService.Name
+	}
+	return fmt.Sprintf("%v-%v", r.config.ServiceAgent.ManagedService.Name, r.index)
+}
+
+// the current replicas, by index
+func (a *Agent) replicaList() []*replica {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*replica(nil), a.replicas...)
+}
+
+// the replica with the given index, nil if there is none
+func (a *Agent) replica(index int) *replica {
+	replicas := a.replicaList()
+	if index < 0 || index >= len(replicas) {
+		return nil
+	}
+	return replicas[index]
+}
+
+// the first replica, which a service always has. a job runs as its first and only replica
+func (a *Agent) first() *replica {
+	return a.replica(0)
+}
+
+// apply an operation to every replica. the errors are prefixed with their replica when there are several
+func (a *Agent) eachReplica(operation func(*replica) error) error {
+	replicas := a.replicaList()
+	var failures []string
+	for _, r := range replicas {
+		if err := operation(r); err != nil {
+			if len(replicas) == 1 {
+				return err
+			}
+			failures = append(failures, fmt.Sprintf("replica %v: %v", r.index, err))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// the number of replicas to run: the configured one, unless the managed service was scaled since
+func (a *Agent) replicaCount() int {
+	configured := a.configuredReplicas()
+	agentState, err := state.Load(a.newReplica(0).stateFile())
+	if err == nil && agentState.Replicas > 0 && agentState.ConfiguredReplicas == configured {
+		return agentState.Replicas
+	}
+	return configured
+}
+
+func (a *Agent) configuredReplicas() int {
+	if replicas := a.config.ServiceAgent.ManagedService.Replicas; replicas > 0 {
+		return replicas
+	}
+	return 1
+}
+
+// persist the number of replicas in the state file of the first replica, so that a restarted or upgraded agent
+// runs (and adopts) as many
+func (a *Agent) saveReplicaCount(replicas int) {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+	path := a.first().stateFile()
+	agentState, err := state.Load(path)
+	if err != nil {
+		agentState = &state.State{}
+	}
+	agentState.Replicas, agentState.ConfiguredReplicas = replicas, a.configuredReplicas()
+	if err := state.Save(path, agentState); err != nil {
+		a.logger.Printf("unable to persist the number of replicas of %v: %v", a.config.ServiceAgent.ManagedService.Name, err)
+	}
+}
+
+// replace the port and replica templates by those of the replica
+func (r *replica) expand(value string) string {
+	return strings.NewReplacer(portTemplate, strconv.Itoa(r.port), replicaTemplate, strconv.Itoa(r.index)).Replace(value)
+}
+
+// the probe configuration with the port and replica templates replaced
+func (r *replica) expandProbe(config conf.Probe) conf.Probe {
+	config.URL, config.Address, config.Path = r.expand(config.URL), r.expand(config.Address), r.expand(config.Path)
+	command := make([]string, len(config.Command))
+	for i, arg := range config.Command {
+		command[i] = r.expand(arg)
+	}
+	config.Command = command
+	return config
+}
+
+// the port arguments of the process of the replica
+func (r *replica) portArguments() []string {
+	ports := r.config.ServiceAgent.ManagedService.Ports
+	if ports == nil {
+		return nil
+	}
+	var args []string
+	for _, arg := range ports.Args {
+		args = append(args, r.expand(arg))
+	}
+	return args
+}
+
+// add the port environment to the process of the replica
+func (r *replica) portEnvironment(command *exec.Cmd) {
+	ports := r.config.ServiceAgent.ManagedService.Ports
+	if ports == nil || len(ports.Env) == 0 {
+		return
+	}
+	if command.Env == nil {
+		command.Env = os.Environ()
+	}
+	for _, variable := range ports.Env {
+		command.Env = append(command.Env, r.expand(variable))
+	}
+}
+
+// a free port for a replica: the first one of the range that is not allocated to another replica and can be
+// listened on, any free port without a range
+func (a *Agent) allocatePort() (int, error) {
+	portRange := a.config.ServiceAgent.ManagedService.Ports.Range
+	if portRange == "" {
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			return 0, fmt.Errorf("unable to allocate a port: %v", err)
+		}
+		defer listener.Close()
+		return listener.Addr().(*net.TCPAddr).Port, nil
+	}
+
+	low, high, _ := parsePortRange(portRange)
+	allocated := make(map[int]bool)
+	for _, r := range a.replicaList() {
+		allocated[r.port] = true
+	}
+	for port := low; port <= high; port++ {
+		if allocated[port] {
+			continue
+		}
+		if listener, err := net.Listen("tcp", fmt.Sprintf(":%v", port)); err == nil {
+			listener.Close()
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port left in %v", portRange)
+}
+
+// start (or adopt) the process of the replica and register it
+func (r *replica) start(reason string) error {
+	managedServiceConf := r.config.ServiceAgent.ManagedService
+
+	//if a previous agent crashed or was upgraded, the managed process it started may still be running in its own
+	//process group. adopt it instead of starting a duplicate.
+	command, adopted := r.adoptManagedProcess()
+	if adopted {
+		if err := r.adoptProcess(command); err != nil {
+			return fmt.Errorf("unable to adopt the managed service %v: %v", r.name(), err)
+		}
+	} else {
+		//contact consul service registry and get the callable URLs for the dependency service(s) described in the configuration.
+		serviceDependencyEndpointsMap, err := r.discoverManagedServiceDependencies()
+		if err != nil {
+			return fmt.Errorf("unable to resolve service dependency : %v", err)
+		}
+		if managedServiceConf.Ports != nil {
+			if r.port, err = r.allocatePort(); err != nil {
+				return err
+			}
+		}
+
+		command = r.managedProcessCommand(serviceDependencyEndpointsMap)
+
+		//start the managed process
+		r.managedService.Lifecycle.Transition(lifecycle.Starting, reason)
+		if err := r.launchManagedProcess(command, reason); err != nil {
+			return fmt.Errorf("unable to start the managed service %v: %v", r.name(), err)
+		}
+	}
+
+	//announce the replica to consul registry along with the ping check configuration.
+	serviceId, err := r.registerManagedService()
+	if err != nil {
+		return fmt.Errorf("unable to register the service %v: %v", r.name(), err)
+	}
+	r.logger.Printf("service %v registered successfully", r.name())
+	r.setManagedServiceId(serviceId)
+	return nil
+}
+
+// the command of the managed process, given the endpoints of its dependencies and its port as arguments
+func (r *replica) managedProcessCommand(endpoints map[string][]discovery.Endpoint) *exec.Cmd {
+	managedServiceConf := r.config.ServiceAgent.ManagedService
+	r.setDependencySources(r.currentSources())
+	processArguments := managedProcessArguments(managedServiceConf.Process.Args, r.proxiedEndpoints(endpoints))
+	processArguments = append(processArguments, r.portArguments()...)
+	return exec.Command(managedServiceConf.Process.Exec, processArguments...)
+}
+
+// stop the process of a replica that is scaled away, deregister it and delete its state
+func (r *replica) remove(reason string) {
+	close(r.removed)
+	machine := r.managedService.Lifecycle
+	if machine.Is(lifecycle.Starting, lifecycle.Running, lifecycle.Suspended) {
+		if err := r.stopManagedService(reason); err != nil {
+			r.logger.Printf("Error stopping replica %v of the managed service: %v", r.index, err)
+		}
+	} else {
+		//nothing runs while pending, crashed or in backoff
+		machine.Transition(lifecycle.Stopped, reason)
+	}
+	waitStopped(machine, removeTimeout)
+
+	if serviceId := r.managedServiceId(); serviceId != "" {
+		if err := r.registry.Deregister(serviceId); err != nil {
+			r.logger.Printf("unable to deregister replica %v (%v): %v", r.index, serviceId, err)
+		}
+		if err := r.deleteMetadata(serviceId); err != nil {
+			r.logger.Printf("unable to delete the metadata of replica %v (%v): %v", r.index, serviceId, err)
+		}
+	}
+	for _, file := range []string{r.stateFile(), r.outputFile()} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			r.logger.Printf("unable to remove %v: %v", file, err)
+		}
+	}
+}
+
+// wait for the process being stopped to exit, until the timeout
+func waitStopped(machine *lifecycle.Machine, timeout time.Duration) {
+	for deadline := time.Now().Add(timeout); machine.Is(lifecycle.Stopping) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Scale changes the number of replicas of the managed service. new replicas are started and registered, the
+// replicas with the highest indexes are stopped and deregistered
+func (a *Agent) Scale(replicas int) error {
+	if a.isJob() {
+		return fmt.Errorf("a job has a single replica")
+	}
+	if replicas < 1 {
+		return fmt.Errorf("invalid number of replicas: %v", replicas)
+	}
+	a.scaleLock.Lock()
+	defer a.scaleLock.Unlock()
+
+	name := a.config.ServiceAgent.ManagedService.Name
+	current := a.replicaList()
+	for index := len(current); index < replicas; index++ {
+		r := a.newReplica(index)
+		if err := r.start("scaled up"); err != nil {
+			r.remove("failed to start")
+			a.saveReplicaCount(index)
+			return fmt.Errorf("unable to start replica %v: %v", index, err)
+		}
+		a.mu.Lock()
+		a.replicas = append(a.replicas, r)
+		a.mu.Unlock()
+	}
+	//replicas are out of the list before they are stopped, so that nothing restarts them
+	for index := len(current) - 1; index >= replicas; index-- {
+		a.mu.Lock()
+		a.replicas = a.replicas[:index]
+		a.mu.Unlock()
+		current[index].remove("scaled down")
+	}
+	if replicas != len(current) {
+		//the cooldowns of the autoscaler start over
+		a.mu.Lock()
+		a.lastScaled = a.clock.Now()
+		a.mu.Unlock()
+	}
+	a.saveReplicaCount(replicas)
+	a.logger.Printf("service %v scaled from %v to %v replicas", name, len(current), replicas)
+	return nil
+}
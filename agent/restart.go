@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/lifecycle"
+)
+
+var (
+	restartNever         = "never"
+	restartOnFailure     = "on-failure"
+	restartAlways        = "always"
+	validRestartPolicies = []string{restartNever, restartOnFailure, restartAlways}
+
+	defaultRestartBackoff    = time.Second
+	defaultMaxRestartBackoff = time.Minute
+)
+
+func validateRestartPolicy(policy *conf.RestartPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	if !validateValue(policy.Policy, validRestartPolicies) {
+		return fmt.Errorf("invalid restart policy found in the service configuration: %v, valid policies are: %v", policy.Policy, validRestartPolicies)
+	}
+	for _, duration := range []string{policy.Backoff, policy.MaxBackoff} {
+		if _, err := parseDuration(duration, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// whether the restart policy restarts a crashed managed service. failed tells a crash (non-zero exit, signal,
+// failed liveness probes) from an unexpected clean exit
+func (a *Agent) restarts(failed bool) bool {
+	policy := a.config.ServiceAgent.ManagedService.Restart
+	if policy == nil {
+		return false
+	}
+	return policy.Policy == restartAlways || (policy.Policy == restartOnFailure && failed)
+}
+
+// the delay before the next restart: the backoff doubles with every crash, and starts over once the service ran
+// for longer than the maximum backoff
+func (r *replica) nextRestartDelay() time.Duration {
+	policy := r.config.ServiceAgent.ManagedService.Restart
+	backoff, _ := parseDuration(policy.Backoff, defaultRestartBackoff)
+	maxBackoff, _ := parseDuration(policy.MaxBackoff, defaultMaxRestartBackoff)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.restartDelay == 0 || (!r.readyAt.IsZero() && r.clock.Now().Sub(r.readyAt) > maxBackoff) {
+		r.restartDelay = backoff
+	} else if r.restartDelay *= 2; r.restartDelay > maxBackoff {
+		r.restartDelay = maxBackoff
+	}
+	r.readyAt = time.Time{}
+	return r.restartDelay
+}
+
+// apply the restart policy to the crashed managed service: wait in backoff, then start it again
+func (r *replica) restartAfterCrash(failed bool) {
+	if !r.restarts(failed) {
+		return
+	}
+	delay := r.nextRestartDelay()
+	if err := r.managedService.Lifecycle.TransitionFrom([]lifecycle.State{lifecycle.Crashed}, lifecycle.Backoff, fmt.Sprintf("restarting in %v", delay)); err != nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-r.done:
+			return
+		case <-r.removed:
+			return
+		case <-time.After(delay):
+		}
+		if !r.waitResumed() {
+			return
+		}
+		if err := r.startManagedService("restarted after a crash"); err != nil {
+			r.logger.Printf("Unable to restart the managed service %v: %v", r.managedService.Name, err)
+			//a failed start leaves the service crashed, keep trying
+			r.restartAfterCrash(true)
+		}
+	}()
+}
+
+// start the replica with the current endpoints of its dependencies, as its first start does, and register it again
+// once it is ready. the replica must be stopped, crashed or in backoff
+func (r *replica) startManagedService(reason string) error {
+	managedService := &r.managedService
+	if err := managedService.Lifecycle.Transition(lifecycle.Starting, reason); err != nil {
+		//looks like the process is still running (or being started/stopped). can not start it again
+		return err
+	}
+	//the instances of the dependencies may have changed since the last process started
+	endpoints, err := r.discoverManagedServiceDependencies()
+	if err != nil {
+		managedService.Lifecycle.Transition(lifecycle.Crashed, fmt.Sprintf("failed to start: unable to resolve service dependency: %v", err))
+		return fmt.Errorf("unable to resolve service dependency : %v", err)
+	}
+	command := r.managedProcessCommand(endpoints)
+
+	if err := r.launchManagedProcess(command, reason); err != nil {
+		return err
+	}
+
+	//re-register service under its persisted id, along with its metadata
+	serviceId, err := r.registerManagedService()
+	if err != nil {
+		return fmt.Errorf("unable to register the managed service: %v", err)
+	}
+	r.setManagedServiceId(serviceId)
+	r.logger.Printf("service %v started successfully", command.Path)
+	return nil
+}
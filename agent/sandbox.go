@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/sandbox"
+)
+
+/********************************************************************************************
+	            sandbox of the managed process
+ *******************************************************************************************/
+
+//A sandboxed managed process is started through the sandbox shim, see package sandbox. Its pid, arguments and
+//environment stay those of the managed binary, so supervision, adoption and limits work as without a sandbox.
+
+var validNamespaces = []string{"mount", "pid", "ipc", "uts"}
+
+func validateSandbox(config *conf.Sandbox) error {
+	_, err := newSandbox(config)
+	return err
+}
+
+// the sandbox of the managed process, nil without one
+func newSandbox(config *conf.Sandbox) (*sandbox.Config, error) {
+	if config == nil {
+		return nil, nil
+	}
+	for _, namespace := range config.Namespaces {
+		if !validateValue(namespace, validNamespaces) {
+			return nil, fmt.Errorf("invalid namespace: %v, valid namespaces are: %v", namespace, validNamespaces)
+		}
+	}
+	for _, path := range append(append([]string{}, config.ReadOnlyPaths...), config.WritablePaths...) {
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("sandbox paths must be absolute: %v", path)
+		}
+	}
+	credential, err := lookupCredential(config.User, config.Group)
+	if err != nil {
+		return nil, err
+	}
+	return &sandbox.Config{
+		Namespaces:    config.Namespaces,
+		Credential:    credential,
+		PrivateTmp:    config.PrivateTmp,
+		ReadOnlyPaths: config.ReadOnlyPaths,
+		WritablePaths: config.WritablePaths,
+		NoNewPrivs:    config.NoNewPrivileges,
+	}, nil
+}
+
+// the credential of a user and group given by name or id, nil if neither is given
+func lookupCredential(userName, groupName string) (*syscall.Credential, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+	credential := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return nil, fmt.Errorf("unknown user %v", userName)
+			}
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		credential.Uid, credential.Gid = uint32(uid), uint32(gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return nil, fmt.Errorf("unknown group %v", groupName)
+			}
+		}
+		gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+		credential.Gid = uint32(gid)
+	}
+	return credential, nil
+}
+
+// wrap the command of the managed process in its sandbox, if it has one or rlimits to set before it runs
+func (a *Agent) sandboxCommand(command *exec.Cmd) error {
+	config, err := newSandbox(a.config.ServiceAgent.ManagedService.Process.Sandbox)
+	if err != nil {
+		return err
+	}
+	if rlimits := a.rlimits(); len(rlimits) > 0 {
+		if config == nil {
+			config = &sandbox.Config{}
+		}
+		config.Rlimits = rlimits
+	}
+	if config == nil {
+		return nil
+	}
+	return sandbox.Wrap(config, command)
+}
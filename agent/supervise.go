@@ -0,0 +1,239 @@
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/lifecycle"
+)
+
+/********************************************************************************************
+	            supervision of the managed process
+ *******************************************************************************************/
+
+//Every operation on the managed process (start, stop, suspend, resume, exit) first moves the managed service's
+//lifecycle state machine. The transition is the guard: an operation that is not allowed in the current state is
+//refused, so concurrent HTTP requests and the dependency check job can not race each other.
+
+// interval at which an adopted process, which the agent can not Wait on, is checked for exit
+const adoptedProcessPollInterval = time.Second
+
+func (r *replica) managedCommand() *exec.Cmd {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.managedService.Command
+}
+
+func (r *replica) setManagedCommand(command *exec.Cmd) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.managedService.Command = command
+}
+
+func (r *replica) managedServiceId() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.managedService.ServiceId
+}
+
+func (r *replica) setManagedServiceId(serviceId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.managedService.ServiceId = serviceId
+}
+
+// start the managed process. the lifecycle must already be in the starting state; it moves on to running once
+// the process is ready, or to crashed if the process can not be started or does not become ready
+func (r *replica) launchManagedProcess(command *exec.Cmd, reason string) error {
+	probes, err := r.readinessProbes(false)
+	if err == nil {
+		err = r.runHooks(preStartHook, command, reason)
+	}
+	if err == nil {
+		command, err = r.startManagedProcess(command)
+	}
+	if err != nil {
+		r.managedService.Lifecycle.Transition(lifecycle.Crashed, fmt.Sprintf("failed to start: %v", err))
+		return err
+	}
+	r.setManagedCommand(command)
+	r.recordManagedProcess(command)
+	go r.superviseProcess(command, true)
+	return r.becomeReady(command, probes, reason, true)
+}
+
+// start the process with its port environment, its output captured and within its resource limits. the process
+// actually started is returned
+func (r *replica) startManagedProcess(command *exec.Cmd) (*exec.Cmd, error) {
+	r.portEnvironment(command)
+	output, err := r.captureOutput(command)
+	if err != nil {
+		return nil, err
+	}
+	if output != nil {
+		//the child has its own copy
+		defer output.Close()
+	}
+	if err := r.sandboxCommand(command); err != nil {
+		return nil, fmt.Errorf("unable to sandbox the managed process: %v", err)
+	}
+	return r.startLimited(command)
+}
+
+// take over a managed process started by a previous run of the agent
+func (r *replica) adoptProcess(command *exec.Cmd) error {
+	r.setManagedCommand(command)
+	r.managedService.Lifecycle.Transition(lifecycle.Starting, "agent restarted")
+	go r.superviseProcess(command, false)
+	probes, err := r.readinessProbes(true)
+	if err != nil {
+		return err
+	}
+	return r.becomeReady(command, probes, fmt.Sprintf("adopted process %v", command.Process.Pid), false)
+}
+
+// wait for the started process to be ready, run the post-start hooks of a process the agent started and move on
+// to running. a process that doesn't become ready is killed, its start reported as failed
+func (r *replica) becomeReady(command *exec.Cmd, probes []timedProbe, reason string, started bool) error {
+	err := r.waitReady(probes)
+	if err == nil && started {
+		err = r.runHooks(postStartHook, command, reason)
+	}
+	if err != nil {
+		err = fmt.Errorf("startup failed: %v", err)
+		r.logger.Printf("Managed service [%v] of type [%v] %v", r.managedService.Name, r.managedService.Type, err)
+		if r.managedService.Lifecycle.TransitionFrom([]lifecycle.State{lifecycle.Starting}, lifecycle.Crashed, err.Error()) == nil {
+			signalProcessGroup(command, syscall.SIGKILL)
+		}
+		return err
+	}
+	if err := r.managedService.Lifecycle.TransitionFrom([]lifecycle.State{lifecycle.Starting}, lifecycle.Running, reason); err != nil {
+		return fmt.Errorf("startup failed: %v", err)
+	}
+	r.mu.Lock()
+	r.readyAt = r.clock.Now()
+	r.livenessErr = nil
+	r.mu.Unlock()
+	return nil
+}
+
+// wait for the managed process to exit and record how it exited
+func (r *replica) superviseProcess(command *exec.Cmd, child bool) {
+	var reason string
+	//the exit status of an adopted process is unknown
+	failed := true
+	if child {
+		err := command.Wait()
+		reason, failed = exitReason(err), err != nil
+		if failed && r.oomKilled() {
+			reason = "killed by the OOM killer"
+		}
+	} else {
+		for command.Process.Signal(syscall.Signal(0)) == nil {
+			time.Sleep(adoptedProcessPollInterval)
+		}
+		reason = "adopted process exited"
+	}
+	r.processExited(command, reason, failed)
+}
+
+// an exit the agent asked for (stopping) ends in stopped, any other exit of the current process is a crash. the
+// restart policy applies to crashes of a running service, a crash while starting fails the start instead
+func (r *replica) processExited(command *exec.Cmd, reason string, failed bool) {
+	if r.managedCommand() != command {
+		//an older process, superseded by a restart
+		return
+	}
+	//only processExited moves on from stopping, the service is stopped once its post-stop hooks ran
+	if r.managedService.Lifecycle.Is(lifecycle.Stopping) {
+		r.runHooks(postStopHook, command, reason)
+		if r.managedService.Lifecycle.TransitionFrom([]lifecycle.State{lifecycle.Stopping}, lifecycle.Stopped, reason) == nil {
+			r.logger.Printf("Managed service [%v] of type [%v] stopped: %v", r.managedService.Name, r.managedService.Type, reason)
+			return
+		}
+	}
+	if r.managedService.Lifecycle.TransitionFrom([]lifecycle.State{lifecycle.Running, lifecycle.Suspended}, lifecycle.Crashed, reason) == nil {
+		r.logger.Printf("Managed service [%v] of type [%v] crashed: %v", r.managedService.Name, r.managedService.Type, reason)
+		r.runHooks(onCrashHook, command, reason)
+		r.restartAfterCrash(failed)
+		return
+	}
+	if r.managedService.Lifecycle.Transition(lifecycle.Crashed, reason) == nil {
+		r.logger.Printf("Managed service [%v] of type [%v] crashed: %v", r.managedService.Name, r.managedService.Type, reason)
+		r.runHooks(onCrashHook, command, reason)
+	}
+}
+
+func startProcess(cmd *exec.Cmd) (bool, error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		return false, fmt.Errorf("error starting the executable specified in the service configuration %v: %w", cmd.Path, err)
+	}
+
+	//the process is reaped by superviseProcess
+	return true, nil
+}
+
+func exitReason(err error) string {
+	if err == nil {
+		return "exited with status 0"
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return fmt.Sprintf("killed by signal %v", status.Signal())
+		}
+		return fmt.Sprintf("exited with status %v", exitErr.ExitCode())
+	}
+	return err.Error()
+}
+
+// stop the managed process group. the lifecycle moves to stopping, and to stopped once the exit is observed
+func (r *replica) stopManagedService(reason string) error {
+	if err := r.managedService.Lifecycle.Transition(lifecycle.Stopping, reason); err != nil {
+		return err
+	}
+	command := r.managedCommand()
+	r.runHooks(preStopHook, command, reason)
+	if err := signalProcessGroup(command, syscall.SIGKILL); err != nil {
+		if err == syscall.ESRCH {
+			//already gone, the exit may have been missed while the state was changing
+			r.runHooks(postStopHook, command, reason)
+			r.managedService.Lifecycle.Transition(lifecycle.Stopped, reason)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// pause the managed process group with SIGSTOP while a dependency is unavailable
+func (r *replica) suspendManagedService(reason string) error {
+	if err := r.managedService.Lifecycle.TransitionFrom([]lifecycle.State{lifecycle.Running}, lifecycle.Suspended, reason); err != nil {
+		return err
+	}
+	return signalProcessGroup(r.managedCommand(), syscall.SIGSTOP)
+}
+
+// continue a suspended managed process group
+func (r *replica) resumeManagedService(reason string) error {
+	if err := r.managedService.Lifecycle.TransitionFrom([]lifecycle.State{lifecycle.Suspended}, lifecycle.Running, reason); err != nil {
+		return err
+	}
+	return signalProcessGroup(r.managedCommand(), syscall.SIGCONT)
+}
+
+func signalProcessGroup(command *exec.Cmd, signal syscall.Signal) error {
+	if command == nil || command.Process == nil {
+		return syscall.ESRCH
+	}
+	pgid, err := syscall.Getpgid(command.Process.Pid)
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(-pgid, signal)
+}
@@ -0,0 +1,307 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/********************************************************************************************
+	            zero-downtime self-upgrade of the agent
+ *******************************************************************************************/
+
+//An upgrade re-execs the agent binary (the running one, or the one given to PUT /agent/upgrade?binary=) as a new
+//agent process. The new agent inherits the listening management socket through a file descriptor, adopts the
+//managed process through the state file, and reports back on a pipe once it is serving. Only then does the old
+//agent shut down, leaving the managed process (which runs in its own process group) untouched throughout. The old
+//agent stops accepting connections first, and serves those it accepted already before it shuts down. While both
+//agents supervise the managed process, the old one neither restarts it nor probes, checks, runs or scales it, and
+//takes these up again if the new agent does not take over.
+
+const (
+	//environment variables telling a new agent which inherited file descriptors to use
+	listenFdEnv       = "TMGC_LISTEN_FD"
+	upgradeReadyFdEnv = "TMGC_UPGRADE_READY_FD"
+)
+
+var (
+	// how long the new agent has to take over before it is killed
+	upgradeTimeout = 30 * time.Second
+	// how long the old agent waits for the connections it accepted to be read before it shuts down
+	handoffTimeout = time.Second
+)
+
+// handoffListener is the management listener of an agent, which stops accepting connections once the agent
+// handed over and leaves them to the new agent, until the server closes it
+type handoffListener struct {
+	net.Listener
+	stopping  chan struct{}
+	stopped   chan struct{}
+	closed    chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
+}
+
+func newHandoffListener(listener net.Listener) *handoffListener {
+	return &handoffListener{Listener: listener, stopping: make(chan struct{}), stopped: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (l *handoffListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.stopping:
+			close(l.stopped)
+			<-l.closed
+			return nil, net.ErrClosed
+		default:
+		}
+	}
+	return conn, err
+}
+
+func (l *handoffListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// stop accepting connections without closing the socket, which the new agent keeps accepting from. once this
+// returns, every connection accepted is known to the server
+func (l *handoffListener) stop() error {
+	tcpListener, ok := l.Listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("the management socket can not stop accepting")
+	}
+	l.stopOnce.Do(func() {
+		close(l.stopping)
+		//the pending accept fails right away
+		tcpListener.SetDeadline(time.Now())
+	})
+	select {
+	case <-l.stopped:
+		return nil
+	case <-time.After(handoffTimeout):
+		return fmt.Errorf("still accepting after %v", handoffTimeout)
+	}
+}
+
+// track the connections the management server has not read a request from yet, a shutdown drops them
+func (a *Agent) trackConnState(conn net.Conn, state http.ConnState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if state != http.StateNew {
+		delete(a.unread, conn)
+		return
+	}
+	if a.unread == nil {
+		a.unread = make(map[net.Conn]bool)
+	}
+	a.unread[conn] = true
+}
+
+// listen on the management port, or take over the socket handed down by the agent being upgraded
+func managementListen(port int) (net.Listener, error) {
+	if fd := os.Getenv(listenFdEnv); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %v", listenFdEnv, fd)
+		}
+		file := os.NewFile(uintptr(n), "management-listener")
+		defer file.Close()
+		return net.FileListener(file)
+	}
+	return net.Listen("tcp", fmt.Sprintf("localhost:%v", port))
+}
+
+// tell the agent that started this one through an upgrade that the management socket is being served
+func (a *Agent) signalUpgradeReady() {
+	fd := os.Getenv(upgradeReadyFdEnv)
+	if fd == "" {
+		return
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		a.logger.Printf("invalid %v: %v", upgradeReadyFdEnv, fd)
+		return
+	}
+	ready := os.NewFile(uintptr(n), "upgrade-ready")
+	ready.Write([]byte("ready"))
+	ready.Close()
+	os.Unsetenv(listenFdEnv)
+	os.Unsetenv(upgradeReadyFdEnv)
+}
+
+// Upgrade hands the managed service over to a new agent started from binary (the running executable if empty),
+// with the same arguments. once the new agent is serving, this agent shuts down and Run returns; the binary
+// embedding the agent is expected to exit then. on error the current agent keeps running
+func (a *Agent) Upgrade(binary string) error {
+	if err := a.upgradeAgent(binary); err != nil {
+		return err
+	}
+	go a.shutdownAfterUpgrade()
+	return nil
+}
+
+func (a *Agent) agentUpgradeHandler(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	if err := a.Upgrade(request.URL.Query().Get("binary")); err != nil {
+		a.logger.Printf("agent upgrade failed, the current agent keeps running: %v", err)
+		writer.WriteHeader(500)
+		writer.Write([]byte(fmt.Sprintf("Error upgrading the agent for managed service [%v] : [%v]", a.config.ServiceAgent.ManagedService.Name, err)))
+		return
+	}
+	writer.WriteHeader(200)
+	writer.Write([]byte(fmt.Sprintf("Agent for managed service [%v] handed over to the upgraded agent", a.config.ServiceAgent.ManagedService.Name)))
+}
+
+// start the new agent binary with the management socket and a readiness pipe, and wait for it to take over
+func (a *Agent) upgradeAgent(binary string) error {
+	a.upgradeLock.Lock()
+	defer a.upgradeLock.Unlock()
+
+	if binary == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		binary = executable
+	}
+	a.mu.Lock()
+	tcpListener, ok := a.listener.(*net.TCPListener)
+	a.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("the management socket can not be handed over")
+	}
+	listenerFile, err := tcpListener.File()
+	if err != nil {
+		return err
+	}
+	defer listenerFile.Close()
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	//make sure the new agent adopts the processes that are running now
+	for _, r := range a.replicaList() {
+		if command := r.managedCommand(); command != nil && command.Process != nil {
+			r.recordManagedProcess(command)
+		}
+	}
+
+	//ExtraFiles start at fd 3
+	command := exec.Command(binary, os.Args[1:]...)
+	command.Env = append(os.Environ(), listenFdEnv+"=3", upgradeReadyFdEnv+"=4")
+	command.ExtraFiles = []*os.File{listenerFile, readyWriter}
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	a.quiesce()
+	err = command.Start()
+	readyWriter.Close()
+	if err != nil {
+		a.resume()
+		return err
+	}
+	a.logger.Printf("started upgraded agent %v with pid %v, waiting for it to take over", binary, command.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, len("ready"))
+		_, err := readyReader.Read(buf)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("timed out after %v", upgradeTimeout)
+	}
+	if err != nil {
+		//the new agent never took over (e.g. it exited on a bad configuration), make sure it is gone
+		command.Process.Kill()
+		command.Wait()
+		a.resume()
+		return fmt.Errorf("upgraded agent %v did not become ready: %v", binary, err)
+	}
+
+	//the old agent exits soon, the new agent is reaped by init
+	go command.Wait()
+	a.handedOver = true
+	return nil
+}
+
+// keep the agent from acting on the managed service on its own while a new agent takes it over: no restart,
+// liveness probe, dependency check, scheduled job run or autoscaling until resume
+func (a *Agent) quiesce() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.resumed == nil {
+		a.resumed = make(chan struct{})
+	}
+}
+
+// take up what quiesce held back, once a handoff failed
+func (a *Agent) resume() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.resumed != nil {
+		close(a.resumed)
+		a.resumed = nil
+	}
+}
+
+// whether the agent is handing the managed service over
+func (a *Agent) quiesced() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.resumed != nil
+}
+
+// wait until the agent is not handing the managed service over. false if it shut down instead
+func (a *Agent) waitResumed() bool {
+	a.mu.Lock()
+	resumed := a.resumed
+	a.mu.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-a.done:
+		return false
+	}
+}
+
+// stop serving (finishing in-flight requests, including the upgrade request itself) without touching the
+// managed process
+func (a *Agent) shutdownAfterUpgrade() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a.logger.Printf("agent for managed service %v handed over to the upgraded agent, shutting down", a.config.ServiceAgent.ManagedService.Name)
+	a.mu.Lock()
+	accepting := a.accepting
+	a.mu.Unlock()
+	if accepting != nil {
+		//the connections accepted already are read before the shutdown
+		if err := accepting.stop(); err != nil {
+			a.logger.Printf("connections to the management port may be dropped by the shutdown: %v", err)
+		}
+		for deadline := time.Now().Add(handoffTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			a.mu.Lock()
+			unread := len(a.unread)
+			a.mu.Unlock()
+			if unread == 0 {
+				break
+			}
+		}
+	}
+	a.Shutdown(ctx)
+}
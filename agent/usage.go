@@ -0,0 +1,240 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/conf"
+	"github.com/aambhaik/tmgcagent/lifecycle"
+	"github.com/aambhaik/tmgcagent/proc"
+	"github.com/julienschmidt/httprouter"
+)
+
+/********************************************************************************************
+	            resource usage of the managed service
+ *******************************************************************************************/
+
+//The agent samples the resource usage of the whole process group of the managed service from /proc whenever it is
+//asked for it: /service/health in JSON and /metrics report it on every request. When usage reporting to the
+//registry is configured the usage is also stored in the registry under <service id>/usage every interval, and
+//appended to the output of its TTL check. Registering the service again to refresh it as service meta would reset
+//its check, and wake every watcher of the service each interval.
+
+var defaultUsageInterval = 30 * time.Second
+
+func validateUsage(usage *conf.UsageReporting) error {
+	if usage == nil {
+		return nil
+	}
+	_, err := parseDuration(usage.Interval, 0)
+	return err
+}
+
+// sample the resource usage of the process group of the replica
+func (r *replica) usage() (*proc.Usage, error) {
+	command := r.managedCommand()
+	if command == nil || command.Process == nil {
+		return nil, fmt.Errorf("the managed service has no process")
+	}
+	pgid, err := syscall.Getpgid(command.Process.Pid)
+	if err != nil {
+		return nil, fmt.Errorf("the managed process %v is gone: %v", command.Process.Pid, err)
+	}
+	return proc.GroupUsage(pgid)
+}
+
+func (a *Agent) reportsUsage() bool {
+	usage := a.config.ServiceAgent.ManagedService.Usage
+	return usage != nil && usage.Registry
+}
+
+// the registry key of the usage of a registration
+func usageKey(serviceId string) string {
+	return serviceId + "/usage"
+}
+
+// the usage of the managed service for the output of its check, empty unless it is reported to the registry
+func (r *replica) usageSummary() string {
+	if !r.reportsUsage() {
+		return ""
+	}
+	usage, err := r.usage()
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("usage: processes=%v children=%v threads=%v cpu-seconds=%.2f rss-bytes=%v open-fds=%v",
+		usage.Processes, usage.Children, usage.Threads, usage.CPUSeconds, usage.RSSBytes, usage.OpenFDs)
+}
+
+// start storing the usage of the registrations of the managed service until the agent shuts down
+func (a *Agent) reportUsageJob() {
+	if !a.reportsUsage() {
+		return
+	}
+	interval, _ := parseDuration(a.config.ServiceAgent.ManagedService.Usage.Interval, defaultUsageInterval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-ticker.C:
+			}
+			for _, r := range a.replicaList() {
+				r.reportUsage()
+			}
+		}
+	}()
+}
+
+// store the current usage of the running replica in the registry
+func (r *replica) reportUsage() {
+	serviceId := r.managedServiceId()
+	if serviceId == "" || r.managedService.Lifecycle.State() != lifecycle.Running {
+		return
+	}
+	usage, err := r.usage()
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return
+	}
+	if err := r.registry.PutKV(usageKey(serviceId), data); err != nil {
+		r.logger.Printf("unable to report the usage of the service %v: %v", serviceId, err)
+	}
+}
+
+// wantsJSON tells whether a request asks for a JSON response, with ?format=json or an Accept header
+func wantsJSON(request *http.Request) bool {
+	return request.URL.Query().Get("format") == "json" || strings.Contains(request.Header.Get("Accept"), "application/json")
+}
+
+// the JSON body of /service/health. the state, health and usage of a service with several replicas are those of
+// all of them, detailed by replica
+type managedServiceHealth struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	State    string      `json:"state"`
+	Healthy  bool        `json:"healthy"`
+	Liveness string      `json:"liveness-error,omitempty"`
+	Port     int         `json:"port,omitempty"`
+	Usage    *proc.Usage `json:"usage,omitempty"`
+	// the output of the check and the last run of a job
+	Output   string          `json:"output,omitempty"`
+	LastRun  *jobRun         `json:"last-run,omitempty"`
+	Replicas []replicaHealth `json:"replicas,omitempty"`
+}
+
+type replicaHealth struct {
+	Replica  int         `json:"replica"`
+	ID       string      `json:"id,omitempty"`
+	State    string      `json:"state"`
+	Healthy  bool        `json:"healthy"`
+	Liveness string      `json:"liveness-error,omitempty"`
+	Port     int         `json:"port,omitempty"`
+	Usage    *proc.Usage `json:"usage,omitempty"`
+}
+
+// whether the replica is running and live
+func (r *replica) healthy() bool {
+	return r.managedService.Lifecycle.State() == lifecycle.Running && r.liveness() == nil
+}
+
+func (r *replica) health() replicaHealth {
+	health := replicaHealth{
+		Replica: r.index,
+		ID:      r.managedServiceId(),
+		State:   string(r.managedService.Lifecycle.State()),
+		Port:    r.port,
+	}
+	livenessErr := r.liveness()
+	health.Healthy = health.State == string(lifecycle.Running) && livenessErr == nil
+	if livenessErr != nil {
+		health.Liveness = livenessErr.Error()
+	}
+	if usage, err := r.usage(); err == nil {
+		health.Usage = usage
+	}
+	return health
+}
+
+func (a *Agent) writeHealthJSON(writer http.ResponseWriter, status int, replicas []*replica) {
+	managedServiceConf := a.config.ServiceAgent.ManagedService
+	health := managedServiceHealth{Name: managedServiceConf.Name, Type: managedServiceConf.Type, Healthy: status == 200}
+	for _, r := range replicas {
+		health.Replicas = append(health.Replicas, r.health())
+	}
+	if len(replicas) == 1 {
+		only := health.Replicas[0]
+		health.State, health.Liveness, health.Port, health.Usage, health.Replicas = only.State, only.Liveness, only.Port, only.Usage, nil
+	} else {
+		//the state shared by the replicas, degraded if they differ
+		health.State = health.Replicas[0].State
+		for _, details := range health.Replicas {
+			if details.State != health.State {
+				health.State = "degraded"
+			}
+			if details.Usage != nil {
+				if health.Usage == nil {
+					health.Usage = &proc.Usage{}
+				}
+				health.Usage.Add(details.Usage)
+			}
+		}
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(health)
+}
+
+// metricsHandler exposes the state and usage of the replicas of the managed service in the Prometheus text format
+func (a *Agent) metricsHandler(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	replicas := a.replicaList()
+	usages := make([]*proc.Usage, len(replicas))
+	for i, r := range replicas {
+		usages[i], _ = r.usage()
+	}
+	var metrics strings.Builder
+	//the usage metrics of a replica without a process are left out
+	metric := func(name, kind, help string, usage bool, value func(i int) interface{}) {
+		header := false
+		for i, r := range replicas {
+			if usage && usages[i] == nil {
+				continue
+			}
+			if !header {
+				fmt.Fprintf(&metrics, "# HELP tmgc_managed_service_%v %v\n", name, help)
+				fmt.Fprintf(&metrics, "# TYPE tmgc_managed_service_%v %v\n", name, kind)
+				header = true
+			}
+			fmt.Fprintf(&metrics, "tmgc_managed_service_%v{service=%q,replica=\"%v\"} %v\n", name, r.managedService.Name, r.index, value(i))
+		}
+	}
+
+	metric("up", "gauge", "Whether the replica of the managed service is running and live.", false, func(i int) interface{} {
+		if replicas[i].healthy() {
+			return 1
+		}
+		return 0
+	})
+	metric("cpu_seconds_total", "counter", "CPU time spent by the processes of the managed service.", true, func(i int) interface{} {
+		return strconv.FormatFloat(usages[i].CPUSeconds, 'f', -1, 64)
+	})
+	metric("memory_rss_bytes", "gauge", "Resident memory of the processes of the managed service.", true, func(i int) interface{} { return usages[i].RSSBytes })
+	metric("open_fds", "gauge", "Open file descriptors of the processes of the managed service.", true, func(i int) interface{} { return usages[i].OpenFDs })
+	metric("threads", "gauge", "Threads of the processes of the managed service.", true, func(i int) interface{} { return usages[i].Threads })
+	metric("processes", "gauge", "Processes of the managed service, its children included.", true, func(i int) interface{} { return usages[i].Processes })
+	metric("children", "gauge", "Child processes of the managed service.", true, func(i int) interface{} { return usages[i].Children })
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writer.Write([]byte(metrics.String()))
+}
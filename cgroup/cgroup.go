@@ -0,0 +1,149 @@
+// Package cgroup manages a cgroup v2 of the unified hierarchy for the managed process, limiting its memory, CPU
+// and number of processes, and reports the OOM kills in it.
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Root is the mount point of the unified hierarchy, a variable so that tests can point it elsewhere
+var Root = "/sys/fs/cgroup"
+
+// period of the CPU quota, in microseconds
+const cpuPeriod = 100000
+
+// Limits of a cgroup. zero values leave the corresponding limit unset
+type Limits struct {
+	// MemoryMax in bytes
+	MemoryMax int64
+	// CPUWeight from 1 to 10000, 100 being the default share
+	CPUWeight int
+	// CPUQuota in percent of one CPU, 200 allowing two full CPUs
+	CPUQuota int
+	// PidsMax is the maximum number of processes and threads
+	PidsMax int64
+}
+
+// Group is a cgroup
+type Group struct {
+	path string
+}
+
+// Available reports whether the unified (v2) hierarchy is mounted at Root
+func Available() bool {
+	_, err := os.Stat(filepath.Join(Root, "cgroup.controllers"))
+	return err == nil
+}
+
+// Create creates the cgroup <Root>/<parent>/<name>, or reuses it, enabling the controllers the limits need on the
+// way down, and applies the limits
+func Create(parent, name string, limits Limits) (*Group, error) {
+	var controllers []string
+	if limits.MemoryMax > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if limits.CPUWeight > 0 || limits.CPUQuota > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	if limits.PidsMax > 0 {
+		controllers = append(controllers, "+pids")
+	}
+
+	//a cgroup can only limit its children with the controllers enabled in the subtree_control of its parent
+	dir := Root
+	for _, element := range strings.Split(filepath.Join(parent, name), string(filepath.Separator)) {
+		if element == "" {
+			continue
+		}
+		if len(controllers) > 0 {
+			if err := write(dir, "cgroup.subtree_control", strings.Join(controllers, " ")); err != nil {
+				return nil, err
+			}
+		}
+		dir = filepath.Join(dir, element)
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+
+	g := &Group{path: dir}
+	//limits removed from the configuration are reset to their defaults, the cgroup is reused across restarts
+	settings := []struct {
+		file, value string
+		set         bool
+	}{
+		{"memory.max", strconv.FormatInt(limits.MemoryMax, 10), limits.MemoryMax > 0},
+		{"cpu.weight", strconv.Itoa(limits.CPUWeight), limits.CPUWeight > 0},
+		{"cpu.max", fmt.Sprintf("%v %v", limits.CPUQuota*cpuPeriod/100, cpuPeriod), limits.CPUQuota > 0},
+		{"pids.max", strconv.FormatInt(limits.PidsMax, 10), limits.PidsMax > 0},
+	}
+	defaults := map[string]string{"memory.max": "max", "cpu.weight": "100", "cpu.max": fmt.Sprintf("max %v", cpuPeriod), "pids.max": "max"}
+	for _, setting := range settings {
+		value := setting.value
+		if !setting.set {
+			if _, err := os.Stat(filepath.Join(dir, setting.file)); err != nil {
+				//controller not enabled, nothing to reset
+				continue
+			}
+			value = defaults[setting.file]
+		}
+		if err := write(dir, setting.file, value); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Path of the cgroup directory
+func (g *Group) Path() string {
+	return g.path
+}
+
+// Cloneable reports whether processes can be started directly in the cgroup, which it must be on the cgroup2 file
+// system for
+func (g *Group) Cloneable() bool {
+	var stat unix.Statfs_t
+	return unix.Statfs(g.path, &stat) == nil && stat.Type == unix.CGROUP2_SUPER_MAGIC
+}
+
+// Open returns the cgroup directory, to start a process in it through SysProcAttr.CgroupFD
+func (g *Group) Open() (*os.File, error) {
+	return os.Open(g.path)
+}
+
+// AddProcess moves a running process into the cgroup
+func (g *Group) AddProcess(pid int) error {
+	return write(g.path, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// OOMKills returns the number of processes of the cgroup killed by the OOM killer so far
+func (g *Group) OOMKills() (uint64, error) {
+	file, err := os.Open(filepath.Join(g.path, "memory.events"))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, scanner.Err()
+}
+
+func write(dir, file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("unable to set %v of cgroup %v to %v: %v", file, dir, value, err)
+	}
+	return nil
+}
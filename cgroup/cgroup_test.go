@@ -0,0 +1,79 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeRoot points Root at a directory of plain files standing in for the cgroup filesystem
+func fakeRoot(t *testing.T) string {
+	previous := Root
+	Root = t.TempDir()
+	t.Cleanup(func() { Root = previous })
+	ioutil.WriteFile(filepath.Join(Root, "cgroup.controllers"), []byte("cpu memory pids"), 0644)
+	return Root
+}
+
+func read(t *testing.T, path ...string) string {
+	value, err := ioutil.ReadFile(filepath.Join(path...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(value)
+}
+
+func TestCreate(t *testing.T) {
+	root := fakeRoot(t)
+	if !Available() {
+		t.Fatal("expected the fake hierarchy to be available")
+	}
+
+	g, err := Create("tmgc", "Rolex", Limits{MemoryMax: 64 << 20, CPUWeight: 50, CPUQuota: 150, PidsMax: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Path() != filepath.Join(root, "tmgc", "Rolex") {
+		t.Errorf("unexpected cgroup path %v", g.Path())
+	}
+	if g.Cloneable() {
+		t.Error("expected a cgroup of plain files not to be cloneable")
+	}
+	for _, dir := range []string{root, filepath.Join(root, "tmgc")} {
+		if got := read(t, dir, "cgroup.subtree_control"); got != "+memory +cpu +pids" {
+			t.Errorf("unexpected controllers enabled in %v: %v", dir, got)
+		}
+	}
+	expected := map[string]string{"memory.max": "67108864", "cpu.weight": "50", "cpu.max": "150000 100000", "pids.max": "32"}
+	for file, value := range expected {
+		if got := read(t, g.Path(), file); got != value {
+			t.Errorf("%v is %v, expected %v", file, got, value)
+		}
+	}
+
+	//limits dropped from the configuration are reset when the cgroup is reused
+	if _, err := Create("tmgc", "Rolex", Limits{PidsMax: 16}); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, g.Path(), "memory.max"); got != "max" {
+		t.Errorf("memory.max is %v, expected it to be reset", got)
+	}
+}
+
+func TestOOMKills(t *testing.T) {
+	fakeRoot(t)
+	g, err := Create("", "Rolex", Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(g.Path(), "memory.events"), []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"), 0644)
+	if kills, err := g.OOMKills(); err != nil || kills != 1 {
+		t.Errorf("expected 1 OOM kill, got %v (%v)", kills, err)
+	}
+
+	os.Remove(filepath.Join(g.Path(), "memory.events"))
+	if _, err := g.OOMKills(); err == nil {
+		t.Error("expected an error without memory.events")
+	}
+}
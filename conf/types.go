@@ -1,6 +1,10 @@
 package conf
 
-import "os/exec"
+import (
+	"os/exec"
+
+	"github.com/aambhaik/tmgcagent/lifecycle"
+)
 
 type TMGCAgentConfig1 struct {
 	ServiceAgent struct {
@@ -37,6 +41,9 @@ type TMGCAgentConfig struct {
 		ServiceDiscovery struct {
 			Type string `json:"type"`
 			URL  string `json:"url"`
+			// DNSServer is the host:port of the DNS server used for srv-name dependencies, e.g. the Consul DNS
+			// interface on 127.0.0.1:8600. the system resolver configuration is used if empty
+			DNSServer string `json:"dns-server,omitempty"`
 		} `json:"service-discovery"`
 		ManagedService struct {
 			Description string `json:"description"`
@@ -45,21 +52,327 @@ type TMGCAgentConfig struct {
 				Args []string `json:"args"`
 				Exec string   `json:"exec"`
 				Type string   `json:"type"`
+				// Limits on the resources of the managed process
+				Limits *Limits `json:"limits,omitempty"`
+				// Sandbox isolates the managed process from the agent and the host
+				Sandbox *Sandbox `json:"sandbox,omitempty"`
 			} `json:"process"`
-			ServiceDependency []struct {
-				EndpointMapping     string `json:"endpoint-mapping"`
-				ServiceName         string `json:"service-name"`
-				ServiceType         string `json:"service-type"`
-				Skip                bool   `json:"skip,omitempty"`
-				UnavailablityImpact string `json:"unavailablity-impact"`
-				MinInstances        int    `json:"min-instances,omitempty"`
-			} `json:"service-dependency"`
-			Type string `json:"type"`
+			ServiceDependency []ServiceDependency `json:"service-dependency"`
+			Type              string              `json:"type"`
+			// Readiness delays the registration of a started managed service until it is ready
+			Readiness *Readiness `json:"readiness,omitempty"`
+			// Liveness probes the running managed service, its result is reported through a TTL check
+			Liveness *Liveness `json:"liveness,omitempty"`
+			// Restart restarts the managed service when it crashes or fails its liveness probes
+			Restart *RestartPolicy `json:"restart,omitempty"`
+			// Usage reports the resource usage of the managed service to the registry
+			Usage *UsageReporting `json:"usage,omitempty"`
+			// Hooks are commands run by the agent around the lifecycle transitions of the managed service
+			Hooks *Hooks `json:"hooks,omitempty"`
+			// Job makes the managed service a job the agent runs on a schedule, instead of a long running service
+			Job *Job `json:"job,omitempty"`
+			// Replicas is the number of processes of the managed service the agent runs, 1 if zero
+			Replicas int `json:"replicas,omitempty"`
+			// Ports are allocated by the agent, one per replica, and passed to the processes
+			Ports *Ports `json:"ports,omitempty"`
+			// Autoscale has the agent adjust the number of replicas to an observed signal
+			Autoscale *Autoscale `json:"autoscale,omitempty"`
+			// DependencyGroups apply the unavailability impact to dependencies together, when too few of them are
+			// available
+			DependencyGroups []DependencyGroup `json:"dependency-groups,omitempty"`
 		} `json:"managed-service"`
 		DependencyCheckInterval string `json:"dependency-check-interval"`
 	} `json:"service-agent"`
 }
 
+type ServiceDependency struct {
+	EndpointMapping     string `json:"endpoint-mapping"`
+	ServiceName         string `json:"service-name"`
+	ServiceType         string `json:"service-type"`
+	Skip                bool   `json:"skip,omitempty"`
+	UnavailablityImpact string `json:"unavailablity-impact"`
+	// MinInstances is the number of passing instances below which the lookup fails over to the next of the
+	// Datacenters, 1 if zero
+	MinInstances int `json:"min-instances,omitempty"`
+	// SRVName resolves the dependency through a DNS SRV record (e.g. _timer._tcp.service.consul) instead of the registry
+	SRVName string `json:"srv-name,omitempty"`
+	// TaggedAddress selects which address of the dependency instances to call: lan, wan or ipv6 (or a raw consul
+	// tagged address key). the instance address is used if empty
+	TaggedAddress string `json:"tagged-address,omitempty"`
+	// Proxy gives the managed process a local endpoint the agent forwards to the passing instances, instead of
+	// the endpoints of the instances
+	Proxy *DependencyProxy `json:"proxy,omitempty"`
+	// Probe has the agent probe every endpoint of the dependency itself, and leave the failing and the slow ones out
+	Probe *EndpointProbe `json:"probe,omitempty"`
+	// Select orders the passing instances of the dependency by locality and weight, and limits their number
+	Select *DependencySelector `json:"select,omitempty"`
+	// Datacenter to look the dependency up in, the datacenter of the local agent of the registry if empty
+	Datacenter string `json:"datacenter,omitempty"`
+	// Datacenters to look the dependency up in, in order: the first with min-instances passing instances is used
+	Datacenters []string `json:"datacenters,omitempty"`
+	// PreparedQuery resolves the dependency through the named prepared query of the registry instead of its service
+	// name and type, executed in each of the Datacenters if any
+	PreparedQuery string `json:"prepared-query,omitempty"`
+	// Fallback lists the alternatives tried in order when no instance of the dependency passes, before the
+	// unavailability impact applies
+	Fallback []DependencyFallback `json:"fallback,omitempty"`
+	// Group names the dependency group the dependency belongs to, whose unavailability impact applies instead of
+	// its own
+	Group string `json:"group,omitempty"`
+}
+
+// DependencyGroup is a set of dependencies that are available together: all of them, any of them or a quorum
+type DependencyGroup struct {
+	Name string `json:"name"`
+	// Require is all (every member available, by default), any (at least one) or quorum
+	Require string `json:"require,omitempty"`
+	// Quorum is the number of available members the quorum requires, a majority of the members if zero
+	Quorum int `json:"quorum,omitempty"`
+	// UnavailablityImpact applies when the group is unavailable, as for a dependency
+	UnavailablityImpact string `json:"unavailablity-impact"`
+}
+
+// DependencyFallback is an alternative to a dependency. the fields left empty are those of the dependency, and
+// fallbacks are always looked up in the registry by service name and type
+type DependencyFallback struct {
+	ServiceName string `json:"service-name,omitempty"`
+	ServiceType string `json:"service-type,omitempty"`
+	Datacenter  string `json:"datacenter,omitempty"`
+}
+
+// DependencySelector orders and narrows down the passing instances of a dependency
+type DependencySelector struct {
+	// Prefer lists localities, the instances of the first one coming first: same-node, same-datacenter (those
+	// of the local agent of the registry), zone:<zone> (the zone meta or tag of the instance) or tag:<tag>
+	Prefer []string `json:"prefer,omitempty"`
+	// Strict leaves out the instances matching none of the preferences, unless none matches any
+	Strict bool `json:"strict,omitempty"`
+	// Order of the instances of the same locality: registry (the order of the registry, by default), weight (the
+	// highest weight first) or shuffle (a shuffle weighted by the weights, the same every time for a seed)
+	Order string `json:"order,omitempty"`
+	// Seed of the shuffle, the host name and the name of the managed service by default
+	Seed string `json:"seed,omitempty"`
+	// Limit is the number of instances given to the managed service, all if zero
+	Limit int `json:"limit,omitempty"`
+}
+
+// EndpointProbe is a probe the agent runs against every resolved endpoint of a dependency, ejecting the outliers from
+// the endpoints given to the managed service
+type EndpointProbe struct {
+	// Type is http (by default), a GET of Path on the endpoint URL passing with a 2xx or 3xx status, or tcp, a
+	// connection to the endpoint address
+	Type string `json:"type,omitempty"`
+	Path string `json:"path,omitempty"`
+	// Interval between the probes, 10s by default, and Timeout of a probe, 2s by default
+	Interval string `json:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+	// Failures consecutive failed probes eject an endpoint (3 by default), Successes consecutive passed probes
+	// readmit it (2 by default)
+	Failures  int `json:"failures,omitempty"`
+	Successes int `json:"successes,omitempty"`
+	// MaxLatency ejects the endpoints whose average latency over their recent probes is above it
+	MaxLatency string `json:"max-latency,omitempty"`
+	// LatencyFactor ejects the endpoints whose average latency is above the median of the endpoints times the
+	// factor. it needs at least 3 endpoints
+	LatencyFactor float64 `json:"latency-factor,omitempty"`
+	// MaxEjectedPercent of the endpoints can be ejected at once, 50 by default. one endpoint is always left
+	MaxEjectedPercent int `json:"max-ejected-percent,omitempty"`
+}
+
+// DependencyProxy is a local port on 127.0.0.1 the agent listens on for a dependency, balancing what it accepts
+// over the passing instances of the dependency
+type DependencyProxy struct {
+	// Mode is http (by default), forwarding requests, or tcp, forwarding connections
+	Mode string `json:"mode,omitempty"`
+	// Port to listen on. if zero a free port is allocated, and kept across restarts and upgrades of the agent
+	Port int `json:"port,omitempty"`
+	// Balancing is round-robin (by default) or least-connections
+	Balancing string `json:"balancing,omitempty"`
+	// Retries is the number of other instances tried after a failed attempt
+	Retries int `json:"retries,omitempty"`
+	// EjectAfter consecutive failures (3 by default) take an instance out of the balancing for EjectFor (30s by default)
+	EjectAfter int    `json:"eject-after,omitempty"`
+	EjectFor   string `json:"eject-for,omitempty"`
+	// RefreshInterval is how often the passing instances are looked up, 5s by default
+	RefreshInterval string `json:"refresh-interval,omitempty"`
+}
+
+// Limits are the rlimits of the managed process and, where cgroup v2 is available, the limits of the cgroup
+// the agent creates for it
+type Limits struct {
+	// OpenFiles is RLIMIT_NOFILE
+	OpenFiles uint64 `json:"open-files,omitempty"`
+	// CoreSize is RLIMIT_CORE in bytes, 0 disables core dumps
+	CoreSize *uint64 `json:"core-size,omitempty"`
+	// Processes is RLIMIT_NPROC, which counts all processes of the user, those of the agent included unless the
+	// sandbox runs the managed process as another user
+	Processes uint64 `json:"processes,omitempty"`
+
+	// MemoryMax is memory.max, in bytes or with a K, M, G or T suffix
+	MemoryMax string `json:"memory-max,omitempty"`
+	// CPUWeight is cpu.weight, from 1 to 10000 (100 being the default share)
+	CPUWeight int `json:"cpu-weight,omitempty"`
+	// CPUQuota is cpu.max as a percentage of one CPU, e.g. 150%
+	CPUQuota string `json:"cpu-quota,omitempty"`
+	// PidsMax is pids.max
+	PidsMax int64 `json:"pids-max,omitempty"`
+	// CgroupParent is the cgroup, relative to the root of the hierarchy, under which the cgroup of the managed
+	// service is created, tmgc if empty
+	CgroupParent string `json:"cgroup-parent,omitempty"`
+}
+
+// Sandbox runs the managed process in its own namespaces, with a restricted view of the file system and without the
+// privileges of the agent. all of it needs the agent to run as root
+type Sandbox struct {
+	// User and Group (names or ids) the process runs as, without supplementary groups. Group defaults to the
+	// primary group of User
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Namespaces the process gets: mount, pid, ipc and uts. pid implies mount, and makes the managed binary pid 1 of
+	// its namespace, which must reap the orphaned processes in it
+	Namespaces []string `json:"namespaces,omitempty"`
+	// PrivateTmp gives the process an empty /tmp of its own
+	PrivateTmp bool `json:"private-tmp,omitempty"`
+	// ReadOnlyPaths are made read-only for the process, "/" the whole root file system
+	ReadOnlyPaths []string `json:"read-only-paths,omitempty"`
+	// WritablePaths stay writable below the read-only paths
+	WritablePaths []string `json:"writable-paths,omitempty"`
+	// NoNewPrivileges keeps the process from gaining privileges through setuid binaries or file capabilities
+	NoNewPrivileges bool `json:"no-new-privileges,omitempty"`
+}
+
+// Readiness lists the probes that must all succeed before the managed service is registered
+type Readiness struct {
+	Probes []Probe `json:"probes"`
+	// Interval between attempts, 1s if empty
+	Interval string `json:"interval,omitempty"`
+	// StartupTimeout is how long the managed service has to become ready before its start is failed, 60s if empty
+	StartupTimeout string `json:"startup-timeout,omitempty"`
+}
+
+// Liveness lists the probes run periodically against the running managed service. the service is unhealthy once
+// a probe failed failure-threshold times in a row
+type Liveness struct {
+	Probes []Probe `json:"probes"`
+	// Interval between rounds of probes, 10s if empty
+	Interval string `json:"interval,omitempty"`
+	// FailureThreshold is the number of consecutive failures that make the service unhealthy, 3 if zero
+	FailureThreshold int `json:"failure-threshold,omitempty"`
+}
+
+// RestartPolicy decides whether a crashed managed service is started again: never (the default), on-failure
+// (after a non-zero exit, a signal or failed liveness probes) or always (after any exit the agent did not ask for)
+type RestartPolicy struct {
+	Policy string `json:"policy"`
+	// Backoff is the delay before the first restart, 1s if empty. it doubles with every crash up to MaxBackoff
+	Backoff string `json:"backoff,omitempty"`
+	// MaxBackoff caps the delay, 1m if empty. a service that ran for longer than MaxBackoff restarts after Backoff again
+	MaxBackoff string `json:"max-backoff,omitempty"`
+}
+
+// UsageReporting stores the resource usage of the managed service in the registry under <service id>/usage and
+// appends it to the output of its TTL check. /service/health and /metrics report the usage regardless
+type UsageReporting struct {
+	Registry bool `json:"registry"`
+	// Interval between updates of the stored usage, 30s if empty
+	Interval string `json:"interval,omitempty"`
+}
+
+// Hooks lists the commands run for each lifecycle event of the managed service, in order
+type Hooks struct {
+	// PreStart hooks run before the process is started, e.g. migrations
+	PreStart []Hook `json:"pre-start,omitempty"`
+	// PostStart hooks run once the process is ready, before the service is running and registered
+	PostStart []Hook `json:"post-start,omitempty"`
+	// PreStop hooks run before the agent kills the process
+	PreStop []Hook `json:"pre-stop,omitempty"`
+	// PostStop hooks run after the process stopped, before the service is reported as stopped
+	PostStop []Hook `json:"post-stop,omitempty"`
+	// OnCrash hooks run when the process exited without the agent asking it to, or failed its liveness probes
+	OnCrash []Hook `json:"on-crash,omitempty"`
+}
+
+// Hook is a command run by the agent, with the TMGC_* environment describing the event
+type Hook struct {
+	Command []string `json:"command"`
+	// Timeout after which the process group of the hook is killed, 30s if empty
+	Timeout string `json:"timeout,omitempty"`
+	// OnFailure is abort (the default: skip the remaining hooks of the event and fail a start) or continue
+	OnFailure string `json:"on-failure,omitempty"`
+}
+
+// Job runs the managed process to completion on a cron schedule
+type Job struct {
+	// Schedule in the format of robfig/cron: six fields starting with the seconds, or a descriptor such as @hourly
+	// or @every 10m
+	Schedule string `json:"schedule"`
+	// Timeout after which a run is killed, none if empty
+	Timeout string `json:"timeout,omitempty"`
+	// Concurrency decides what happens when a run is due while the previous one is still active: forbid (the
+	// default, the new run is skipped), allow (both run) or replace (the active run is killed)
+	Concurrency string `json:"concurrency,omitempty"`
+	// History is the number of runs kept, 20 if zero
+	History int `json:"history,omitempty"`
+}
+
+// Ports has the agent allocate a free port for each replica of the managed service, which registers the replica on
+// it. {{port}} and {{replica}} (the index of the replica, from 0) in the arguments, the environment and the probes
+// are replaced by those of the replica
+type Ports struct {
+	// Range the ports are allocated from, e.g. 31000-31999. any free port if empty
+	Range string `json:"range,omitempty"`
+	// Args are appended to the arguments of the process, e.g. ["-port", "{{port}}"]
+	Args []string `json:"args,omitempty"`
+	// Env are NAME=value variables added to the environment of the process, e.g. PORT={{port}}
+	Env []string `json:"env,omitempty"`
+}
+
+// Autoscale scales the replicas of the managed service between Min and Max so that the signal per replica stays at
+// Target: the number of replicas becomes the signal of all replicas divided by the target, rounded up
+type Autoscale struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+	// Signal is cpu (the CPU used per replica, in CPUs), metric (a metric scraped from each replica) or
+	// dependencies (the passing instances of the dependencies, the same for all replicas)
+	Signal string  `json:"signal"`
+	Target float64 `json:"target"`
+	// Metric scraped for the metric signal
+	Metric *ScrapedMetric `json:"metric,omitempty"`
+	// Interval between evaluations, 30s if empty
+	Interval string `json:"interval,omitempty"`
+	// ScaleUpCooldown and ScaleDownCooldown are how long after the last scaling the replicas are not scaled up,
+	// respectively down, 1m and 5m if empty
+	ScaleUpCooldown   string `json:"scale-up-cooldown,omitempty"`
+	ScaleDownCooldown string `json:"scale-down-cooldown,omitempty"`
+	// History is the number of scaling decisions kept, 50 if zero
+	History int `json:"history,omitempty"`
+}
+
+// ScrapedMetric is a metric the managed service exposes in the Prometheus text format. the values of all its
+// samples are added up. it must be a gauge, such as the requests in flight: counters (_total, _count, _sum and
+// _bucket) only grow and are rejected
+type ScrapedMetric struct {
+	// URL of the metrics of a replica, e.g. http://127.0.0.1:{{port}}/metrics
+	URL  string `json:"url"`
+	Name string `json:"name"`
+}
+
+// Probe checks the managed service. the fields used depend on the type:
+// http (url, answering 2xx or 3xx), tcp (address accepting connections), exec (command exiting with 0),
+// grpc (address of a gRPC health service reporting service as SERVING), log (pattern matching a line of path, by
+// default the output of the managed process) or file (path existing)
+type Probe struct {
+	Type    string   `json:"type"`
+	URL     string   `json:"url,omitempty"`
+	Address string   `json:"address,omitempty"`
+	Service string   `json:"service,omitempty"`
+	Command []string `json:"command,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	// Timeout of a single attempt, 1s if empty
+	Timeout string `json:"timeout,omitempty"`
+}
+
 //type TMGCAgentConfig struct {
 //	ServiceAgent struct {
 //		DependencyCheckInterval string `yaml:"dependency-check-interval"`
@@ -98,4 +411,5 @@ type ManagedServiceInstance struct {
 	ServiceId string
 	Exec      string
 	Config    *TMGCAgentConfig
+	Lifecycle *lifecycle.Machine
 }
@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/gob"
+	"github.com/aambhaik/tmgcagent/discovery"
 	consul "github.com/hashicorp/consul/api"
 	"io"
 	"log"
@@ -13,20 +14,15 @@ import (
 	"time"
 )
 
-//Client provides an interface for getting data out of Consul
-type Client interface {
-	// Get a Service from consul
-	Service(string, string) ([]string, error)
-	// Register a service with local agent
-	Register(string, int) error
-	// Deregister a service with local agent
-	DeRegister(string) error
-}
-
+// ConsulClient is the Consul backed implementation of the discovery.Registry
 type ConsulClient struct {
 	consul *consul.Client
 }
 
+var _ discovery.Registry = (*ConsulClient)(nil)
+var _ discovery.Locator = (*ConsulClient)(nil)
+var _ discovery.Querier = (*ConsulClient)(nil)
+
 //NewConsul returns a Client interface for given consul address
 func NewConsulClient(addr string) (*ConsulClient, error) {
 	config := consul.DefaultConfig()
@@ -39,56 +35,143 @@ func NewConsulClient(addr string) (*ConsulClient, error) {
 }
 
 // Register a service with consul local agent
-func (c *ConsulClient) Register(id *string, name string, host string, port int, serviceType string) (sid *string, err error) {
-	var serviceId string
-	if id == nil {
+func (c *ConsulClient) Register(r *discovery.Registration) (string, error) {
+	serviceId := r.ID
+	if serviceId == "" {
 		uniqueId, err := newUUID()
 		if err != nil {
-			return nil, err
+			return "", err
 		}
-		serviceId = name + "-" + serviceType + "-" + uniqueId
-	} else {
-		serviceId = *id
+		serviceId = r.Name + "-" + r.Type + "-" + uniqueId
 	}
 
+	tags := append([]string{r.Type, time.Now().Format("Jan 02 15:04:05.000 MST")}, r.Tags...)
 	reg := &consul.AgentServiceRegistration{
 		ID:      serviceId,
-		Name:    name,
-		Address: host,
-		Port:    port,
-		Tags:    []string{serviceType, time.Now().Format("Jan 02 15:04:05.000 MST")},
+		Name:    r.Name,
+		Address: r.Address,
+		Port:    r.Port,
+		Tags:    tags,
+		Meta:    r.Meta,
 		Check: &consul.AgentServiceCheck{
-			HTTP:     "http://" + host + ":" + strconv.Itoa(port) + "/ping",
+			HTTP:     "http://" + r.Address + ":" + strconv.Itoa(r.Port) + "/ping",
 			Interval: "10s",
 			Timeout:  "1s",
 			Notes:    "Basic ping checks",
 		},
 	}
-	return &serviceId, c.consul.Agent().ServiceRegister(reg)
+	if r.CheckTTL > 0 {
+		//the agent probes the service itself and reports the result, registered services are ready so start as passing
+		reg.Check = &consul.AgentServiceCheck{
+			CheckID: checkId(serviceId),
+			TTL:     r.CheckTTL.String(),
+			Status:  consul.HealthPassing,
+			Notes:   "Liveness probes run by the service agent",
+		}
+	}
+	return serviceId, c.consul.Agent().ServiceRegister(reg)
+}
+
+// UpdateHealth sets the status of the TTL check of a service registered with a CheckTTL
+func (c *ConsulClient) UpdateHealth(id, status, output string) error {
+	return c.consul.Agent().UpdateTTL(checkId(id), output, status)
+}
+
+// id of the TTL check of a service, the id consul gives to the check of a service registration by default
+func checkId(serviceId string) string {
+	return "service:" + serviceId
 }
 
-// DeRegister a service with consul local agent
-func (c *ConsulClient) DeRegister(id string) error {
+// Deregister a service with consul local agent
+func (c *ConsulClient) Deregister(id string) error {
 	return c.consul.Agent().ServiceDeregister(id)
 }
 
-// Service return a service
-func (c *ConsulClient) Service(service, tag string) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+// Lookup the passing instances of a service
+func (c *ConsulClient) Lookup(service, tag string, opts *discovery.QueryOptions) ([]*discovery.Instance, error) {
 	passingOnly := true
-	addrs, meta, err := c.consul.Health().Service(service, tag, passingOnly, nil)
+	addrs, _, err := c.consul.Health().Service(service, tag, passingOnly, queryOptions(opts))
 	if len(addrs) == 0 && err == nil {
 		log.Printf("service ( %s ) was not found", service)
-		return nil, nil, fmt.Errorf("service ( %s ) was not found", service)
+		return nil, fmt.Errorf("service ( %s ) was not found", service)
 	}
 	if err != nil {
 		log.Printf("Unexpected error ( %v ) in accessing the service", err)
-		return nil, nil, err
+		return nil, err
+	}
+	return toInstances(addrs), nil
+}
+
+// Watch blocks on the consul health endpoint until the passing instances of a service change
+func (c *ConsulClient) Watch(service, tag string, opts *discovery.QueryOptions) ([]*discovery.Instance, uint64, error) {
+	passingOnly := true
+	addrs, meta, err := c.consul.Health().Service(service, tag, passingOnly, queryOptions(opts))
+	if err != nil {
+		return nil, 0, err
+	}
+	return toInstances(addrs), meta.LastIndex, nil
+}
+
+// Locality returns the node name and the datacenter of the consul local agent
+func (c *ConsulClient) Locality() (discovery.Locality, error) {
+	self, err := c.consul.Agent().Self()
+	if err != nil {
+		return discovery.Locality{}, err
 	}
-	return addrs, meta, nil
+	node, _ := self["Config"]["NodeName"].(string)
+	datacenter, _ := self["Config"]["Datacenter"].(string)
+	return discovery.Locality{Node: node, Datacenter: datacenter}, nil
+}
+
+// Query executes a prepared query, whose own failover policy may answer from another datacenter
+func (c *ConsulClient) Query(name, datacenter string) ([]*discovery.Instance, error) {
+	response, _, err := c.consul.PreparedQuery().Execute(name, &consul.QueryOptions{Datacenter: datacenter})
+	if err != nil {
+		log.Printf("Unexpected error ( %v ) in executing the prepared query", err)
+		return nil, err
+	}
+	if len(response.Nodes) == 0 {
+		log.Printf("prepared query ( %s ) found no instance", name)
+		return nil, fmt.Errorf("prepared query ( %s ) found no instance", name)
+	}
+	entries := make([]*consul.ServiceEntry, len(response.Nodes))
+	for i := range response.Nodes {
+		entries[i] = &response.Nodes[i]
+	}
+	instances := toInstances(entries)
+	for _, instance := range instances {
+		if instance.Datacenter == "" {
+			instance.Datacenter = response.Datacenter
+		}
+	}
+	return instances, nil
+}
+
+// LocalServices returns the instances of a service registered with the consul local agent
+func (c *ConsulClient) LocalServices(name string) ([]*discovery.Instance, error) {
+	services, err := c.consul.Agent().Services()
+	if err != nil {
+		return nil, err
+	}
+	var instances []*discovery.Instance
+	for _, service := range services {
+		if service.Service != name {
+			continue
+		}
+		instances = append(instances, &discovery.Instance{
+			ID:      service.ID,
+			Name:    service.Service,
+			Address: service.Address,
+			Port:    service.Port,
+			Tags:    service.Tags,
+			Meta:    service.Meta,
+		})
+	}
+	return instances, nil
 }
 
 // Attach key-value metadata to a service
-func (c *ConsulClient) AddMetadata(key string, value []byte) error {
+func (c *ConsulClient) PutKV(key string, value []byte) error {
 	d := consul.KVPair{Key: key, Value: value}
 	_, err := c.consul.KV().Put(&d, nil)
 	if err != nil {
@@ -98,6 +181,49 @@ func (c *ConsulClient) AddMetadata(key string, value []byte) error {
 	return nil
 }
 
+// Remove the key-value metadata of a service
+func (c *ConsulClient) DeleteKV(key string) error {
+	_, err := c.consul.KV().Delete(key, nil)
+	return err
+}
+
+func queryOptions(opts *discovery.QueryOptions) *consul.QueryOptions {
+	if opts == nil {
+		return nil
+	}
+	return &consul.QueryOptions{
+		Datacenter: opts.Datacenter,
+		WaitIndex:  opts.WaitIndex,
+		WaitTime:   opts.WaitTime,
+	}
+}
+
+func toInstances(entries []*consul.ServiceEntry) []*discovery.Instance {
+	instances := make([]*discovery.Instance, 0, len(entries))
+	for _, entry := range entries {
+		instance := &discovery.Instance{
+			ID:      entry.Service.ID,
+			Name:    entry.Service.Service,
+			Address: entry.Service.Address,
+			Port:    entry.Service.Port,
+			Tags:    entry.Service.Tags,
+			Meta:    entry.Service.Meta,
+		}
+		if entry.Node != nil {
+			instance.Node, instance.Datacenter = entry.Node.Node, entry.Node.Datacenter
+		}
+		instance.Weight = entry.Service.Weights.Passing
+		if len(entry.Service.TaggedAddresses) > 0 {
+			instance.TaggedAddresses = make(map[string]discovery.TaggedAddress)
+			for key, address := range entry.Service.TaggedAddresses {
+				instance.TaggedAddresses[key] = discovery.TaggedAddress{Address: address.Address, Port: address.Port}
+			}
+		}
+		instances = append(instances, instance)
+	}
+	return instances
+}
+
 /**
 Utility functions
 */
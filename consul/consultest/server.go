@@ -0,0 +1,443 @@
+// Package consultest provides an in-process fake of the subset of the Consul HTTP API used by the consul package,
+// so that the agent can be exercised end-to-end by go test without a Consul server.
+package consultest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	// NodeName and Datacenter are those of the fake agent, where services are registered unless AddServiceOn says
+	// otherwise
+	NodeName   = "consultest"
+	Datacenter = "dc1"
+
+	maxWaitTime = 10 * time.Second
+)
+
+// Server is a fake Consul agent serving the agent service, health service, prepared query and KV endpoints from memory
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	services map[string]*service
+	order    []string
+	kv       map[string][]byte
+	queries  map[string]consul.PreparedQueryDefinition
+	index    uint64
+	changed  chan struct{}
+}
+
+type service struct {
+	registration consul.AgentServiceRegistration
+	status       string
+	node         string
+	datacenter   string
+}
+
+// NewServer starts a fake Consul agent. callers must Close it when done
+func NewServer() *Server {
+	s := &Server{
+		services: make(map[string]*service),
+		kv:       make(map[string][]byte),
+		queries:  make(map[string]consul.PreparedQueryDefinition),
+		index:    1,
+		changed:  make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/service/register", s.handleRegister)
+	mux.HandleFunc("/v1/agent/service/deregister/", s.handleDeregister)
+	mux.HandleFunc("/v1/agent/services", s.handleAgentServices)
+	mux.HandleFunc("/v1/agent/self", s.handleAgentSelf)
+	mux.HandleFunc("/v1/health/service/", s.handleHealthService)
+	mux.HandleFunc("/v1/agent/check/update/", s.handleCheckUpdate)
+	mux.HandleFunc("/v1/kv/", s.handleKV)
+	mux.HandleFunc("/v1/query/", s.handleQueryExecute)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Addr returns the host:port of the fake, suitable for the service-discovery url
+func (s *Server) Addr() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// AddService registers a passing service instance directly, as if another agent had registered it
+func (s *Server) AddService(reg *consul.AgentServiceRegistration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(*reg)
+}
+
+// AddServiceOn registers a passing service instance on another node, in the given datacenter. as with consul, the
+// health endpoint only returns the instances of the datacenter queried, the local one by default
+func (s *Server) AddServiceOn(node, datacenter string, reg *consul.AgentServiceRegistration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(*reg)
+	s.services[reg.ID].node, s.services[reg.ID].datacenter = node, datacenter
+}
+
+// AddQuery creates a prepared query, executed by its name
+func (s *Server) AddQuery(query consul.PreparedQueryDefinition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries[query.Name] = query
+}
+
+// SetStatus changes the health status (passing, warning, critical) of a registered service instance
+func (s *Server) SetStatus(id, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if svc, ok := s.services[id]; ok {
+		svc.status = status
+		s.notify()
+	}
+}
+
+// RemoveService drops a service instance, as if it had been deregistered elsewhere
+func (s *Server) RemoveService(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+}
+
+// Status returns the health status of a service instance
+func (s *Server) Status(id string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if svc, ok := s.services[id]; ok {
+		return svc.status
+	}
+	return ""
+}
+
+// Service returns the registration of a service instance and whether it exists
+func (s *Server) Service(id string) (consul.AgentServiceRegistration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	svc, ok := s.services[id]
+	if !ok {
+		return consul.AgentServiceRegistration{}, false
+	}
+	return svc.registration, true
+}
+
+// Services returns the registrations of all instances of the named service
+func (s *Server) Services(name string) []consul.AgentServiceRegistration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var regs []consul.AgentServiceRegistration
+	for _, id := range s.order {
+		if svc := s.services[id]; svc.registration.Name == name {
+			regs = append(regs, svc.registration)
+		}
+	}
+	return regs
+}
+
+// KV returns the value stored under key and whether it exists
+func (s *Server) KV(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.kv[key]
+	return value, ok
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var reg consul.AgentServiceRegistration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reg.ID == "" {
+		reg.ID = reg.Name
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(reg)
+}
+
+func (s *Server) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.services[id]; !ok {
+		http.Error(w, "Unknown service ID "+id, http.StatusNotFound)
+		return
+	}
+	s.remove(id)
+}
+
+// handleCheckUpdate updates the status of the TTL check of a service, the check id being service:<service id>
+func (s *Server) handleCheckUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/agent/check/update/"), "service:")
+	var update struct {
+		Status string
+		Output string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	svc, ok := s.services[id]
+	if !ok {
+		http.Error(w, "Unknown check ID service:"+id, http.StatusNotFound)
+		return
+	}
+	if svc.status != update.Status {
+		svc.status = update.Status
+		s.notify()
+	}
+}
+
+func (s *Server) handleAgentServices(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	services := make(map[string]*consul.AgentService)
+	for id, svc := range s.services {
+		services[id] = svc.entry().Service
+	}
+	s.writeJSON(w, services)
+}
+
+func (s *Server) handleAgentSelf(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeJSON(w, map[string]map[string]interface{}{"Config": {"NodeName": NodeName, "Datacenter": Datacenter}})
+}
+
+func (s *Server) handleHealthService(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	query := r.URL.Query()
+	tags := query["tag"]
+	_, passingOnly := query["passing"]
+	datacenter := query.Get("dc")
+	if datacenter == "" {
+		datacenter = Datacenter
+	}
+
+	s.wait(query)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeJSON(w, s.entries(name, datacenter, tags, passingOnly))
+}
+
+// handleQueryExecute executes a prepared query: the passing instances of its service in the datacenter queried,
+// or else in the first of its failover datacenters that has any
+func (s *Server) handleQueryExecute(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/query/"), "/execute")
+	datacenter := r.URL.Query().Get("dc")
+	if datacenter == "" {
+		datacenter = Datacenter
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query, ok := s.queries[name]
+	if !ok {
+		http.Error(w, "Query not found", http.StatusNotFound)
+		return
+	}
+	response := consul.PreparedQueryExecuteResponse{Service: query.Service.Service, Nodes: []consul.ServiceEntry{}, Datacenter: datacenter}
+	for i, candidate := range append([]string{datacenter}, query.Service.Failover.Datacenters...) {
+		entries := s.entries(query.Service.Service, candidate, query.Service.Tags, true)
+		if len(entries) == 0 {
+			continue
+		}
+		for _, entry := range entries {
+			response.Nodes = append(response.Nodes, *entry)
+		}
+		response.Datacenter, response.Failovers = candidate, i
+		break
+	}
+	s.writeJSON(w, response)
+}
+
+// entries returns the health entries of the instances of a service in a datacenter. callers must hold s.mu
+func (s *Server) entries(name, datacenter string, tags []string, passingOnly bool) []*consul.ServiceEntry {
+	entries := []*consul.ServiceEntry{}
+	for _, id := range s.order {
+		svc := s.services[id]
+		if svc.registration.Name != name || svc.datacenter != datacenter || !hasTags(svc.registration.Tags, tags) {
+			continue
+		}
+		if passingOnly && svc.status != consul.HealthPassing {
+			continue
+		}
+		entries = append(entries, svc.entry())
+	}
+	return entries
+}
+
+func (s *Server) handleKV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.kv[key] = value
+		s.notify()
+		s.writeJSON(w, true)
+	case http.MethodGet:
+		value, ok := s.kv[key]
+		if !ok {
+			w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.writeJSON(w, []*consul.KVPair{{Key: key, Value: value}})
+	case http.MethodDelete:
+		delete(s.kv, key)
+		s.notify()
+		s.writeJSON(w, true)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// wait implements blocking queries: it returns once the index moves past the requested one or the wait time elapses
+func (s *Server) wait(query url.Values) {
+	index, err := strconv.ParseUint(query.Get("index"), 10, 64)
+	if err != nil || index == 0 {
+		return
+	}
+	waitTime := maxWaitTime
+	if wait, err := time.ParseDuration(query.Get("wait")); err == nil && wait < waitTime {
+		waitTime = wait
+	}
+
+	timeout := time.NewTimer(waitTime)
+	defer timeout.Stop()
+	for {
+		s.mu.Lock()
+		current, changed := s.index, s.changed
+		s.mu.Unlock()
+		if current > index {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+// put stores a registration as passing. callers must hold s.mu
+func (s *Server) put(reg consul.AgentServiceRegistration) {
+	if _, ok := s.services[reg.ID]; !ok {
+		s.order = append(s.order, reg.ID)
+	}
+	s.services[reg.ID] = &service{registration: reg, status: consul.HealthPassing, node: NodeName, datacenter: Datacenter}
+	s.notify()
+}
+
+// remove drops a registration. callers must hold s.mu
+func (s *Server) remove(id string) {
+	delete(s.services, id)
+	for i, existing := range s.order {
+		if existing == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	s.notify()
+}
+
+// notify bumps the index and wakes up blocking queries. callers must hold s.mu
+func (s *Server) notify() {
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// writeJSON writes a response along with the query meta headers the consul api client expects. callers must hold s.mu
+func (s *Server) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (svc *service) entry() *consul.ServiceEntry {
+	reg := svc.registration
+	weights := consul.AgentWeights{Passing: 1, Warning: 1}
+	if reg.Weights != nil {
+		weights = *reg.Weights
+	}
+	return &consul.ServiceEntry{
+		Node: &consul.Node{Node: svc.node, Address: "127.0.0.1", Datacenter: svc.datacenter},
+		Service: &consul.AgentService{
+			ID:      reg.ID,
+			Service: reg.Name,
+			Tags:    reg.Tags,
+			Meta:    reg.Meta,
+			Address: reg.Address,
+			Port:    reg.Port,
+			Weights: weights,
+
+			TaggedAddresses: reg.TaggedAddresses,
+		},
+		Checks: consul.HealthChecks{{
+			Node:        svc.node,
+			CheckID:     "service:" + reg.ID,
+			Name:        "Service '" + reg.Name + "' check",
+			Status:      svc.status,
+			ServiceID:   reg.ID,
+			ServiceName: reg.Name,
+		}},
+	}
+}
+
+func hasTags(tags []string, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, t := range tags {
+			if t == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
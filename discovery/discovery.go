@@ -0,0 +1,92 @@
+package discovery
+
+import "time"
+
+// Registry is the contract between the agent and a service-discovery backend. The agent only ever talks to the
+// registry through this interface; the concrete backend is chosen by the service-discovery type in the configuration.
+type Registry interface {
+	// Register a service instance. if reg.ID is empty the backend mints a new id, which is returned
+	Register(reg *Registration) (string, error)
+	// Deregister a service instance by id
+	Deregister(id string) error
+	// Lookup the healthy instances of a service carrying the given tag
+	Lookup(name, tag string, opts *QueryOptions) ([]*Instance, error)
+	// Watch blocks until the healthy instances of a service change (or the backend wait time elapses) and
+	// returns the current instances along with an index to pass to the next Watch call
+	Watch(name, tag string, opts *QueryOptions) ([]*Instance, uint64, error)
+	// LocalServices returns every instance of the named service registered on the local node, healthy or not
+	LocalServices(name string) ([]*Instance, error)
+	// PutKV stores a key/value pair in the registry
+	PutKV(key string, value []byte) error
+	// DeleteKV removes a key from the registry
+	DeleteKV(key string) error
+	// UpdateHealth sets the status (HealthPassing, HealthWarning or HealthCritical) of the TTL check of an instance
+	// registered with a CheckTTL, output describing why
+	UpdateHealth(id, status, output string) error
+}
+
+// Health statuses of an instance
+const (
+	HealthPassing  = "passing"
+	HealthWarning  = "warning"
+	HealthCritical = "critical"
+)
+
+// Registration describes a service instance announced by the agent
+type Registration struct {
+	ID      string
+	Name    string
+	Type    string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+	// CheckTTL registers the instance with a TTL check that the agent keeps passing through UpdateHealth, instead
+	// of the backend probing it. the check turns critical if it isn't updated within the TTL
+	CheckTTL time.Duration
+}
+
+// Instance is a service instance as seen through the registry
+type Instance struct {
+	ID         string
+	Name       string
+	Node       string
+	Datacenter string
+	Address    string
+	Port       int
+	Tags       []string
+	Meta       map[string]string
+	// TaggedAddresses are the alternative addresses of the instance keyed by lan, wan, lan_ipv6 etc.
+	TaggedAddresses map[string]TaggedAddress
+	// Weight of the passing instance in the registry (the consul Weights), 0 if the registry has none
+	Weight int
+}
+
+// Locator is implemented by the registries that know where the agent runs
+type Locator interface {
+	// Locality returns the node and the datacenter of the local agent of the registry
+	Locality() (Locality, error)
+}
+
+// Querier is implemented by the registries that resolve named queries, such as the consul prepared queries
+type Querier interface {
+	// Query the healthy instances selected by the named query, executed in the given datacenter (the backend's
+	// local datacenter if empty). the datacenter of the instances tells where the query found them
+	Query(name, datacenter string) ([]*Instance, error)
+}
+
+// Locality is where an agent of the registry runs
+type Locality struct {
+	Node       string
+	Datacenter string
+}
+
+// QueryOptions narrows or blocks a lookup
+type QueryOptions struct {
+	// Datacenter to query, the backend's local datacenter if empty
+	Datacenter string
+	// WaitIndex is the index returned by a previous Watch call
+	WaitIndex uint64
+	// WaitTime bounds how long a Watch call may block
+	WaitTime time.Duration
+}
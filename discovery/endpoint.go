@@ -0,0 +1,125 @@
+package discovery
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// service meta keys describing how to call an instance. each key can also be given as a "key:value" tag, which is
+// how older registrations (and the route:/proto: tags) describe endpoints
+const (
+	MetaScheme        = "scheme"
+	MetaPath          = "path"
+	MetaTLSServerName = "tls-server-name"
+	MetaWeight        = "weight"
+	// MetaZone is the zone the instance runs in, for the locality preferences of the dependencies
+	MetaZone = "zone"
+
+	defaultScheme = "http"
+	defaultWeight = 1
+)
+
+// tagged address selectors for a dependency. lan, wan and ipv6 prefer the address family specific consul keys
+// (lan_ipv4, wan_ipv4, lan_ipv6, wan_ipv6) and fall back on the generic ones
+var taggedAddressFallbacks = map[string][]string{
+	"lan":  {"lan_ipv4", "lan"},
+	"wan":  {"wan_ipv4", "wan"},
+	"ipv6": {"lan_ipv6", "wan_ipv6"},
+}
+
+// ValidTaggedAddresses are the tagged-address values a dependency may select
+var ValidTaggedAddresses = []string{"", "lan", "wan", "ipv6", "lan_ipv4", "wan_ipv4", "lan_ipv6", "wan_ipv6"}
+
+// TaggedAddress is an alternative address of an instance, e.g. its wan or ipv6 address
+type TaggedAddress struct {
+	Address string
+	Port    int
+}
+
+// Endpoint is the callable address of a dependency instance
+type Endpoint struct {
+	URL           string
+	TLSServerName string
+	Weight        int
+	Instance      *Instance
+}
+
+// Endpoint builds the callable endpoint of the instance. taggedAddress selects one of the instance's tagged
+// addresses (see ValidTaggedAddresses), the instance address is used if it is empty or the instance has no such
+// address. scheme, path, tls-server-name and weight come from the service meta, then from tags, then defaults. the
+// weight falls back on the weight of the instance in the registry before its default.
+func (i *Instance) Endpoint(taggedAddress string) Endpoint {
+	host, port := i.Address, i.Port
+	if tagged, ok := i.taggedAddress(taggedAddress); ok {
+		host = tagged.Address
+		if tagged.Port != 0 {
+			port = tagged.Port
+		}
+	}
+	if host == "" {
+		host = "localhost"
+	}
+
+	scheme := i.value(MetaScheme, "proto")
+	if scheme == "" {
+		scheme = defaultScheme
+	}
+	path := i.value(MetaPath, "route")
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	weight, err := strconv.Atoi(i.value(MetaWeight))
+	if err != nil || weight <= 0 {
+		weight = i.Weight
+	}
+	if weight <= 0 {
+		weight = defaultWeight
+	}
+
+	return Endpoint{
+		URL:           scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port)) + path,
+		TLSServerName: i.value(MetaTLSServerName),
+		Weight:        weight,
+		Instance:      i,
+	}
+}
+
+// Zone returns the zone of the instance from its service meta or its zone: tag, empty if it has none
+func (i *Instance) Zone() string {
+	return i.value(MetaZone)
+}
+
+func (i *Instance) taggedAddress(selector string) (TaggedAddress, bool) {
+	if selector == "" {
+		return TaggedAddress{}, false
+	}
+	keys, ok := taggedAddressFallbacks[selector]
+	if !ok {
+		keys = []string{selector}
+	}
+	for _, key := range keys {
+		if tagged, ok := i.TaggedAddresses[key]; ok && tagged.Address != "" {
+			return tagged, true
+		}
+	}
+	return TaggedAddress{}, false
+}
+
+// value returns the meta value for key (or an alias), or else the value of the first "key:" (or "alias:") tag
+func (i *Instance) value(key string, aliases ...string) string {
+	names := append([]string{key}, aliases...)
+	for _, name := range names {
+		if v := i.Meta[name]; v != "" {
+			return v
+		}
+	}
+	for _, name := range names {
+		for _, tag := range i.Tags {
+			if strings.HasPrefix(tag, name+":") {
+				return tag[len(name)+1:]
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package discovery
+
+import "testing"
+
+func TestEndpoint(t *testing.T) {
+	tagged := map[string]TaggedAddress{
+		"lan_ipv4": {Address: "10.0.0.5", Port: 9980},
+		"wan_ipv4": {Address: "203.0.113.5", Port: 19980},
+		"lan_ipv6": {Address: "fd00::5", Port: 9980},
+	}
+	tests := []struct {
+		name          string
+		instance      Instance
+		taggedAddress string
+		want          Endpoint
+	}{
+		{
+			name:     "tags",
+			instance: Instance{Address: "timer.local", Port: 9980, Tags: []string{"Timer", "proto:https", "route:/time"}},
+			want:     Endpoint{URL: "https://timer.local:9980/time", Weight: 1},
+		},
+		{
+			name:     "defaults",
+			instance: Instance{Port: 9980},
+			want:     Endpoint{URL: "http://localhost:9980", Weight: 1},
+		},
+		{
+			name: "meta over tags",
+			instance: Instance{
+				Address: "timer.local",
+				Port:    9980,
+				Tags:    []string{"proto:http", "route:/old"},
+				Meta:    map[string]string{"scheme": "https", "path": "time", "tls-server-name": "timer.example.com", "weight": "5"},
+			},
+			want: Endpoint{URL: "https://timer.local:9980/time", TLSServerName: "timer.example.com", Weight: 5},
+		},
+		{
+			name:     "registry weight",
+			instance: Instance{Address: "timer.local", Port: 9980, Weight: 3},
+			want:     Endpoint{URL: "http://timer.local:9980", Weight: 3},
+		},
+		{
+			name:          "wan address",
+			instance:      Instance{Address: "10.0.0.5", Port: 9980, TaggedAddresses: tagged},
+			taggedAddress: "wan",
+			want:          Endpoint{URL: "http://203.0.113.5:19980", Weight: 1},
+		},
+		{
+			name:          "ipv6 address",
+			instance:      Instance{Address: "10.0.0.5", Port: 9980, TaggedAddresses: tagged},
+			taggedAddress: "ipv6",
+			want:          Endpoint{URL: "http://[fd00::5]:9980", Weight: 1},
+		},
+		{
+			name:          "missing tagged address",
+			instance:      Instance{Address: "10.0.0.5", Port: 9980},
+			taggedAddress: "wan",
+			want:          Endpoint{URL: "http://10.0.0.5:9980", Weight: 1},
+		},
+	}
+	for _, test := range tests {
+		got := test.instance.Endpoint(test.taggedAddress)
+		got.Instance = nil
+		if got != test.want {
+			t.Errorf("%v: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
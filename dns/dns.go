@@ -0,0 +1,293 @@
+// Package dns resolves dependency endpoints from DNS SRV records, caching answers for as long as their TTL allows.
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultServer = "127.0.0.1:53"
+	resolvConf    = "/etc/resolv.conf"
+	queryTimeout  = 2 * time.Second
+	maxUDPSize    = 4096
+	minCacheTTL   = time.Second
+	negativeTTL   = 5 * time.Second
+)
+
+// Target is a single endpoint of an SRV record
+type Target struct {
+	// Host is the SRV target with the trailing dot removed
+	Host string
+	// Address is the A/AAAA record for the target from the additional section, if the server supplied one
+	Address  string
+	Port     int
+	Priority uint16
+	Weight   uint16
+}
+
+// Resolver queries a DNS server directly so that record TTLs are known, and caches answers until they expire
+type Resolver struct {
+	server string
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cache map[cacheKey]*cacheEntry
+}
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+type cacheEntry struct {
+	expires time.Time
+	targets []Target
+	txt     []string
+	err     error
+}
+
+// NewResolver returns a resolver querying server (host:port). if server is empty the first nameserver from
+// /etc/resolv.conf is used
+func NewResolver(server string) *Resolver {
+	if server == "" {
+		server = systemNameserver()
+	}
+	return &Resolver{
+		server: server,
+		now:    time.Now,
+		cache:  make(map[cacheKey]*cacheEntry),
+	}
+}
+
+// LookupSRV returns the targets of the SRV record name, ordered by priority
+func (r *Resolver) LookupSRV(name string) ([]Target, error) {
+	entry, err := r.lookup(name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	return entry.targets, nil
+}
+
+// LookupTXT returns the TXT strings published for name. a name without TXT records is not an error
+func (r *Resolver) LookupTXT(name string) ([]string, error) {
+	entry, err := r.lookup(name, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	return entry.txt, nil
+}
+
+// lookup serves an answer from the cache while its TTL holds, and re-resolves it once it expires
+func (r *Resolver) lookup(name string, qtype dnsmessage.Type) (*cacheEntry, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	key := cacheKey{name: strings.ToLower(name), qtype: qtype}
+
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && r.now().Before(entry.expires) {
+		return entry, entry.err
+	}
+
+	entry = r.query(name, qtype)
+	r.mu.Lock()
+	r.cache[key] = entry
+	r.mu.Unlock()
+	return entry, entry.err
+}
+
+func (r *Resolver) query(name string, qtype dnsmessage.Type) *cacheEntry {
+	msg, err := r.exchange(name, qtype)
+	if err != nil {
+		//don't cache transport errors, the next lookup should retry
+		return &cacheEntry{expires: r.now(), err: err}
+	}
+	if msg.RCode == dnsmessage.RCodeNameError {
+		return &cacheEntry{expires: r.now().Add(negativeTTL), err: fmt.Errorf("dns name %v does not exist", name)}
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		return &cacheEntry{expires: r.now(), err: fmt.Errorf("dns query for %v failed: %v", name, msg.RCode)}
+	}
+
+	addresses := make(map[string]string)
+	for _, rr := range msg.Additionals {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addresses[strings.ToLower(rr.Header.Name.String())] = net.IP(body.A[:]).String()
+		case *dnsmessage.AAAAResource:
+			if _, ok := addresses[strings.ToLower(rr.Header.Name.String())]; !ok {
+				addresses[strings.ToLower(rr.Header.Name.String())] = net.IP(body.AAAA[:]).String()
+			}
+		}
+	}
+
+	entry := &cacheEntry{}
+	var ttl uint32
+	first := true
+	for _, rr := range msg.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.SRVResource:
+			target := body.Target.String()
+			entry.targets = append(entry.targets, Target{
+				Host:     strings.TrimSuffix(target, "."),
+				Address:  addresses[strings.ToLower(target)],
+				Port:     int(body.Port),
+				Priority: body.Priority,
+				Weight:   body.Weight,
+			})
+		case *dnsmessage.TXTResource:
+			entry.txt = append(entry.txt, body.TXT...)
+		default:
+			continue
+		}
+		if first || rr.Header.TTL < ttl {
+			ttl, first = rr.Header.TTL, false
+		}
+	}
+	if qtype == dnsmessage.TypeSRV && len(entry.targets) == 0 {
+		entry.err = fmt.Errorf("no SRV records found for %v", name)
+		entry.expires = r.now().Add(negativeTTL)
+		return entry
+	}
+	sortByPriority(entry.targets)
+
+	cacheTTL := time.Duration(ttl) * time.Second
+	if first {
+		cacheTTL = negativeTTL
+	} else if cacheTTL < minCacheTTL {
+		cacheTTL = minCacheTTL
+	}
+	entry.expires = r.now().Add(cacheTTL)
+	return entry
+}
+
+// exchange sends the query over UDP and retries over TCP if the answer was truncated
+func (r *Resolver) exchange(name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	query.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := r.exchangeUDP(packed)
+	if err == nil && msg.Truncated {
+		msg, err = r.exchangeTCP(packed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dns query for %v against %v failed: %v", name, r.server, err)
+	}
+	if msg.ID != id {
+		return nil, fmt.Errorf("dns query for %v against %v returned a mismatched id", name, r.server)
+	}
+	return msg, nil
+}
+
+func (r *Resolver) exchangeUDP(packed []byte) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout("udp", r.server, queryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(queryTimeout))
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (r *Resolver) exchangeTCP(packed []byte) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout("tcp", r.server, queryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(queryTimeout))
+	framed := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(framed, uint16(len(packed)))
+	copy(framed[2:], packed)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// sortByPriority orders targets by ascending priority and, within a priority, by descending weight
+func sortByPriority(targets []Target) {
+	for i := 1; i < len(targets); i++ {
+		for j := i; j > 0 && less(targets[j], targets[j-1]); j-- {
+			targets[j], targets[j-1] = targets[j-1], targets[j]
+		}
+	}
+}
+
+func less(a, b Target) bool {
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	return a.Weight > b.Weight
+}
+
+// systemNameserver returns the first nameserver from resolv.conf
+func systemNameserver() string {
+	file, err := os.Open(resolvConf)
+	if err != nil {
+		return defaultServer
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], strconv.Itoa(53))
+		}
+	}
+	return defaultServer
+}
@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serve answers SRV and TXT queries for _timer._tcp.service.consul. with the given ttl, counting the queries
+func serve(t *testing.T, ttl uint32, queries *int32) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			question := query.Questions[0]
+			header := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+			target := dnsmessage.MustNewName("timer1.node.dc1.consul.")
+			reply := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true},
+				Questions: query.Questions,
+			}
+			switch question.Type {
+			case dnsmessage.TypeSRV:
+				reply.Answers = []dnsmessage.Resource{
+					{Header: header, Body: &dnsmessage.SRVResource{Priority: 2, Weight: 1, Port: 9981, Target: dnsmessage.MustNewName("timer2.node.dc1.consul.")}},
+					{Header: header, Body: &dnsmessage.SRVResource{Priority: 1, Weight: 1, Port: 9980, Target: target}},
+				}
+				reply.Additionals = []dnsmessage.Resource{
+					{Header: dnsmessage.ResourceHeader{Name: target, Class: dnsmessage.ClassINET, TTL: ttl}, Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}},
+				}
+			case dnsmessage.TypeTXT:
+				reply.Answers = []dnsmessage.Resource{
+					{Header: header, Body: &dnsmessage.TXTResource{TXT: []string{"proto=http", "route=/time"}}},
+				}
+			}
+			packed, _ := reply.Pack()
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestLookupSRV(t *testing.T) {
+	var queries int32
+	r := NewResolver(serve(t, 60, &queries))
+
+	targets, err := r.LookupSRV("_timer._tcp.service.consul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %v", targets)
+	}
+	if targets[0].Host != "timer1.node.dc1.consul" || targets[0].Address != "10.0.0.1" || targets[0].Port != 9980 {
+		t.Errorf("unexpected first target: %+v", targets[0])
+	}
+	if targets[1].Address != "" || targets[1].Port != 9981 {
+		t.Errorf("unexpected second target: %+v", targets[1])
+	}
+
+	txt, err := r.LookupTXT("_timer._tcp.service.consul")
+	if err != nil || len(txt) != 2 || txt[1] != "route=/time" {
+		t.Errorf("unexpected TXT records: %v, %v", txt, err)
+	}
+}
+
+func TestTTLReResolution(t *testing.T) {
+	var queries int32
+	r := NewResolver(serve(t, 30, &queries))
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.LookupSRV("_timer._tcp.service.consul"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("expected the answer to be cached within its TTL, got %v queries", n)
+	}
+
+	now = now.Add(31 * time.Second)
+	if _, err := r.LookupSRV("_timer._tcp.service.consul"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("expected the record to be re-resolved after its TTL, got %v queries", n)
+	}
+}
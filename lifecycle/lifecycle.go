@@ -0,0 +1,137 @@
+// Package lifecycle tracks the state of a managed service through an explicit, concurrency-safe state machine.
+package lifecycle
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State is a lifecycle state of the managed service
+type State string
+
+const (
+	// Pending is the initial state, before the agent first starts the service
+	Pending State = "pending"
+	// Starting means the process is being started
+	Starting State = "starting"
+	// Running means the process is up
+	Running State = "running"
+	// Suspended means the process is paused (SIGSTOP) while a dependency is unavailable
+	Suspended State = "suspended"
+	// Stopping means the agent is stopping the process
+	Stopping State = "stopping"
+	// Stopped means the process was stopped by the agent
+	Stopped State = "stopped"
+	// Crashed means the process exited without the agent stopping it, or failed to start
+	Crashed State = "crashed"
+	// Backoff means the agent is waiting before restarting a crashed process
+	Backoff State = "backoff"
+)
+
+// transitions lists the states each state may move to
+var transitions = map[State][]State{
+	Pending:   {Starting, Stopped},
+	Starting:  {Running, Stopping, Crashed},
+	Running:   {Suspended, Stopping, Crashed},
+	Suspended: {Running, Stopping, Crashed},
+	Stopping:  {Stopped, Crashed},
+	Stopped:   {Starting},
+	Crashed:   {Starting, Backoff, Stopped},
+	Backoff:   {Starting, Stopped},
+}
+
+const defaultHistorySize = 100
+
+// Event records a transition
+type Event struct {
+	Time   time.Time `json:"time"`
+	From   State     `json:"from"`
+	To     State     `json:"to"`
+	Reason string    `json:"reason"`
+}
+
+// Machine is the state machine of one managed service. all methods are safe for concurrent use
+type Machine struct {
+	mu          sync.Mutex
+	state       State
+	history     []Event
+	historySize int
+	now         func() time.Time
+}
+
+// NewMachine returns a machine in the Pending state. events are timestamped with now, time.Now if it is nil
+func NewMachine(now func() time.Time) *Machine {
+	if now == nil {
+		now = time.Now
+	}
+	return &Machine{state: Pending, historySize: defaultHistorySize, now: now}
+}
+
+// State returns the current state
+func (m *Machine) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Is reports whether the current state is one of states
+func (m *Machine) Is(states ...State) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range states {
+		if m.state == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the machine to state to, failing if the move is not allowed from the current state. because
+// the check and the move happen atomically, concurrent callers racing for the same transition (e.g. two start
+// requests) see exactly one of them succeed
+func (m *Machine) Transition(to State, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.transition(to, reason)
+}
+
+// TransitionFrom moves the machine to state to only if it is currently in one of the from states
+func (m *Machine) TransitionFrom(from []State, to State, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range from {
+		if m.state == s {
+			return m.transition(to, reason)
+		}
+	}
+	return fmt.Errorf("can not move to %v while %v", to, m.state)
+}
+
+func (m *Machine) transition(to State, reason string) error {
+	if !allowed(m.state, to) {
+		return fmt.Errorf("can not move to %v while %v", to, m.state)
+	}
+	m.history = append(m.history, Event{Time: m.now(), From: m.state, To: to, Reason: reason})
+	if len(m.history) > m.historySize {
+		m.history = m.history[len(m.history)-m.historySize:]
+	}
+	m.state = to
+	return nil
+}
+
+// History returns the recorded transitions, oldest first
+func (m *Machine) History() []Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Event(nil), m.history...)
+}
+
+func allowed(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package lifecycle
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var states = []State{Pending, Starting, Running, Suspended, Stopping, Stopped, Crashed, Backoff}
+
+// a machine already in state
+func machineIn(state State) *Machine {
+	m := NewMachine(nil)
+	m.state = state
+	return m
+}
+
+func TestTransitions(t *testing.T) {
+	tests := []struct {
+		from  State
+		legal []State
+	}{
+		{Pending, []State{Starting, Stopped}},
+		{Starting, []State{Running, Stopping, Crashed}},
+		{Running, []State{Suspended, Stopping, Crashed}},
+		{Suspended, []State{Running, Stopping, Crashed}},
+		{Stopping, []State{Stopped, Crashed}},
+		{Stopped, []State{Starting}},
+		{Crashed, []State{Starting, Backoff, Stopped}},
+		{Backoff, []State{Starting, Stopped}},
+	}
+	for _, test := range tests {
+		legal := map[State]bool{}
+		for _, s := range test.legal {
+			legal[s] = true
+		}
+		for _, to := range states {
+			m := machineIn(test.from)
+			err := m.Transition(to, "test")
+			switch {
+			case legal[to] && err != nil:
+				t.Errorf("expected %v -> %v to be allowed: %v", test.from, to, err)
+			case !legal[to] && err == nil:
+				t.Errorf("expected %v -> %v to be refused", test.from, to)
+			}
+			want := test.from
+			if legal[to] {
+				want = to
+			}
+			if m.State() != want {
+				t.Errorf("%v -> %v: expected the machine to be %v, it is %v", test.from, to, want, m.State())
+			}
+			if history := m.History(); len(history) != 0 != legal[to] {
+				t.Errorf("%v -> %v: unexpected history %+v", test.from, to, history)
+			}
+		}
+	}
+}
+
+func TestTransitionFrom(t *testing.T) {
+	tests := []struct {
+		name  string
+		state State
+		from  []State
+		to    State
+		moved bool
+	}{
+		{"in from", Crashed, []State{Crashed, Backoff}, Starting, true},
+		{"not in from", Running, []State{Crashed, Backoff}, Starting, false},
+		{"in from, not allowed", Backoff, []State{Backoff}, Running, false},
+		{"no from", Stopped, nil, Starting, false},
+	}
+	for _, test := range tests {
+		m := machineIn(test.state)
+		err := m.TransitionFrom(test.from, test.to, "test")
+		if (err == nil) != test.moved {
+			t.Errorf("%v: expected moved=%v, got %v", test.name, test.moved, err)
+		}
+		if moved := m.Is(test.to); moved != test.moved {
+			t.Errorf("%v: expected moved=%v, the machine is %v", test.name, test.moved, m.State())
+		}
+	}
+}
+
+func TestTransitionFromContention(t *testing.T) {
+	//of the callers racing to start a stopped service, exactly one wins
+	for round := 0; round < 50; round++ {
+		m := machineIn(Stopped)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		won := 0
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if m.TransitionFrom([]State{Stopped, Crashed, Backoff}, Starting, "start") == nil {
+					mu.Lock()
+					won++
+					mu.Unlock()
+				}
+				m.State()
+				m.History()
+			}()
+		}
+		wg.Wait()
+		if won != 1 || !m.Is(Starting) || len(m.History()) != 1 {
+			t.Fatalf("expected exactly one caller to start the service, %v did, history %+v", won, m.History())
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := NewMachine(func() time.Time { return now })
+	m.Transition(Starting, "start")
+	if history := m.History(); len(history) != 1 ||
+		history[0] != (Event{Time: now, From: Pending, To: Starting, Reason: "start"}) {
+		t.Fatalf("unexpected history %+v", history)
+	}
+
+	//the history keeps the last 100 events, oldest first
+	for i := 0; i < 50; i++ {
+		for _, to := range []State{Running, Crashed, Starting} {
+			if err := m.Transition(to, strconv.Itoa(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	history := m.History()
+	if len(history) != defaultHistorySize {
+		t.Fatalf("expected the history to be capped at %v events, got %v", defaultHistorySize, len(history))
+	}
+	if first, last := history[0], history[len(history)-1]; first != (Event{Time: now, From: Crashed, To: Starting, Reason: "16"}) ||
+		last != (Event{Time: now, From: Crashed, To: Starting, Reason: "49"}) {
+		t.Errorf("expected the oldest events to be dropped, got %+v to %+v", first, last)
+	}
+
+	//the history returned is a copy
+	history[0].Reason = "changed"
+	if m.History()[0].Reason == "changed" {
+		t.Error("expected the history to be copied")
+	}
+}
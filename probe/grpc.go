@@ -0,0 +1,108 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// GRPC passes when the standard gRPC health service (grpc.health.v1.Health/Check) at Address reports Service,
+// the whole server if empty, as SERVING. the server is called over plaintext HTTP/2
+type GRPC struct {
+	Address string
+	Service string
+}
+
+// status SERVING of grpc.health.v1.HealthCheckResponse
+const grpcServing = 1
+
+// h2c transport shared by the gRPC probes
+var grpcTransport = &http2.Transport{
+	AllowHTTP: true,
+	DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	},
+}
+
+func (p *GRPC) Check(ctx context.Context) error {
+	//HealthCheckRequest{service = 1}, in a gRPC length prefixed message
+	var message []byte
+	if p.Service != "" {
+		message = append([]byte{0x0a}, binary.AppendUvarint(nil, uint64(len(p.Service)))...)
+		message = append(message, p.Service...)
+	}
+	body := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(message)))
+	body = append(body, message...)
+
+	request, err := http.NewRequestWithContext(ctx, "POST", "http://"+p.Address+"/grpc.health.v1.Health/Check", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+	response, err := grpcTransport.RoundTrip(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	reply, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	//errors come as a grpc-status trailer, or in the headers of a response without a body
+	status := response.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = response.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		return fmt.Errorf("health check of %v failed with grpc status %v: %v", p.Address, status, response.Trailer.Get("Grpc-Message")+response.Header.Get("Grpc-Message"))
+	}
+	if len(reply) < 5 || int(binary.BigEndian.Uint32(reply[1:5])) != len(reply)-5 {
+		return fmt.Errorf("invalid health check response from %v", p.Address)
+	}
+	if serving := healthStatus(reply[5:]); serving != grpcServing {
+		return fmt.Errorf("%v reports serving status %v", p.Address, serving)
+	}
+	return nil
+}
+
+// the status field (1, varint) of a HealthCheckResponse, 0 (UNKNOWN) if absent
+func healthStatus(message []byte) uint64 {
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0
+		}
+		message = message[n:]
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(message)
+			if n <= 0 {
+				return 0
+			}
+			if key>>3 == 1 {
+				return value
+			}
+			message = message[n:]
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				return 0
+			}
+			message = message[n+int(length):]
+		default:
+			return 0
+		}
+	}
+	return 0
+}
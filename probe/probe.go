@@ -0,0 +1,154 @@
+// Package probe checks whether a managed service is up: by an HTTP request, a TCP connection, a command, a line
+// in its log or the existence of a file.
+package probe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync"
+)
+
+// Probe is a single check. Check returns nil when the check passes
+type Probe interface {
+	Check(ctx context.Context) error
+}
+
+// HTTP passes when a GET of URL answers with a 2xx or 3xx status
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func (p *HTTP) Check(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", p.URL, nil)
+	if err != nil {
+		return err
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 400 {
+		return fmt.Errorf("GET %v answered %v", p.URL, response.Status)
+	}
+	return nil
+}
+
+// TCP passes when Address accepts a connection
+type TCP struct {
+	Address string
+}
+
+func (p *TCP) Check(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Exec passes when Command exits with status 0
+type Exec struct {
+	Command []string
+}
+
+func (p *Exec) Check(ctx context.Context) error {
+	if len(p.Command) == 0 {
+		return fmt.Errorf("no command to run")
+	}
+	output, err := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %v %s", p.Command[0], err, output)
+	}
+	return nil
+}
+
+// File passes when Path exists
+type File struct {
+	Path string
+}
+
+func (p *File) Check(context.Context) error {
+	_, err := os.Stat(p.Path)
+	return err
+}
+
+// Log passes once a line matching its pattern has been appended to a file after the probe was created. once
+// matched it keeps passing
+type Log struct {
+	path    string
+	pattern *regexp.Regexp
+
+	mu      sync.Mutex
+	offset  int64
+	partial []byte
+	matched bool
+}
+
+// NewLog creates a probe watching the lines appended to path from now on
+func NewLog(path, pattern string) (*Log, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log pattern %v: %v", pattern, err)
+	}
+	p := &Log{path: path, pattern: re}
+	if info, err := os.Stat(path); err == nil {
+		p.offset = info.Size()
+	}
+	return p, nil
+}
+
+func (p *Log) Check(context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.matched {
+		return nil
+	}
+
+	file, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.Size() < p.offset {
+		//truncated or replaced, start over
+		p.offset = 0
+		p.partial = nil
+	}
+	if _, err := file.Seek(p.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		p.offset += int64(len(line))
+		if err != nil {
+			//an incomplete last line is matched once it is complete
+			p.partial = append(p.partial, line...)
+			break
+		}
+		line = append(p.partial, line...)
+		p.partial = nil
+		if p.pattern.Match(bytes.TrimRight(line, "\r\n")) {
+			p.matched = true
+			return nil
+		}
+	}
+	return fmt.Errorf("no line of %v matches %v yet", p.path, p.pattern)
+}
@@ -0,0 +1,118 @@
+package probe
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestHTTP(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		writer.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	p := &HTTP{URL: server.URL + "/ready"}
+	if err := p.Check(context.Background()); err == nil {
+		t.Error("expected a 503 to fail the probe")
+	}
+	status = http.StatusOK
+	if err := p.Check(context.Background()); err != nil {
+		t.Errorf("expected a 200 to pass the probe: %v", err)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	p := &TCP{Address: address}
+	if err := p.Check(context.Background()); err != nil {
+		t.Errorf("expected the listening address to pass the probe: %v", err)
+	}
+	listener.Close()
+	if err := p.Check(context.Background()); err == nil {
+		t.Error("expected a closed port to fail the probe")
+	}
+}
+
+func TestExecAndFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ready")
+	if err := (&Exec{Command: []string{"test", "-e", path}}).Check(context.Background()); err == nil {
+		t.Error("expected the command to fail the probe")
+	}
+	if err := (&File{Path: path}).Check(context.Background()); err == nil {
+		t.Error("expected a missing file to fail the probe")
+	}
+	os.WriteFile(path, nil, 0644)
+	if err := (&Exec{Command: []string{"test", "-e", path}}).Check(context.Background()); err != nil {
+		t.Errorf("expected the command to pass the probe: %v", err)
+	}
+	if err := (&File{Path: path}).Check(context.Background()); err != nil {
+		t.Errorf("expected an existing file to pass the probe: %v", err)
+	}
+}
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.log")
+	os.WriteFile(path, []byte("listening on :8080 (previous run)\n"), 0644)
+
+	p, err := NewLog(path, `^listening on :\d+$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Check(context.Background()); err == nil {
+		t.Error("lines written before the probe was created should not match")
+	}
+
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	defer file.Close()
+	file.WriteString("starting\nlistening on ")
+	if err := p.Check(context.Background()); err == nil {
+		t.Error("an incomplete line should not match")
+	}
+	file.WriteString(":8080\n")
+	if err := p.Check(context.Background()); err != nil {
+		t.Errorf("expected the completed line to match: %v", err)
+	}
+}
+
+// grpcHealthServer answers grpc.health.v1.Health/Check with the given serving status, over h2c
+func grpcHealthServer(t *testing.T, serving byte) string {
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/grpc.health.v1.Health/Check" {
+			writer.Header().Set("Grpc-Status", "12")
+			return
+		}
+		io.ReadAll(request.Body)
+		writer.Header().Set("Content-Type", "application/grpc")
+		writer.Header().Set("Trailer", "Grpc-Status")
+		writer.Write([]byte{0, 0, 0, 0, 2, 0x08, serving})
+		writer.Header().Set("Grpc-Status", "0")
+	})
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String()
+}
+
+func TestGRPC(t *testing.T) {
+	p := &GRPC{Address: grpcHealthServer(t, 1), Service: "timer"}
+	if err := p.Check(context.Background()); err != nil {
+		t.Errorf("expected a SERVING service to pass the probe: %v", err)
+	}
+	p = &GRPC{Address: grpcHealthServer(t, 2)}
+	if err := p.Check(context.Background()); err == nil {
+		t.Error("expected a NOT_SERVING service to fail the probe")
+	}
+}
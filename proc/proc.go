@@ -0,0 +1,167 @@
+// Package proc reads process information from the Linux /proc filesystem.
+package proc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Root is the mount point of the proc filesystem
+var Root = "/proc"
+
+// Stat is the subset of /proc/<pid>/stat used by the agent
+type Stat struct {
+	Pid   int
+	Comm  string
+	State string
+	PPid  int
+	Pgrp  int
+	// StartTime is the time the process started after system boot, in clock ticks. together with the pid it
+	// identifies a process, since pids are reused
+	StartTime uint64
+	// UTime and STime are the CPU time spent in user and kernel mode, in clock ticks
+	UTime uint64
+	STime uint64
+	// Threads is the number of threads of the process
+	Threads int
+	// RSS is the resident set size, in pages
+	RSS int64
+}
+
+// ReadStat reads /proc/<pid>/stat
+func ReadStat(pid int) (*Stat, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("%v/%v/stat", Root, pid))
+	if err != nil {
+		return nil, err
+	}
+	return parseStat(data)
+}
+
+// Cmdline reads the command line of a process from /proc/<pid>/cmdline
+func Cmdline(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("%v/%v/cmdline", Root, pid))
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSuffix(data, []byte{0})
+	if len(data) == 0 {
+		return nil, fmt.Errorf("process %v has no command line", pid)
+	}
+	return strings.Split(string(data), "\x00"), nil
+}
+
+// FDCount returns the number of open file descriptors of a process
+func FDCount(pid int) (int, error) {
+	fds, err := ioutil.ReadDir(fmt.Sprintf("%v/%v/fd", Root, pid))
+	if err != nil {
+		return 0, err
+	}
+	return len(fds), nil
+}
+
+// clock ticks per second of the times in stat (USER_HZ), which is 100 on every Linux architecture the agent runs on
+const clockTicks = 100
+
+// Usage is the resource usage of a group of processes
+type Usage struct {
+	// Processes is the number of processes, the leader included
+	Processes int `json:"processes"`
+	// Children is the number of processes other than the leader
+	Children   int     `json:"children"`
+	Threads    int     `json:"threads"`
+	CPUSeconds float64 `json:"cpu-seconds"`
+	RSSBytes   int64   `json:"rss-bytes"`
+	OpenFDs    int     `json:"open-fds"`
+}
+
+// Add adds the usage of other, e.g. of another process group
+func (u *Usage) Add(other *Usage) {
+	u.Processes += other.Processes
+	u.Children += other.Children
+	u.Threads += other.Threads
+	u.CPUSeconds += other.CPUSeconds
+	u.RSSBytes += other.RSSBytes
+	u.OpenFDs += other.OpenFDs
+}
+
+// GroupUsage sums the resource usage of the processes of a process group. the CPU time of processes that
+// already exited is not included. processes that disappear while they are being read are skipped
+func GroupUsage(pgid int) (*Usage, error) {
+	entries, err := ioutil.ReadDir(Root)
+	if err != nil {
+		return nil, err
+	}
+	pageSize := int64(os.Getpagesize())
+	usage := &Usage{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ReadStat(pid)
+		if err != nil || stat.Pgrp != pgid || stat.State == "Z" {
+			continue
+		}
+		usage.Processes++
+		if pid != pgid {
+			usage.Children++
+		}
+		usage.Threads += stat.Threads
+		usage.CPUSeconds += float64(stat.UTime+stat.STime) / clockTicks
+		usage.RSSBytes += stat.RSS * pageSize
+		if fds, err := FDCount(pid); err == nil {
+			usage.OpenFDs += fds
+		}
+	}
+	if usage.Processes == 0 {
+		return nil, fmt.Errorf("no process in process group %v", pgid)
+	}
+	return usage, nil
+}
+
+// parseStat parses the stat line. the command name is enclosed in parentheses and may itself contain spaces and
+// parentheses, so the fields are split after the last closing parenthesis
+func parseStat(data []byte) (*Stat, error) {
+	line := string(data)
+	open, end := strings.IndexByte(line, '('), strings.LastIndexByte(line, ')')
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("malformed stat line: %q", line)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line[:open]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed stat line: %q", line)
+	}
+	// fields[0] is the state (field 3 in proc(5))
+	fields := strings.Fields(line[end+1:])
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("malformed stat line: %q", line)
+	}
+
+	s := &Stat{Pid: pid, Comm: line[open+1 : end], State: fields[0]}
+	if s.PPid, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, err
+	}
+	if s.Pgrp, err = strconv.Atoi(fields[2]); err != nil {
+		return nil, err
+	}
+	if s.UTime, err = strconv.ParseUint(fields[11], 10, 64); err != nil {
+		return nil, err
+	}
+	if s.STime, err = strconv.ParseUint(fields[12], 10, 64); err != nil {
+		return nil, err
+	}
+	if s.Threads, err = strconv.Atoi(fields[17]); err != nil {
+		return nil, err
+	}
+	if s.StartTime, err = strconv.ParseUint(fields[19], 10, 64); err != nil {
+		return nil, err
+	}
+	if s.RSS, err = strconv.ParseInt(fields[21], 10, 64); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
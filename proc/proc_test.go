@@ -0,0 +1,152 @@
+package proc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a stat line of the given command name, the other fields of proc(5) filled in
+func statLine(pid int, comm, state string, pgrp int, utime, stime uint64, threads int, rss int64) string {
+	return fmt.Sprintf("%v (%v) %v 1 %v %v 0 -1 4194560 120 0 0 0 %v %v 0 0 20 0 %v 0 4242 12345678 %v 18446744073709551615\n",
+		pid, comm, state, pgrp, pgrp, utime, stime, threads, rss)
+}
+
+// fakeRoot points Root to an empty directory for the duration of the test
+func fakeRoot(t *testing.T) string {
+	t.Helper()
+	root, previous := t.TempDir(), Root
+	Root = root
+	t.Cleanup(func() { Root = previous })
+	return root
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseStat(t *testing.T) {
+	tests := []struct {
+		name, line string
+		comm       string
+		fail       bool
+	}{
+		{"plain", statLine(42, "timer", "S", 40, 150, 50, 3, 1000), "timer", false},
+		{"spaces", statLine(42, "timer service", "S", 40, 150, 50, 3, 1000), "timer service", false},
+		{"parentheses", statLine(42, "a) 1 2 (b", "S", 40, 150, 50, 3, 1000), "a) 1 2 (b", false},
+		{"trailing parenthesis", statLine(42, "timer)", "S", 40, 150, 50, 3, 1000), "timer)", false},
+		{"empty", statLine(42, "", "S", 40, 150, 50, 3, 1000), "", false},
+		{"no parentheses", "42 timer S 1 40 40", "", true},
+		{"bad pid", strings.Replace(statLine(42, "timer", "S", 40, 150, 50, 3, 1000), "42", "x", 1), "", true},
+		{"truncated", "42 (timer) S 1 40 40 0 -1", "", true},
+		{"bad field", strings.Replace(statLine(42, "timer", "S", 40, 150, 50, 3, 1000), " 150 ", " x ", 1), "", true},
+	}
+	for _, test := range tests {
+		s, err := parseStat([]byte(test.line))
+		if test.fail {
+			if err == nil {
+				t.Errorf("%v: expected %q to be rejected, got %+v", test.name, test.line, s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		want := Stat{Pid: 42, Comm: test.comm, State: "S", PPid: 1, Pgrp: 40, StartTime: 4242, UTime: 150, STime: 50, Threads: 3, RSS: 1000}
+		if *s != want {
+			t.Errorf("%v: expected %+v, got %+v", test.name, want, *s)
+		}
+	}
+}
+
+func TestReadStat(t *testing.T) {
+	//the stat of the test itself
+	s, err := ReadStat(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Pid != os.Getpid() || s.PPid != os.Getppid() || s.Threads < 1 || s.StartTime == 0 {
+		t.Errorf("unexpected stat %+v", s)
+	}
+	if _, err := ReadStat(-1); err == nil {
+		t.Error("expected reading the stat of an unknown process to fail")
+	}
+}
+
+func TestCmdline(t *testing.T) {
+	root := fakeRoot(t)
+	tests := []struct {
+		name, cmdline string
+		want          []string
+	}{
+		{"arguments", "timer\x00-port\x009980\x00", []string{"timer", "-port", "9980"}},
+		{"no trailing NUL", "timer\x00-port", []string{"timer", "-port"}},
+		{"spaces", "/opt/timer service\x00-name\x00a b\x00", []string{"/opt/timer service", "-name", "a b"}},
+		{"empty argument", "timer\x00\x00-v\x00", []string{"timer", "", "-v"}},
+		{"kernel thread", "", nil},
+	}
+	for i, test := range tests {
+		pid := i + 1
+		writeFile(t, filepath.Join(root, fmt.Sprint(pid), "cmdline"), test.cmdline)
+		args, err := Cmdline(pid)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%v: expected an empty command line to be rejected, got %q", test.name, args)
+			}
+			continue
+		}
+		if err != nil || strings.Join(args, "|") != strings.Join(test.want, "|") || len(args) != len(test.want) {
+			t.Errorf("%v: expected %q, got %q: %v", test.name, test.want, args, err)
+		}
+	}
+	if _, err := Cmdline(100); err == nil {
+		t.Error("expected the command line of an unknown process to fail")
+	}
+}
+
+func TestGroupUsage(t *testing.T) {
+	root := fakeRoot(t)
+	process := func(pid int, state string, pgrp, fds int) {
+		dir := filepath.Join(root, fmt.Sprint(pid))
+		writeFile(t, filepath.Join(dir, "stat"), statLine(pid, "timer", state, pgrp, 150, 50, 2, 10))
+		os.MkdirAll(filepath.Join(dir, "fd"), 0755)
+		for fd := 0; fd < fds; fd++ {
+			writeFile(t, filepath.Join(dir, "fd", fmt.Sprint(fd)), "")
+		}
+	}
+	process(100, "S", 100, 3)
+	process(101, "R", 100, 2)
+	process(102, "Z", 100, 0) //zombies are left out
+	process(200, "S", 200, 5) //another group
+	writeFile(t, filepath.Join(root, "self", "stat"), "not a process")
+	os.MkdirAll(filepath.Join(root, "103"), 0755) //a process that exited while it was listed
+
+	usage, err := GroupUsage(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageSize := int64(os.Getpagesize())
+	want := Usage{Processes: 2, Children: 1, Threads: 4, CPUSeconds: 4, RSSBytes: 20 * pageSize, OpenFDs: 5}
+	if *usage != want {
+		t.Errorf("expected %+v, got %+v", want, *usage)
+	}
+
+	usage.Add(&Usage{Processes: 1, Threads: 1, CPUSeconds: 0.5, RSSBytes: pageSize, OpenFDs: 1})
+	if want := (Usage{Processes: 3, Children: 1, Threads: 5, CPUSeconds: 4.5, RSSBytes: 21 * pageSize, OpenFDs: 6}); *usage != want {
+		t.Errorf("expected the usages to be added to %+v, got %+v", want, *usage)
+	}
+
+	if _, err := GroupUsage(300); err == nil {
+		t.Error("expected an empty process group to fail")
+	}
+}
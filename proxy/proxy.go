@@ -0,0 +1,433 @@
+// Package proxy forwards the requests (HTTP) or connections (TCP) accepted on a local listener to a changing set of
+// backends, balancing them round-robin or to the backend with the least active connections, retrying the failed
+// attempts that are safe to send again on other backends and ejecting the backends that keep failing for a while.
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modes and balancing policies
+const (
+	TCP  = "tcp"
+	HTTP = "http"
+
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-connections"
+)
+
+// Logger is the logging interface of the proxy. *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Config of a proxy. zero values take the defaults noted
+type Config struct {
+	// Name of the proxy in the logs
+	Name string
+	// Mode is HTTP (by default) or TCP
+	Mode string
+	// Balancing is RoundRobin (by default) or LeastConnections
+	Balancing string
+	// Retries is the number of further backends tried after a failed attempt that is safe to send again
+	Retries int
+	// EjectAfter consecutive failures eject a backend for EjectFor. backends are never ejected if EjectAfter is zero
+	EjectAfter int
+	EjectFor   time.Duration
+	// DialTimeout bounds the connection to a backend, 5s by default
+	DialTimeout time.Duration
+	Logger      Logger
+}
+
+// Backend is an instance the proxy forwards to
+type Backend struct {
+	// Address is the host:port connections are forwarded to
+	Address string `json:"address"`
+	// URL is the base URL requests are forwarded to in HTTP mode: the path of a request is appended to its path
+	URL string `json:"url,omitempty"`
+}
+
+// BackendStatus is the state of a backend as seen by the proxy
+type BackendStatus struct {
+	Backend
+	Active       int        `json:"active"`
+	Failures     int        `json:"failures"`
+	EjectedUntil *time.Time `json:"ejected-until,omitempty"`
+}
+
+// Proxy forwards to the backends set by SetBackends
+type Proxy struct {
+	config    Config
+	transport *http.Transport
+
+	mu       sync.Mutex
+	backends []*backend
+	//round-robin position
+	next   int
+	server *http.Server
+}
+
+type backend struct {
+	Backend
+	target       *url.URL
+	active       int
+	failures     int
+	ejectedUntil time.Time
+}
+
+// the response statuses of a backend that count as failed attempts
+var failedStatuses = map[int]bool{http.StatusBadGateway: true, http.StatusServiceUnavailable: true, http.StatusGatewayTimeout: true}
+
+// the methods whose requests can be sent again after a backend received them. other requests are only retried when
+// they carry an Idempotency-Key, or did not reach the backend
+var idempotentMethods = map[string]bool{http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true, http.MethodPut: true, http.MethodDelete: true}
+
+// request bodies up to this size are buffered, so that they can be sent again on a retry. larger ones are streamed
+// to a single backend
+const maxRetryBody = 1 << 20
+
+// headers that only apply to a single connection, not forwarded
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// New creates a proxy without backends
+func New(config Config) *Proxy {
+	if config.Mode == "" {
+		config.Mode = HTTP
+	}
+	if config.Balancing == "" {
+		config.Balancing = RoundRobin
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: config.DialTimeout}
+	return &Proxy{
+		config: config,
+		transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// SetBackends replaces the backends. backends that remain keep their active connections and failures
+func (p *Proxy) SetBackends(backends []Backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	existing := make(map[Backend]*backend)
+	for _, b := range p.backends {
+		existing[b.Backend] = b
+	}
+	var updated []*backend
+	for _, spec := range backends {
+		if b, ok := existing[spec]; ok {
+			updated = append(updated, b)
+			delete(existing, spec)
+			continue
+		}
+		//a backend without a URL is called over plain HTTP at its address
+		b := &backend{Backend: spec, target: &url.URL{Scheme: "http", Host: spec.Address}}
+		if spec.URL != "" {
+			target, err := url.Parse(spec.URL)
+			if err != nil {
+				p.logf("ignoring backend %v: %v", spec.URL, err)
+				continue
+			}
+			b.target = target
+		}
+		updated = append(updated, b)
+	}
+	p.backends = updated
+}
+
+// Backends returns the state of the backends
+func (p *Proxy) Backends() []BackendStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var statuses []BackendStatus
+	for _, b := range p.backends {
+		status := BackendStatus{Backend: b.Backend, Active: b.active, Failures: b.failures}
+		if b.ejectedUntil.After(time.Now()) {
+			ejectedUntil := b.ejectedUntil
+			status.EjectedUntil = &ejectedUntil
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Serve forwards what is accepted on listener until it is closed or Close is called
+func (p *Proxy) Serve(listener net.Listener) error {
+	if p.config.Mode == HTTP {
+		server := &http.Server{Handler: p}
+		p.mu.Lock()
+		p.server = server
+		p.mu.Unlock()
+		return server.Serve(listener)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.forward(conn)
+	}
+}
+
+// Close closes the idle connections to the backends, and in HTTP mode the listener and the idle client connections
+func (p *Proxy) Close() error {
+	p.transport.CloseIdleConnections()
+	p.mu.Lock()
+	server := p.server
+	p.mu.Unlock()
+	if server != nil {
+		return server.Close()
+	}
+	return nil
+}
+
+// pick the backend of the next attempt, skipping those already tried. the ejected backends are only picked when
+// all others have been tried, so that the proxy still tries something when every backend failed
+func (p *Proxy) pick(tried map[*backend]bool) *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var candidates, ejected []*backend
+	for i := range p.backends {
+		b := p.backends[(p.next+i)%len(p.backends)]
+		if tried[b] {
+			continue
+		}
+		if b.ejectedUntil.After(now) {
+			ejected = append(ejected, b)
+		} else {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = ejected
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	chosen := candidates[0]
+	if p.config.Balancing == LeastConnections {
+		for _, b := range candidates[1:] {
+			if b.active < chosen.active {
+				chosen = b
+			}
+		}
+	}
+	p.next++
+	chosen.active++
+	return chosen
+}
+
+// account for the end of an attempt on a backend
+func (p *Proxy) done(b *backend, err error) {
+	p.report(b, err)
+	p.release(b)
+}
+
+// account for the outcome of an attempt on a backend, ejecting it after too many consecutive failures
+func (p *Proxy) report(b *backend, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if p.config.EjectAfter > 0 && b.failures >= p.config.EjectAfter {
+		b.failures = 0
+		b.ejectedUntil = time.Now().Add(p.config.EjectFor)
+		p.logf("ejecting backend %v for %v: %v", b.name(), p.config.EjectFor, err)
+	}
+}
+
+// account for the end of a connection to a backend
+func (p *Proxy) release(b *backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.active--
+}
+
+// only connecting is retried: once a connection is forwarded its data cannot be replayed
+func (p *Proxy) forward(conn net.Conn) {
+	defer conn.Close()
+	tried := make(map[*backend]bool)
+	for attempt := 0; attempt <= p.config.Retries; attempt++ {
+		b := p.pick(tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+		upstream, err := net.DialTimeout("tcp", b.Address, p.config.DialTimeout)
+		if err != nil {
+			p.done(b, err)
+			p.logf("unable to connect to backend %v: %v", b.name(), err)
+			continue
+		}
+		p.report(b, nil)
+		pipe(conn, upstream)
+		p.release(b)
+		return
+	}
+	if len(tried) == 0 {
+		p.logf("no backend to forward a connection to")
+	}
+}
+
+// copy both ways until either side closes
+func pipe(conn, upstream net.Conn) {
+	defer upstream.Close()
+	finished := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		//pass the end of the stream on, and let the other direction finish
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		finished <- struct{}{}
+	}
+	go copyHalf(upstream, conn)
+	go copyHalf(conn, upstream)
+	<-finished
+	<-finished
+}
+
+// ServeHTTP forwards a request in HTTP mode. a failed attempt is retried on another backend when the request did not
+// reach the backend, or when it is idempotent
+func (p *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	retries := p.config.Retries
+	var buffered []byte
+	var stream io.Reader = request.Body
+	if retries > 0 && request.Body != nil {
+		var err error
+		if buffered, err = io.ReadAll(io.LimitReader(request.Body, maxRetryBody+1)); err != nil {
+			http.Error(writer, fmt.Sprintf("unable to read the request: %v", err), http.StatusBadRequest)
+			return
+		}
+		stream = nil
+		if len(buffered) > maxRetryBody {
+			//too large to be kept for a retry
+			stream, buffered, retries = io.MultiReader(bytes.NewReader(buffered), request.Body), nil, 0
+		}
+	}
+	idempotent := idempotentMethods[request.Method] || request.Header.Get("Idempotency-Key") != ""
+
+	tried := make(map[*backend]bool)
+	var lastErr error
+	//the response of the last backend that answered with a failed status, passed on if no other backend does better
+	var failed *http.Response
+	for attempt := 0; attempt <= retries; attempt++ {
+		b := p.pick(tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+		body, length := stream, request.ContentLength
+		if stream == nil {
+			body, length = bytes.NewReader(buffered), int64(len(buffered))
+		}
+		response, err := p.transport.RoundTrip(p.outgoing(request, b, body, length))
+		if err == nil && !failedStatuses[response.StatusCode] {
+			if failed != nil {
+				failed.Body.Close()
+			}
+			p.respond(writer, response)
+			p.done(b, nil)
+			return
+		}
+		//a request the backend received may have had effects already
+		retryable := idempotent || err != nil && dialFailed(err)
+		if err == nil {
+			err = fmt.Errorf("answered %v", response.Status)
+			if failed != nil {
+				failed.Body.Close()
+			}
+			failed = response
+		}
+		p.done(b, err)
+		lastErr = err
+		p.logf("%v %v on backend %v failed: %v", request.Method, request.URL.Path, b.name(), err)
+		if !retryable {
+			break
+		}
+	}
+
+	switch {
+	case failed != nil:
+		p.respond(writer, failed)
+	case lastErr != nil:
+		http.Error(writer, fmt.Sprintf("all backends failed: %v", lastErr), http.StatusBadGateway)
+	default:
+		http.Error(writer, "no backend available", http.StatusServiceUnavailable)
+	}
+}
+
+// whether an attempt failed to connect to the backend, before anything of the request was sent
+func dialFailed(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// the request to a backend: the path and query of the request appended to the URL of the backend
+func (p *Proxy) outgoing(request *http.Request, b *backend, body io.Reader, length int64) *http.Request {
+	target := *b.target
+	target.Path = strings.TrimSuffix(target.Path, "/") + request.URL.Path
+	target.RawPath = ""
+	target.RawQuery = request.URL.RawQuery
+
+	out, _ := http.NewRequestWithContext(request.Context(), request.Method, target.String(), body)
+	out.Header = request.Header.Clone()
+	for _, header := range hopHeaders {
+		out.Header.Del(header)
+	}
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		out.Header.Set("X-Forwarded-For", host)
+	}
+	out.Header.Set("X-Forwarded-Host", request.Host)
+	out.ContentLength = length
+	if length == 0 {
+		out.Body = http.NoBody
+	}
+	return out
+}
+
+func (p *Proxy) respond(writer http.ResponseWriter, response *http.Response) {
+	defer response.Body.Close()
+	for _, header := range hopHeaders {
+		response.Header.Del(header)
+	}
+	for key, values := range response.Header {
+		writer.Header()[key] = values
+	}
+	writer.WriteHeader(response.StatusCode)
+	io.Copy(writer, response.Body)
+}
+
+func (b *backend) name() string {
+	if b.URL != "" {
+		return b.URL
+	}
+	return b.Address
+}
+
+func (p *Proxy) logf(format string, v ...interface{}) {
+	if p.config.Logger == nil {
+		return
+	}
+	p.config.Logger.Printf("proxy %v: "+format, append([]interface{}{p.config.Name}, v...)...)
+}
@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve the proxy on a local port, closing it with the test
+func serve(t *testing.T, p *Proxy) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(listener)
+	t.Cleanup(func() {
+		listener.Close()
+		p.Close()
+	})
+	return listener.Addr().String()
+}
+
+// a TCP server answering every line with its name
+func namedServer(t *testing.T, name string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					fmt.Fprintf(conn, "%v %v\n", name, scanner.Text())
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// a local address nothing listens on
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func ask(t *testing.T, address string) string {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintln(conn, "ping")
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(answer)
+}
+
+func TestTCPRoundRobin(t *testing.T) {
+	p := New(Config{Mode: TCP})
+	p.SetBackends([]Backend{{Address: namedServer(t, "a")}, {Address: namedServer(t, "b")}})
+	address := serve(t, p)
+
+	answers := map[string]int{}
+	for i := 0; i < 4; i++ {
+		answers[ask(t, address)]++
+	}
+	if answers["a ping"] != 2 || answers["b ping"] != 2 {
+		t.Errorf("expected the connections spread evenly over both backends, got %v", answers)
+	}
+}
+
+func TestTCPRetryAndEjection(t *testing.T) {
+	p := New(Config{Mode: TCP, Retries: 1, EjectAfter: 2, EjectFor: time.Minute})
+	dead := closedAddress(t)
+	p.SetBackends([]Backend{{Address: dead}, {Address: namedServer(t, "a")}})
+	address := serve(t, p)
+
+	for i := 0; i < 4; i++ {
+		if answer := ask(t, address); answer != "a ping" {
+			t.Fatalf("expected the retry to reach the live backend, got %q", answer)
+		}
+	}
+	for _, status := range p.Backends() {
+		if status.Address == dead && status.EjectedUntil == nil {
+			t.Errorf("expected the dead backend to be ejected: %+v", status)
+		}
+	}
+
+	//nothing is attempted on the ejected backend any more
+	for i := 0; i < 2; i++ {
+		ask(t, address)
+	}
+	for _, status := range p.Backends() {
+		if status.Address == dead && status.Failures != 0 {
+			t.Errorf("expected the ejected backend to be skipped: %+v", status)
+		}
+	}
+
+	//the backends that remain keep their state across updates
+	p.SetBackends([]Backend{{Address: dead}})
+	if statuses := p.Backends(); len(statuses) != 1 || statuses[0].EjectedUntil == nil {
+		t.Errorf("expected the ejection to be kept: %+v", statuses)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	p := New(Config{Mode: TCP, Balancing: LeastConnections})
+	a, b := namedServer(t, "a"), namedServer(t, "b")
+	p.SetBackends([]Backend{{Address: a}, {Address: b}})
+	address := serve(t, p)
+
+	//a held connection makes its backend the busier one
+	held, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	fmt.Fprintln(held, "hold")
+	first, _ := bufio.NewReader(held).ReadString('\n')
+	busy := strings.Fields(first)[0]
+
+	for i := 0; i < 3; i++ {
+		if answer := ask(t, address); strings.HasPrefix(answer, busy) {
+			t.Errorf("expected the backend without connections, got %q", answer)
+		}
+		//until the proxy saw the connection end
+		for deadline := time.Now().Add(5 * time.Second); active(p) != 1 && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func active(p *Proxy) int {
+	total := 0
+	for _, status := range p.Backends() {
+		total += status.Active
+	}
+	return total
+}
+
+func TestHTTP(t *testing.T) {
+	var failing, healthy []string
+	bad := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		failing = append(failing, request.URL.Path)
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		healthy = append(healthy, request.URL.Path)
+		fmt.Fprintf(writer, "%v %v?%v %s", request.Method, request.URL.Path, request.URL.RawQuery, body)
+	}))
+	defer good.Close()
+
+	p := New(Config{Retries: 1, EjectAfter: 1, EjectFor: time.Minute})
+	p.SetBackends([]Backend{{URL: bad.URL + "/v1"}, {URL: good.URL + "/v1/"}})
+	address := serve(t, p)
+
+	request, _ := http.NewRequest("POST", "http://"+address+"/time?zone=utc", strings.NewReader("now"))
+	request.Header.Set("Idempotency-Key", "1")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || string(body) != "POST /v1/time?zone=utc now" {
+		t.Errorf("expected the request retried on the healthy backend, got %v %q", response.Status, body)
+	}
+	if len(failing) != 1 || failing[0] != "/v1/time" {
+		t.Errorf("expected one attempt on the failing backend, got %v", failing)
+	}
+
+	//the failing backend is ejected after its failure
+	for i := 0; i < 2; i++ {
+		response, err := http.Get("http://" + address + "/time")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+	if len(failing) != 1 || len(healthy) != 3 {
+		t.Errorf("expected the ejected backend to be skipped, got %v and %v", failing, healthy)
+	}
+
+	//the failed answer is passed on when no backend does better
+	p.SetBackends([]Backend{{URL: bad.URL}})
+	if response, err := http.Get("http://" + address + "/time"); err != nil || response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the 503 of the only backend, got %v %v", response, err)
+	}
+	p.SetBackends(nil)
+	if response, err := http.Get("http://" + address + "/time"); err != nil || response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 without backends, got %v %v", response, err)
+	}
+}
+
+func TestHTTPRetries(t *testing.T) {
+	var attempts []string
+	bad := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		attempts = append(attempts, "bad")
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		attempts = append(attempts, "good")
+		fmt.Fprintf(writer, "%v", len(body))
+	}))
+	defer good.Close()
+	post := func(address string, size int) (int, string) {
+		t.Helper()
+		response, err := http.Post("http://"+address+"/", "text/plain", strings.NewReader(strings.Repeat("x", size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+
+	//a proxy of its own for every case, so that the backends are tried in order
+	proxied := func(backends ...Backend) string {
+		attempts = nil
+		p := New(Config{Retries: 1})
+		p.SetBackends(backends)
+		return serve(t, p)
+	}
+
+	//a request that is not idempotent is not sent again once a backend received it
+	if status, _ := post(proxied(Backend{URL: bad.URL}, Backend{URL: good.URL}), 3); status != http.StatusServiceUnavailable || strings.Join(attempts, ",") != "bad" {
+		t.Errorf("expected the POST passed on after the failed attempt, got %v after %v", status, attempts)
+	}
+
+	//but is when it could not reach the backend
+	if status, body := post(proxied(Backend{Address: closedAddress(t)}, Backend{URL: good.URL}), 3); status != http.StatusOK || body != "3" {
+		t.Errorf("expected the POST retried after the failed connection, got %v %q", status, body)
+	}
+
+	//a body too large to be buffered is streamed to a single backend
+	if status, body := post(proxied(Backend{URL: good.URL}), maxRetryBody+1); status != http.StatusOK || body != fmt.Sprint(maxRetryBody+1) {
+		t.Errorf("expected the large body streamed, got %v %q", status, body)
+	}
+	request, _ := http.NewRequest("PUT", "http://"+proxied(Backend{URL: bad.URL}, Backend{URL: good.URL})+"/", strings.NewReader(strings.Repeat("x", maxRetryBody+1)))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable || strings.Join(attempts, ",") != "bad" {
+		t.Errorf("expected the large PUT not to be retried, got %v after %v", response.Status, attempts)
+	}
+}
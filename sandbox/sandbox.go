@@ -0,0 +1,226 @@
+// Package sandbox isolates the managed process: it runs it in its own mount, PID, IPC and UTS namespaces, with a
+// private /tmp, read-only bind mounts, no-new-privs, an unprivileged user and rlimits.
+//
+// The namespaces are created by the clone of the process, the rest has to happen inside them before the managed
+// binary runs. Wrap therefore starts the binary that embeds the agent once more as a shim, which sets up the sandbox
+// and execs the managed binary in place, keeping its pid. Binaries that start sandboxed processes must call Init
+// first thing in main, the agent package included.
+//
+// The shim does not stay around: in a PID namespace the managed binary itself is pid 1 of the namespace, so it must
+// be one that reaps its orphaned descendants (an init such as tini or dumb-init wrapping the service will do).
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// environment variable holding the configuration of the shim
+const configEnv = "TMGC_SANDBOX"
+
+// Namespaces maps the namespaces a process can be given to their clone flags
+var Namespaces = map[string]uintptr{
+	"mount": syscall.CLONE_NEWNS,
+	"pid":   syscall.CLONE_NEWPID,
+	"ipc":   syscall.CLONE_NEWIPC,
+	"uts":   syscall.CLONE_NEWUTS,
+}
+
+// Config of a sandbox. the zero value isolates nothing
+type Config struct {
+	// Namespaces the process gets, keys of Namespaces. a private /tmp, bind mounts and a PID namespace imply a mount
+	// namespace. in a PID namespace the managed binary is pid 1: it must reap the orphans of the namespace, and
+	// ignores the signals it has no handler for
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Credential the process runs with, nil to keep the one of the agent
+	Credential *syscall.Credential `json:"credential,omitempty"`
+	// PrivateTmp mounts an empty tmpfs on /tmp
+	PrivateTmp bool `json:"private-tmp,omitempty"`
+	// ReadOnlyPaths are bind mounted read-only onto themselves, "/" making the whole root file system read-only
+	ReadOnlyPaths []string `json:"read-only-paths,omitempty"`
+	// WritablePaths are bind mounted writable onto themselves, after the read-only ones
+	WritablePaths []string `json:"writable-paths,omitempty"`
+	// NoNewPrivs keeps the process and its children from gaining privileges, e.g. through setuid binaries
+	NoNewPrivs bool `json:"no-new-privs,omitempty"`
+	// Rlimits are set before the credential is dropped, so they may exceed the hard limits of the user
+	Rlimits []Rlimit `json:"rlimits,omitempty"`
+}
+
+// Rlimit sets both the soft and the hard limit of a resource, unix.RLIMIT_NOFILE for instance, to Value
+type Rlimit struct {
+	Resource int    `json:"resource"`
+	Value    uint64 `json:"value"`
+}
+
+// configuration handed to the shim
+type shim struct {
+	Config
+	// Path of the managed binary
+	Path string `json:"path"`
+}
+
+func (c *Config) mounts() bool {
+	return c.PrivateTmp || len(c.ReadOnlyPaths) > 0 || len(c.WritablePaths) > 0
+}
+
+func (c *Config) cloneflags() (uintptr, error) {
+	var flags uintptr
+	for _, namespace := range c.Namespaces {
+		flag, ok := Namespaces[namespace]
+		if !ok {
+			return 0, fmt.Errorf("unknown namespace %v", namespace)
+		}
+		flags |= flag
+	}
+	//a PID namespace needs a /proc of its own, mounted in a mount namespace so that the host keeps its /proc
+	if c.mounts() || flags&syscall.CLONE_NEWPID != 0 {
+		flags |= syscall.CLONE_NEWNS
+	}
+	return flags, nil
+}
+
+// Wrap changes a command that is not started yet to run in the sandbox, through the shim. the arguments, the
+// environment and the pid of the process are those of the unwrapped command
+func Wrap(config *Config, command *exec.Cmd) error {
+	flags, err := config.cloneflags()
+	if err != nil {
+		return err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find the binary of the sandbox shim: %v", err)
+	}
+	data, err := json.Marshal(shim{Config: *config, Path: command.Path})
+	if err != nil {
+		return err
+	}
+
+	env := command.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	command.Path = self
+	command.Env = append(env, configEnv+"="+string(data))
+	if command.SysProcAttr == nil {
+		command.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	command.SysProcAttr.Cloneflags |= flags
+	return nil
+}
+
+// Init runs the shim when the process was started by Wrap, and never returns in that case: it sets up the sandbox
+// and execs the managed binary, or exits with 127 when it can not
+func Init() {
+	data := os.Getenv(configEnv)
+	if data == "" {
+		return
+	}
+	//no-new-privs is a property of the thread, it must be set on the one that execs
+	runtime.LockOSThread()
+	if err := run(data); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to sandbox the managed process: %v\n", err)
+		os.Exit(127)
+	}
+}
+
+func run(data string) error {
+	var s shim
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		return fmt.Errorf("invalid sandbox configuration: %v", err)
+	}
+	if err := s.setupMounts(); err != nil {
+		return err
+	}
+	for _, rlimit := range s.Rlimits {
+		if err := unix.Setrlimit(rlimit.Resource, &unix.Rlimit{Cur: rlimit.Value, Max: rlimit.Value}); err != nil {
+			return fmt.Errorf("unable to set the limit %v to %v: %v", rlimit.Resource, rlimit.Value, err)
+		}
+	}
+	if s.NoNewPrivs {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("unable to set no-new-privs: %v", err)
+		}
+	}
+	if credential := s.Credential; credential != nil {
+		//groups first, they can not be changed any more once the user is
+		if err := syscall.Setgroups(intIds(credential.Groups)); err != nil {
+			return fmt.Errorf("unable to set the groups: %v", err)
+		}
+		if err := syscall.Setgid(int(credential.Gid)); err != nil {
+			return fmt.Errorf("unable to set the group to %v: %v", credential.Gid, err)
+		}
+		if err := syscall.Setuid(int(credential.Uid)); err != nil {
+			return fmt.Errorf("unable to set the user to %v: %v", credential.Uid, err)
+		}
+	}
+
+	var env []string
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, configEnv+"=") {
+			env = append(env, variable)
+		}
+	}
+	err := syscall.Exec(s.Path, os.Args, env)
+	return fmt.Errorf("unable to run %v: %v", s.Path, err)
+}
+
+// set up the file system of the sandbox in its mount namespace
+func (s *shim) setupMounts() error {
+	flags, _ := s.cloneflags()
+	if flags&syscall.CLONE_NEWNS == 0 {
+		return nil
+	}
+	//keep the mounts of the sandbox from propagating back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("unable to make the mounts private: %v", err)
+	}
+	for _, path := range s.ReadOnlyPaths {
+		if err := bind(path, syscall.MS_RDONLY); err != nil {
+			return err
+		}
+	}
+	for _, path := range s.WritablePaths {
+		if err := bind(path, 0); err != nil {
+			return err
+		}
+	}
+	if s.PrivateTmp {
+		if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("unable to mount a private /tmp: %v", err)
+		}
+	}
+	if flags&syscall.CLONE_NEWPID != 0 {
+		//the /proc of the host shows the processes of the host, and the pids as they are seen there
+		if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+			return fmt.Errorf("unable to mount /proc: %v", err)
+		}
+	}
+	return nil
+}
+
+// bind mount a path onto itself. a bind mount keeps the flags of the mount it comes from, so they are set by a
+// remount
+func bind(path string, flags uintptr) error {
+	if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("unable to bind mount %v: %v", path, err)
+	}
+	if err := syscall.Mount("", path, "", syscall.MS_BIND|syscall.MS_REMOUNT|flags, ""); err != nil {
+		return fmt.Errorf("unable to remount %v: %v", path, err)
+	}
+	return nil
+}
+
+func intIds(ids []uint32) []int {
+	ints := make([]int, len(ids))
+	for i, id := range ids {
+		ints[i] = int(id)
+	}
+	return ints
+}
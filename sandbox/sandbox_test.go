@@ -0,0 +1,105 @@
+package sandbox
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMain(m *testing.M) {
+	//the test binary is the shim of the sandboxed commands
+	Init()
+	os.Exit(m.Run())
+}
+
+// run a shell script in a sandbox, failing the test when it does not exit with 0
+func runSandboxed(t *testing.T, config *Config, script string) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("sandboxes need root")
+	}
+	command := exec.Command("/bin/sh", "-c", script)
+	if err := Wrap(config, command); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := command.CombinedOutput(); err != nil {
+		t.Errorf("sandboxed script failed: %v\n%s", err, output)
+	}
+}
+
+func TestNamespacesAndMounts(t *testing.T) {
+	writable := t.TempDir()
+	config := &Config{
+		Namespaces:    []string{"pid", "ipc"},
+		ReadOnlyPaths: []string{"/"},
+		WritablePaths: []string{writable},
+		NoNewPrivs:    true,
+	}
+	runSandboxed(t, config, `
+		read pid rest </proc/self/stat; [ "$pid" = 1 ] || { echo "pid $pid"; exit 1; }
+		touch /sandbox-test 2>/dev/null && { echo "/ is writable"; exit 1; }
+		touch `+writable+`/written || exit 1
+		grep -q "^NoNewPrivs:.1" /proc/self/status || { echo "no-new-privs is not set"; exit 1; }
+	`)
+	if _, err := os.Stat(filepath.Join(writable, "written")); err != nil {
+		t.Errorf("expected the write to the writable path to reach the host: %v", err)
+	}
+	if _, err := os.Stat("/sandbox-test"); err == nil {
+		os.Remove("/sandbox-test")
+	}
+}
+
+func TestPIDNamespace(t *testing.T) {
+	//the process sees the /proc of its namespace, without a mount namespace being asked for
+	runSandboxed(t, &Config{Namespaces: []string{"pid"}}, `
+		read pid rest </proc/self/stat; [ "$pid" = 1 ] || { echo "pid $pid in /proc"; exit 1; }
+	`)
+	//and the host keeps its own
+	if stat, err := ioutil.ReadFile("/proc/self/stat"); err != nil || !strings.HasPrefix(string(stat), strconv.Itoa(os.Getpid())+" ") {
+		t.Errorf("expected the /proc of the host to be left alone, got %q: %v", stat, err)
+	}
+}
+
+func TestPrivateTmp(t *testing.T) {
+	hostFile, err := ioutil.TempFile("/tmp", "sandbox-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostFile.Close()
+	defer os.Remove(hostFile.Name())
+
+	runSandboxed(t, &Config{PrivateTmp: true}, `
+		[ -z "$(ls -A /tmp)" ] || { echo "/tmp is not empty"; exit 1; }
+		touch /tmp/sandbox-private
+	`)
+	if _, err := os.Stat("/tmp/sandbox-private"); err == nil {
+		os.Remove("/tmp/sandbox-private")
+		t.Error("the private /tmp of the sandbox is the one of the host")
+	}
+}
+
+func TestCredential(t *testing.T) {
+	runSandboxed(t, &Config{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}, `
+		[ "$(id -u)" = 65534 ] && [ "$(id -G)" = 65534 ] || { id; exit 1; }
+	`)
+}
+
+func TestRlimits(t *testing.T) {
+	runSandboxed(t, &Config{Rlimits: []Rlimit{{Resource: unix.RLIMIT_NOFILE, Value: 123}, {Resource: unix.RLIMIT_CORE, Value: 0}}}, `
+		[ "$(ulimit -n)" = 123 ] && [ "$(ulimit -Hn)" = 123 ] || { echo "open files $(ulimit -n)"; exit 1; }
+		[ "$(ulimit -c)" = 0 ] || { echo "core size $(ulimit -c)"; exit 1; }
+	`)
+}
+
+func TestUnknownNamespace(t *testing.T) {
+	if err := Wrap(&Config{Namespaces: []string{"net"}}, exec.Command("/bin/true")); err == nil {
+		t.Error("expected an unknown namespace to be rejected")
+	}
+}
@@ -0,0 +1,76 @@
+// Package state persists what the agent needs to remember across restarts of the agent process.
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// State is the agent's persisted state for one managed service
+type State struct {
+	// ServiceID is the id the managed service is registered under, reused on every agent start
+	ServiceID string `json:"service-id,omitempty"`
+	// Process is the managed process last started by the agent
+	Process *Process `json:"process,omitempty"`
+	// Port allocated to the managed process, which it is registered on
+	Port int `json:"port,omitempty"`
+	// Replicas is the number of replicas the managed service was scaled to, and ConfiguredReplicas the number
+	// in the configuration at that time. a changed configuration overrides the scaling
+	Replicas           int `json:"replicas,omitempty"`
+	ConfiguredReplicas int `json:"configured-replicas,omitempty"`
+	// ProxyPorts are the ports allocated to the dependency proxies, by endpoint mapping
+	ProxyPorts map[string]int `json:"proxy-ports,omitempty"`
+}
+
+// Process identifies a running managed process, so that a restarted agent can find and adopt it
+type Process struct {
+	PID  int `json:"pid"`
+	Pgid int `json:"pgid"`
+	// StartTime is the process start time in clock ticks after boot, as in /proc/<pid>/stat. it tells the
+	// managed process apart from an unrelated process that reused its pid
+	StartTime uint64   `json:"start-time"`
+	Cmdline   []string `json:"cmdline"`
+}
+
+// Load reads the state file at path. a missing file is not an error, it yields an empty state
+func Load(path string) (*State, error) {
+	s := &State{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Save writes the state file atomically, so a crash while saving never leaves a truncated file behind
+func Save(path string, s *State) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
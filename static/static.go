@@ -0,0 +1,344 @@
+package static
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/discovery"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	statusPassing = "passing"
+
+	defaultWaitTime = 5 * time.Minute
+	pollInterval    = time.Second
+)
+
+// Catalog is the layout of the static discovery file
+type Catalog struct {
+	// Datacenter is the local datacenter, that of the services without one and of those the agent registers
+	Datacenter string    `json:"datacenter,omitempty" yaml:"datacenter,omitempty"`
+	Services   []Service `json:"services" yaml:"services"`
+}
+
+// Service is a single service instance described in the static discovery file
+type Service struct {
+	ID      string            `json:"id" yaml:"id"`
+	Name    string            `json:"name" yaml:"name"`
+	Node    string            `json:"node,omitempty" yaml:"node,omitempty"`
+	Address string            `json:"address" yaml:"address"`
+	Port    int               `json:"port" yaml:"port"`
+	Tags    []string          `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty" yaml:"meta,omitempty"`
+	// Datacenter of the instance, the local datacenter of the catalog if empty
+	Datacenter string `json:"datacenter,omitempty" yaml:"datacenter,omitempty"`
+	// TaggedAddresses are the alternative (lan, wan, lan_ipv6 ...) addresses of the instance
+	TaggedAddresses map[string]TaggedAddress `json:"tagged-addresses,omitempty" yaml:"tagged-addresses,omitempty"`
+	// Status is the health of the instance: passing, warning or critical. an empty status is treated as passing
+	Status string `json:"status,omitempty" yaml:"status,omitempty"`
+}
+
+// TaggedAddress is an alternative address of a service instance
+type TaggedAddress struct {
+	Address string `json:"address" yaml:"address"`
+	Port    int    `json:"port,omitempty" yaml:"port,omitempty"`
+}
+
+// StaticRegistry is a discovery.Registry backed by a local JSON/YAML file. The file is re-read whenever it changes
+// on disk, and services registered by the agent are kept in memory alongside the ones from the file.
+type StaticRegistry struct {
+	path string
+
+	mu         sync.Mutex
+	modTime    time.Time
+	size       int64
+	datacenter string
+	fromFile   []Service
+	registered map[string]Service
+	kv         map[string][]byte
+	index      uint64
+	changed    chan struct{}
+	done       chan struct{}
+}
+
+var _ discovery.Registry = (*StaticRegistry)(nil)
+
+// NewStaticRegistry loads the discovery file at path and starts watching it for changes
+func NewStaticRegistry(path string) (*StaticRegistry, error) {
+	r := &StaticRegistry{
+		path:       path,
+		registered: make(map[string]Service),
+		kv:         make(map[string][]byte),
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	go r.poll()
+	return r, nil
+}
+
+// Close stops watching the discovery file
+func (r *StaticRegistry) Close() {
+	close(r.done)
+}
+
+// Register a service in memory. the service is reported as passing until it is deregistered
+func (r *StaticRegistry) Register(reg *discovery.Registration) (string, error) {
+	id := reg.ID
+	if id == "" {
+		id = fmt.Sprintf("%v-%v-%v", reg.Name, reg.Type, time.Now().UnixNano())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.registered[id] = Service{
+		ID:      id,
+		Name:    reg.Name,
+		Address: reg.Address,
+		Port:    reg.Port,
+		Tags:    append([]string{reg.Type}, reg.Tags...),
+		Meta:    reg.Meta,
+		Status:  statusPassing,
+	}
+	r.notify()
+	return id, nil
+}
+
+// Deregister a service registered in memory
+func (r *StaticRegistry) Deregister(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.registered[id]; !ok {
+		return fmt.Errorf("service ( %s ) is not registered", id)
+	}
+	delete(r.registered, id)
+	r.notify()
+	return nil
+}
+
+// UpdateHealth sets the status of a service registered in memory
+func (r *StaticRegistry) UpdateHealth(id, status, _ string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	service, ok := r.registered[id]
+	if !ok {
+		return fmt.Errorf("service ( %s ) is not registered", id)
+	}
+	if service.Status != status {
+		service.Status = status
+		r.registered[id] = service
+		r.notify()
+	}
+	return nil
+}
+
+// Lookup the passing instances of a service, in the local datacenter unless opts names another
+func (r *StaticRegistry) Lookup(name, tag string, opts *discovery.QueryOptions) ([]*discovery.Instance, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	instances := r.instances(name, tag, opts)
+	if len(instances) == 0 {
+		log.Printf("service ( %s ) was not found", name)
+		return nil, fmt.Errorf("service ( %s ) was not found", name)
+	}
+	return instances, nil
+}
+
+// Watch blocks until the discovery file or the in-memory registrations change past opts.WaitIndex
+func (r *StaticRegistry) Watch(name, tag string, opts *discovery.QueryOptions) ([]*discovery.Instance, uint64, error) {
+	var waitIndex uint64
+	waitTime := defaultWaitTime
+	if opts != nil {
+		waitIndex = opts.WaitIndex
+		if opts.WaitTime > 0 {
+			waitTime = opts.WaitTime
+		}
+	}
+
+	timeout := time.NewTimer(waitTime)
+	defer timeout.Stop()
+	for {
+		r.mu.Lock()
+		if r.index > waitIndex {
+			instances, index := r.instances(name, tag, opts), r.index
+			r.mu.Unlock()
+			return instances, index, nil
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return r.instances(name, tag, opts), r.index, nil
+		}
+	}
+}
+
+// LocalServices returns the services registered in memory under name. services from the discovery file are not
+// considered local
+func (r *StaticRegistry) LocalServices(name string) ([]*discovery.Instance, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var instances []*discovery.Instance
+	for _, s := range r.registered {
+		if s.Name == name {
+			instances = append(instances, &discovery.Instance{ID: s.ID, Name: s.Name, Address: s.Address, Port: s.Port, Tags: s.Tags, Meta: s.Meta})
+		}
+	}
+	return instances, nil
+}
+
+// PutKV stores a key/value pair in memory
+func (r *StaticRegistry) PutKV(key string, value []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.kv[key] = value
+	return nil
+}
+
+// DeleteKV removes a key/value pair from memory
+func (r *StaticRegistry) DeleteKV(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.kv, key)
+	return nil
+}
+
+// instances returns the passing services matching name and tag in the datacenter of opts, the local one if it has
+// none. callers must hold r.mu
+func (r *StaticRegistry) instances(name, tag string, opts *discovery.QueryOptions) []*discovery.Instance {
+	datacenter := r.datacenter
+	if opts != nil && opts.Datacenter != "" {
+		datacenter = opts.Datacenter
+	}
+	var instances []*discovery.Instance
+	match := func(s Service) {
+		if s.Name != name || (s.Status != "" && s.Status != statusPassing) {
+			return
+		}
+		if tag != "" && !hasTag(s.Tags, tag) {
+			return
+		}
+		if s.Datacenter == "" {
+			s.Datacenter = r.datacenter
+		}
+		if s.Datacenter != datacenter {
+			return
+		}
+		instance := &discovery.Instance{
+			ID:         s.ID,
+			Name:       s.Name,
+			Node:       s.Node,
+			Datacenter: s.Datacenter,
+			Address:    s.Address,
+			Port:       s.Port,
+			Tags:       s.Tags,
+			Meta:       s.Meta,
+		}
+		if len(s.TaggedAddresses) > 0 {
+			instance.TaggedAddresses = make(map[string]discovery.TaggedAddress)
+			for key, address := range s.TaggedAddresses {
+				instance.TaggedAddresses[key] = discovery.TaggedAddress{Address: address.Address, Port: address.Port}
+			}
+		}
+		instances = append(instances, instance)
+	}
+	for _, s := range r.fromFile {
+		match(s)
+	}
+	for _, s := range r.registered {
+		match(s)
+	}
+	return instances
+}
+
+// notify wakes up all pending watches. callers must hold r.mu
+func (r *StaticRegistry) notify() {
+	r.index++
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// poll the discovery file and reload it when its modification time or size changes
+func (r *StaticRegistry) poll() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(r.path)
+			if err != nil {
+				log.Printf("unable to stat the static discovery file %v: %v", r.path, err)
+				continue
+			}
+			r.mu.Lock()
+			unchanged := info.ModTime().Equal(r.modTime) && info.Size() == r.size
+			r.mu.Unlock()
+			if unchanged {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				log.Printf("unable to reload the static discovery file %v, keeping the previous catalog: %v", r.path, err)
+				r.mu.Lock()
+				r.modTime, r.size = info.ModTime(), info.Size()
+				r.mu.Unlock()
+			}
+		}
+	}
+}
+
+// reload reads and decodes the discovery file
+func (r *StaticRegistry) reload() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+
+	var catalog Catalog
+	switch strings.ToLower(filepath.Ext(r.path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &catalog)
+	default:
+		err = json.Unmarshal(data, &catalog)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse the static discovery file %v: %v", r.path, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.datacenter = catalog.Datacenter
+	r.fromFile = catalog.Services
+	r.modTime = info.ModTime()
+	r.size = info.Size()
+	r.notify()
+	return nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package static
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aambhaik/tmgcagent/discovery"
+)
+
+const jsonCatalog = `{
+  "services": [
+    {"id": "timer-1", "name": "TimerService", "address": "timer-1.local", "port": 9980, "tags": ["Timer", "proto:http"],
+     "meta": {"path": "/time"}, "tagged-addresses": {"wan": {"address": "203.0.113.1", "port": 19980}}},
+    {"id": "timer-2", "name": "TimerService", "address": "timer-2.local", "port": 9980, "tags": ["Timer"], "status": "passing"},
+    {"id": "timer-3", "name": "TimerService", "address": "timer-3.local", "port": 9980, "tags": ["Timer"], "status": "critical"},
+    {"id": "legacy-1", "name": "TimerService", "address": "legacy.local", "port": 9980, "tags": ["Legacy"]}
+  ]
+}`
+
+const yamlCatalog = `services:
+  - id: timer-1
+    name: TimerService
+    address: timer-1.local
+    port: 9980
+    tags: [Timer, "proto:http"]
+    meta:
+      path: /time
+    tagged-addresses:
+      wan:
+        address: 203.0.113.1
+        port: 19980
+  - id: timer-2
+    name: TimerService
+    address: timer-2.local
+    port: 9980
+    tags: [Timer]
+    status: passing
+  - id: timer-3
+    name: TimerService
+    address: timer-3.local
+    port: 9980
+    tags: [Timer]
+    status: critical
+  - id: legacy-1
+    name: TimerService
+    address: legacy.local
+    port: 9980
+    tags: [Legacy]
+`
+
+// newRegistry writes the catalog to a file with the given name and loads it
+func newRegistry(t *testing.T, name, catalog string) (*StaticRegistry, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	writeCatalog(t, path, catalog)
+	r, err := NewStaticRegistry(path)
+	if err != nil {
+		t.Fatalf("unable to load %v: %v", name, err)
+	}
+	t.Cleanup(r.Close)
+	return r, path
+}
+
+func writeCatalog(t *testing.T, path, catalog string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(catalog), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the sorted ids of the instances
+func ids(instances []*discovery.Instance) string {
+	var ids []string
+	for _, instance := range instances {
+		ids = append(ids, instance.ID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestParse(t *testing.T) {
+	for _, format := range []struct{ name, catalog string }{
+		{"static.json", jsonCatalog},
+		{"static.yaml", yamlCatalog},
+		{"static.yml", yamlCatalog},
+	} {
+		r, _ := newRegistry(t, format.name, format.catalog)
+		instances, err := r.Lookup("TimerService", "Timer", nil)
+		if err != nil {
+			t.Fatalf("%v: %v", format.name, err)
+		}
+		if ids(instances) != "timer-1,timer-2" {
+			t.Fatalf("%v: expected the passing Timer instances, got %v", format.name, ids(instances))
+		}
+		timer := instances[0]
+		if timer.ID != "timer-1" {
+			timer = instances[1]
+		}
+		if timer.Address != "timer-1.local" || timer.Port != 9980 || timer.Meta["path"] != "/time" ||
+			strings.Join(timer.Tags, ",") != "Timer,proto:http" ||
+			timer.TaggedAddresses["wan"] != (discovery.TaggedAddress{Address: "203.0.113.1", Port: 19980}) {
+			t.Errorf("%v: unexpected instance %+v", format.name, timer)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "static.json")
+	writeCatalog(t, path, "services: [")
+	if _, err := NewStaticRegistry(path); err == nil {
+		t.Error("expected an invalid discovery file to be rejected")
+	}
+	if _, err := NewStaticRegistry(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected a missing discovery file to be rejected")
+	}
+}
+
+func TestInstances(t *testing.T) {
+	r, _ := newRegistry(t, "static.json", jsonCatalog)
+	tests := []struct {
+		name, service, tag string
+		want               string
+	}{
+		{"passing by tag", "TimerService", "Timer", "timer-1,timer-2"},
+		{"any tag", "TimerService", "", "legacy-1,timer-1,timer-2"},
+		{"other tag", "TimerService", "Legacy", "legacy-1"},
+		{"unknown tag", "TimerService", "Weather", ""},
+		{"unknown service", "WeatherService", "", ""},
+	}
+	for _, test := range tests {
+		instances, err := r.Lookup(test.service, test.tag, nil)
+		if got := ids(instances); got != test.want {
+			t.Errorf("%v: expected %q, got %q", test.name, test.want, got)
+		}
+		if (err != nil) != (test.want == "") {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r, _ := newRegistry(t, "static.json", jsonCatalog)
+	id, err := r.Register(&discovery.Registration{Name: "Rolex", Type: "Watch", Address: "localhost", Port: 9985, Tags: []string{"v1"}})
+	if err != nil || !strings.HasPrefix(id, "Rolex-Watch-") {
+		t.Fatalf("expected an id to be minted, got %q: %v", id, err)
+	}
+	if _, err := r.Register(&discovery.Registration{ID: "Rolex-1", Name: "Rolex", Type: "Watch", Port: 9986}); err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err := r.Lookup("Rolex", "Watch", nil)
+	if err != nil || ids(instances) != ids([]*discovery.Instance{{ID: id}, {ID: "Rolex-1"}}) {
+		t.Fatalf("expected the registered instances, got %v: %v", ids(instances), err)
+	}
+	if local, _ := r.LocalServices("Rolex"); len(local) != 2 {
+		t.Errorf("expected the registered instances to be local, got %v", ids(local))
+	}
+	if local, _ := r.LocalServices("TimerService"); len(local) != 0 {
+		t.Errorf("expected the instances of the file not to be local, got %v", ids(local))
+	}
+
+	//an instance that is not passing is not looked up
+	if err := r.UpdateHealth(id, discovery.HealthCritical, "down"); err != nil {
+		t.Fatal(err)
+	}
+	if instances, _ := r.Lookup("Rolex", "v1", nil); len(instances) != 0 {
+		t.Errorf("expected the critical instance to be left out, got %v", ids(instances))
+	}
+	r.UpdateHealth(id, discovery.HealthPassing, "")
+	if instances, _ := r.Lookup("Rolex", "v1", nil); ids(instances) != id {
+		t.Errorf("expected the passing instance again, got %v", ids(instances))
+	}
+
+	if err := r.Deregister(id); err != nil {
+		t.Fatal(err)
+	}
+	if instances, _ := r.Lookup("Rolex", "Watch", nil); ids(instances) != "Rolex-1" {
+		t.Errorf("expected the deregistered instance to be gone, got %v", ids(instances))
+	}
+	if err := r.Deregister(id); err == nil {
+		t.Error("expected deregistering an unknown instance to fail")
+	}
+	if err := r.UpdateHealth(id, discovery.HealthPassing, ""); err == nil {
+		t.Error("expected updating the health of an unknown instance to fail")
+	}
+	if err := r.Deregister("timer-1"); err == nil {
+		t.Error("expected the instances of the file not to be deregistered")
+	}
+}
+
+func TestReload(t *testing.T) {
+	r, path := newRegistry(t, "static.json", jsonCatalog)
+	_, index, _ := r.Watch("TimerService", "Timer", &discovery.QueryOptions{WaitTime: time.Millisecond})
+
+	//a change of the file is picked up by the next poll
+	writeCatalog(t, path, strings.Replace(jsonCatalog, `"critical"`, `"passing"`, 1))
+	instances, next, err := r.Watch("TimerService", "Timer", &discovery.QueryOptions{WaitIndex: index, WaitTime: 3 * pollInterval})
+	if err != nil || next <= index || ids(instances) != "timer-1,timer-2,timer-3" {
+		t.Fatalf("expected the changed file to be reloaded, got %v at %v (was %v): %v", ids(instances), next, index, err)
+	}
+
+	//a file that no longer parses leaves the previous catalog in place
+	writeCatalog(t, path, `{"services": [`)
+	instances, after, _ := r.Watch("TimerService", "Timer", &discovery.QueryOptions{WaitIndex: next, WaitTime: 2*pollInterval + pollInterval/2})
+	if after != next || ids(instances) != "timer-1,timer-2,timer-3" {
+		t.Fatalf("expected the previous catalog to be kept, got %v at %v (was %v)", ids(instances), after, next)
+	}
+
+	//and is reloaded once it is fixed
+	writeCatalog(t, path, `{"services": []}`)
+	instances, after, _ = r.Watch("TimerService", "Timer", &discovery.QueryOptions{WaitIndex: next, WaitTime: 3 * pollInterval})
+	if after <= next || len(instances) != 0 {
+		t.Errorf("expected the fixed file to be reloaded, got %v at %v (was %v)", ids(instances), after, next)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	r, _ := newRegistry(t, "static.json", jsonCatalog)
+
+	//an index behind the registry returns right away
+	instances, index, err := r.Watch("TimerService", "Timer", nil)
+	if err != nil || index == 0 || ids(instances) != "timer-1,timer-2" {
+		t.Fatalf("expected the current instances, got %v at %v: %v", ids(instances), index, err)
+	}
+
+	//an index up to date waits for the wait time, and returns the same index
+	started := time.Now()
+	instances, next, _ := r.Watch("TimerService", "Timer", &discovery.QueryOptions{WaitIndex: index, WaitTime: 100 * time.Millisecond})
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond || next != index || ids(instances) != "timer-1,timer-2" {
+		t.Errorf("expected the watch to time out with the same index, got %v at %v after %v", ids(instances), next, elapsed)
+	}
+
+	//or for a change, with a new index
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		r.Register(&discovery.Registration{ID: "timer-4", Name: "TimerService", Type: "Timer", Port: 9980})
+	}()
+	instances, next, _ = r.Watch("TimerService", "Timer", &discovery.QueryOptions{WaitIndex: index, WaitTime: 5 * time.Second})
+	if next <= index || ids(instances) != "timer-1,timer-2,timer-4" {
+		t.Errorf("expected the watch to return the registered instance, got %v at %v (was %v)", ids(instances), next, index)
+	}
+}
+
+func TestDatacenters(t *testing.T) {
+	r, _ := newRegistry(t, "static.yaml", `datacenter: dc1
+services:
+  - {id: timer-1, name: TimerService, port: 9980, tags: [Timer]}
+  - {id: timer-2, name: TimerService, port: 9980, tags: [Timer], datacenter: dc1}
+  - {id: timer-3, name: TimerService, port: 9980, tags: [Timer], datacenter: dc2}
+`)
+	r.Register(&discovery.Registration{ID: "timer-4", Name: "TimerService", Type: "Timer", Port: 9980})
+	tests := []struct {
+		datacenter string
+		want       string
+	}{
+		{"", "timer-1,timer-2,timer-4"},
+		{"dc1", "timer-1,timer-2,timer-4"},
+		{"dc2", "timer-3"},
+		{"dc3", ""},
+	}
+	for _, test := range tests {
+		instances, _ := r.Lookup("TimerService", "Timer", &discovery.QueryOptions{Datacenter: test.datacenter})
+		if got := ids(instances); got != test.want {
+			t.Errorf("datacenter %q: expected %q, got %q", test.datacenter, test.want, got)
+		}
+		for _, instance := range instances {
+			if test.datacenter != "" && instance.Datacenter != test.datacenter {
+				t.Errorf("expected %v to be in datacenter %v, it is in %q", instance.ID, test.datacenter, instance.Datacenter)
+			}
+		}
+	}
+	if instances, _, _ := r.Watch("TimerService", "Timer", &discovery.QueryOptions{Datacenter: "dc2"}); ids(instances) != "timer-3" {
+		t.Errorf("expected the watch to return the instances of dc2, got %v", ids(instances))
+	}
+}